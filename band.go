@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// watchBandAbove, when non-zero, has searches fetch listings up to this
+// many dollars over their PriceMax. Those above PriceMax are tracked
+// quietly and only alerted on once their price drops to PriceMax or
+// below.
+var watchBandAbove int
+
+// watchBand returns the search to fetch for search, with PriceMax raised
+// by watchBandAbove, and the PriceMax to alert under. The ceiling is 0,
+// and the search unchanged, when the watch band is off or the search has
+// no PriceMax.
+func watchBand(search Search) (Search, int) {
+	if watchBandAbove <= 0 {
+		return search, 0
+	}
+	ceiling, err := strconv.Atoi(search.Params.Get("PriceMax"))
+	if err != nil || ceiling <= 0 {
+		return search, 0
+	}
+
+	params := make(url.Values, len(search.Params))
+	for k, v := range search.Params {
+		params[k] = v
+	}
+	params.Set("PriceMax", strconv.Itoa(ceiling+watchBandAbove))
+	search.Params = params
+	return search, ceiling
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// runtimeBudgetPct is the share of the Lambda function's time a run may
+// use before it stops starting fetches, from RUNTIME_BUDGET_PCT. The rest
+// is left for saving what it has. 0 turns the budget off.
+var runtimeBudgetPct int
+
+type budgetKey struct{}
+
+// withRuntimeBudget returns a context holding the time by which the run
+// should stop starting fetches, runtimeBudgetPct of the way from now to the
+// context's deadline. Without a budget or a deadline, ctx is returned as
+// is.
+func withRuntimeBudget(ctx context.Context) context.Context {
+	deadline, ok := ctx.Deadline()
+	if runtimeBudgetPct <= 0 || !ok {
+		return ctx
+	}
+	now := time.Now()
+	budget := now.Add(deadline.Sub(now) * time.Duration(runtimeBudgetPct) / 100)
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// withinBudget reports whether there is still time in the run's budget to
+// wait for need and then start another fetch.
+func withinBudget(ctx context.Context, need time.Duration) bool {
+	budget, ok := ctx.Value(budgetKey{}).(time.Time)
+	return !ok || time.Now().Add(need).Before(budget)
+}
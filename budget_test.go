@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRuntimeBudgetStopsFetching(t *testing.T) {
+	defer func(pct int, ttl time.Duration, v bool) { runtimeBudgetPct, seenTTL, dryRun = pct, ttl, v }(runtimeBudgetPct, seenTTL, dryRun)
+	runtimeBudgetPct, seenTTL, dryRun = 25, 24*time.Hour, false
+
+	// The budget runs out 100ms in, while the first page takes 150ms.
+	parent, cancel := context.WithDeadline(context.Background(), time.Now().Add(400*time.Millisecond))
+	defer cancel()
+	ctx := withRuntimeBudget(parent)
+	if !withinBudget(ctx, 0) {
+		t.Fatal("budget used up before the run started")
+	}
+
+	search := Search{Name: "search", Params: url.Values{}}
+	paging := Paging{TotalRecords: 3, TotalPages: 3}
+	api := &fakeAPI{
+		pages: map[int]Listings{
+			1: {Results: []Listing{{ID: "1"}}, Paging: paging},
+			2: {Results: []Listing{{ID: "2"}}, Paging: paging},
+			3: {Results: []Listing{{ID: "3"}}, Paging: paging},
+		},
+		delay: 150 * time.Millisecond,
+	}
+	fetcher := &Fetcher{client: api, limiter: newRateLimiter(0)}
+
+	listings, err := fetcher.FetchListings(ctx, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !listings.StoppedEarly || len(api.requests) != 1 || resultIDs(listings.Results) != "1" {
+		t.Fatalf("fetched %s over pages %v, stopped early %v; want page 1 only, stopped early",
+			resultIDs(listings.Results), api.requests, listings.StoppedEarly)
+	}
+	if withinBudget(ctx, 0) {
+		t.Error("budget left after it ran out")
+	}
+
+	// A whole run stops the same way and still saves the cache: the seen
+	// listing on page 1 gets an expiry, written back on flush.
+	dynamo := newFakeDynamo()
+	dynamo.store(t, SeenListing{PartitionKey: search.PartitionKey(), ListingID: "1", Notified: true})
+	api.requests = nil
+	parent, cancel = context.WithDeadline(context.Background(), time.Now().Add(400*time.Millisecond))
+	defer cancel()
+
+	if _, err := runSearch(withRuntimeBudget(parent), dynamo, fetcher, NewRunHistory(dynamo), nil, nil, nil, nil, nil, newRecordingNotifier(), search); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("run requested pages %v, want page 1 only", api.requests)
+	}
+	if dynamo.batches != 1 {
+		t.Errorf("%d batch writes, want the cache flushed", dynamo.batches)
+	}
+	if seen, _ := dynamo.stored(t, search.PartitionKey(), "1"); seen.TTL == 0 {
+		t.Error("listing 1 was not written back with its expiry")
+	}
+}
+
+func TestWithRuntimeBudgetOff(t *testing.T) {
+	defer func(pct int) { runtimeBudgetPct = pct }(runtimeBudgetPct)
+
+	deadline, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Millisecond))
+	defer cancel()
+	runtimeBudgetPct = 0
+	if ctx := withRuntimeBudget(deadline); !withinBudget(ctx, time.Hour) {
+		t.Error("budget enforced with RUNTIME_BUDGET_PCT 0")
+	}
+	runtimeBudgetPct = 50
+	if ctx := withRuntimeBudget(context.Background()); !withinBudget(ctx, time.Hour) {
+		t.Error("budget enforced without a deadline")
+	}
+}
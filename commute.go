@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	distanceMatrixURL = "https://maps.googleapis.com/maps/api/distancematrix/json"
+
+	// dynamoCommutePartitionKey holds cached commute times, keyed by
+	// listing ID.
+	dynamoCommutePartitionKey = "commute"
+
+	defaultCommuteMode = "driving"
+)
+
+var (
+	// maxCommuteMinutes drops listings further than this from
+	// commuteDestination by commuteMode, when non-zero. Commute times come
+	// from the Google Distance Matrix API, which is billed per lookup.
+	maxCommuteMinutes    int
+	commuteDestination   string
+	commuteMode          string
+	commuteUnknownPasses bool
+	googleMapsAPIKey     string
+)
+
+// commuteModes are the COMMUTE_MODE values the Distance Matrix API takes.
+var commuteModes = []string{"driving", "transit", "walking", "bicycling"}
+
+func validCommuteMode(mode string) bool {
+	for _, m := range commuteModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+// commuteRecord is a cached commute time. Destination and Mode are kept so
+// that changing either one does not reuse stale times.
+type commuteRecord struct {
+	Destination string `dynamodbav:"destination"`
+	Mode        string `dynamodbav:"mode"`
+	// Minutes is the commute time, or 0 when there is no route.
+	Minutes int   `dynamodbav:"minutes,omitempty"`
+	TTL     int64 `dynamodbav:"ttl,omitempty"`
+}
+
+// Commuter works out how long the commute from a listing to a fixed
+// destination takes, remembering the answers in DynamoDB so each listing
+// is only looked up once.
+type Commuter struct {
+	client      httpClient
+	dynamo      dynamoAPI
+	apiKey      string
+	destination string
+	mode        string
+}
+
+func NewCommuter(client httpClient, dynamo dynamoAPI, apiKey, destination, mode string) *Commuter {
+	return &Commuter{client: client, dynamo: dynamo, apiKey: apiKey, destination: destination, mode: mode}
+}
+
+// Minutes returns the commute time from the listing, or 0 when the listing
+// has no coordinates or there is no route.
+func (c *Commuter) Minutes(ctx context.Context, listing Listing) (int, error) {
+	if listing.Latitude == 0 && listing.Longitude == 0 {
+		return 0, nil
+	}
+
+	key := map[string]*dynamodb.AttributeValue{
+		dynamoPartitionKeyName: {S: aws.String(dynamoCommutePartitionKey)},
+		dynamoSortKeyName:      {S: aws.String(listing.ID)},
+	}
+
+	cached, err := c.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       key,
+		TableName: aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if cached.Item != nil {
+		var record commuteRecord
+		if err = dynamodbattribute.UnmarshalMap(cached.Item, &record); err != nil {
+			return 0, err
+		}
+		if record.Destination == c.destination && record.Mode == c.mode {
+			return record.Minutes, nil
+		}
+	}
+
+	minutes, err := c.lookup(ctx, listing)
+	if err != nil {
+		return 0, err
+	}
+
+	item, err := dynamodbattribute.MarshalMap(commuteRecord{
+		Destination: c.destination,
+		Mode:        c.mode,
+		Minutes:     minutes,
+		TTL:         expiry(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range key {
+		item[k] = v
+	}
+	_, err = c.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dynamoTableName),
+	})
+	return minutes, err
+}
+
+func (c *Commuter) lookup(ctx context.Context, listing Listing) (int, error) {
+	query := url.Values{
+		"origins":      {strconv.FormatFloat(listing.Latitude, 'f', -1, 64) + "," + strconv.FormatFloat(listing.Longitude, 'f', -1, 64)},
+		"destinations": {c.destination},
+		"mode":         {c.mode},
+		"key":          {c.apiKey},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", distanceMatrixURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return 0, &HTTPStatusError{StatusCode: response.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Rows         []struct {
+			Elements []struct {
+				Status   string `json:"status"`
+				Duration struct {
+					Value int `json:"value"`
+				} `json:"duration"`
+			} `json:"elements"`
+		} `json:"rows"`
+	}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return 0, err
+	}
+	if result.Status != "OK" {
+		return 0, fmt.Errorf("distance matrix request failed with %s: %s", result.Status, result.ErrorMessage)
+	}
+	if len(result.Rows) == 0 || len(result.Rows[0].Elements) == 0 || result.Rows[0].Elements[0].Status != "OK" {
+		return 0, nil
+	}
+	return (result.Rows[0].Elements[0].Duration.Value + 59) / 60, nil
+}
+
+// commuteFilter drops listings whose commute takes longer than
+// maxMinutes.
+func commuteFilter(maxMinutes int, unknownPasses bool) Filter {
+	return func(listing Listing) string {
+		switch {
+		case listing.CommuteMinutes == 0:
+			if !unknownPasses {
+				return "commute time is unknown"
+			}
+		case listing.CommuteMinutes > maxMinutes:
+			return "commute longer than " + strconv.Itoa(maxMinutes) + " minutes"
+		}
+		return ""
+	}
+}
+
+// CommuteText describes the commute, e.g. "Commute: 25 min by transit", or
+// is empty when unknown.
+func (l Listing) CommuteText() string {
+	if l.CommuteMinutes == 0 {
+		return ""
+	}
+	mode := commuteMode
+	switch mode {
+	case "driving":
+		mode = "car"
+	case "bicycling":
+		mode = "bike"
+	case "walking":
+		mode = "foot"
+	}
+	return "Commute: " + strconv.Itoa(l.CommuteMinutes) + " min by " + mode
+}
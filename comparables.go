@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// dynamoComparablesPartitionKey holds when each search last had its
+	// comparables sent, keyed by search name.
+	dynamoComparablesPartitionKey = "comparables"
+
+	defaultComparablesDays     = 90
+	defaultComparablesInterval = 7 * 24 * time.Hour
+
+	// soldTransactionTypeID asks realtor.ca for sold listings instead of
+	// active ones. Solds are only published where the local board allows
+	// it, so the results may well be empty.
+	soldTransactionTypeID = "4"
+)
+
+var (
+	// comparablesEnabled sends each search a periodic digest of recent
+	// sales in its area, separately from the new-listing alerts.
+	// comparablesDays is how recent the sales have to be, and
+	// comparablesInterval how often the digest goes out.
+	comparablesEnabled  bool
+	comparablesDays     int
+	comparablesInterval time.Duration
+)
+
+// comparablesRecord is when a search's comparables were last sent.
+type comparablesRecord struct {
+	PartitionKey string `dynamodbav:"partition_key"`
+	SortKey      string `dynamodbav:"listing_id"`
+	SentAt       int64  `dynamodbav:"sent_at"`
+}
+
+// soldParams turns a search for active listings into one for listings sold
+// within the last days days.
+func soldParams(params url.Values, days int) url.Values {
+	sold := url.Values{}
+	for k, v := range params {
+		sold[k] = v
+	}
+	sold.Set("TransactionTypeId", soldTransactionTypeID)
+	sold.Set("SoldWithinDays", strconv.Itoa(days))
+	return sold
+}
+
+// FetchSold requests the listings in the search's area sold recently.
+func (f *Fetcher) FetchSold(ctx context.Context, search Search, days int) (*Listings, error) {
+	sold := Search{Name: search.Name, Params: soldParams(search.Params, days)}
+	return f.FetchListings(ctx, sold)
+}
+
+// runComparables sends the search's comparables digest, if it is due. It
+// keeps out of the seen-listings cache entirely.
+func runComparables(ctx context.Context, dynamo dynamoAPI, fetcher *Fetcher, notify Notifier, search Search) error {
+	logger := slog.With("search_name", search.Name)
+	// Sort keys cannot be empty, so the unnamed search needs a name here.
+	sortKey := search.Name
+	if sortKey == "" {
+		sortKey = "#default"
+	}
+	key := map[string]*dynamodb.AttributeValue{
+		dynamoPartitionKeyName: {S: aws.String(dynamoComparablesPartitionKey)},
+		dynamoSortKeyName:      {S: aws.String(sortKey)},
+	}
+
+	stored, err := dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       key,
+		TableName: aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return err
+	}
+	var last comparablesRecord
+	if stored.Item != nil {
+		if err = dynamodbattribute.UnmarshalMap(stored.Item, &last); err != nil {
+			return err
+		}
+	}
+	if last.SentAt > 0 && time.Since(time.Unix(last.SentAt, 0)) < comparablesInterval {
+		return nil
+	}
+
+	sold, err := fetcher.FetchSold(ctx, search, comparablesDays)
+	if err != nil {
+		return err
+	}
+	if len(sold.Results) == 0 {
+		logger.InfoContext(ctx, "No recent sales to send as comparables")
+		return nil
+	}
+	if dryRun {
+		logger.InfoContext(ctx, "Dry run: would send comparables", "action", "comparables", "count", len(sold.Results))
+		return nil
+	}
+
+	if err = notify.SendComparables(ctx, search.Name, sold.Results); err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "Sent comparables", "action", "comparables", "count", len(sold.Results))
+
+	item, err := dynamodbattribute.MarshalMap(comparablesRecord{
+		PartitionKey: dynamoComparablesPartitionKey,
+		SortKey:      sortKey,
+		SentAt:       time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dynamoTableName),
+	})
+	return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// searchEnvVars maps the environment variables that tune the default
+// search to the API parameters they set.
+var searchEnvVars = map[string]string{
+	"PRICE_MIN":  "PriceMin",
+	"PRICE_MAX":  "PriceMax",
+	"LAT_MIN":    "LatitudeMin",
+	"LAT_MAX":    "LatitudeMax",
+	"LNG_MIN":    "LongitudeMin",
+	"LNG_MAX":    "LongitudeMax",
+	"BED_RANGE":  "BedRange",
+	"BATH_RANGE": "BathRange",
+
+	"RECORDS_PER_PAGE": "RecordsPerPage",
+}
+
+// transactionTypeIDs maps TRANSACTION_TYPE values to the API's
+// TransactionTypeId.
+var transactionTypeIDs = map[string]string{
+	"sale": transactionTypeForSale,
+	"rent": transactionTypeForRent,
+}
+
+const (
+	transactionTypeForSale = "2"
+	transactionTypeForRent = "3"
+)
+
+// rentalDefaults replace the purchase defaults for rental searches, whose
+// prices are monthly rents. Rentals are listed cheapest first, as a
+// monthly budget is usually the hard limit.
+var rentalDefaults = url.Values{
+	"PriceMin": {"1500"},
+	"PriceMax": {"3000"},
+	"Sort":     {sortCheapest},
+}
+
+// applyRentalDefaults puts the rental defaults in place of the purchase
+// ones in params. A sort order set with SORT is kept.
+func applyRentalDefaults(params url.Values) {
+	for k, v := range rentalDefaults {
+		if k == "Sort" && os.Getenv("SORT") != "" {
+			continue
+		}
+		params[k] = v
+	}
+}
+
+// sortOrders maps SORT values to the API's Sort parameter.
+var sortOrders = map[string]string{
+	"newest":     sortNewest,
+	"oldest":     "6-A",
+	"price_asc":  sortCheapest,
+	"price_desc": "1-D",
+}
+
+// minRecordsPerPage and maxRecordsPerPage bound the page size the API
+// takes; RecordsPerPage outside them is clamped.
+const (
+	minRecordsPerPage = 1
+	maxRecordsPerPage = 200
+)
+
+// sortNewest lists the most recently posted listings first, so when
+// MAX_PAGES cuts a search short it is the oldest that are missed.
+const sortNewest = "6-D"
+
+// sortCheapest lists the lowest prices first.
+const sortCheapest = "1-A"
+
+// buildPayload returns the default search parameters, with any set in the
+// environment taking precedence over the built-in values.
+func buildPayload() (url.Values, error) {
+	params := url.Values{
+		"ZoomLevel":            {"13"},
+		"LatitudeMax":          {"43.51949"},
+		"LongitudeMax":         {"-80.43042"},
+		"LatitudeMin":          {"43.42644"},
+		"LongitudeMin":         {"-80.66406"},
+		"Sort":                 {sortNewest},
+		"PropertyTypeGroupID":  {"1"},
+		"PropertySearchTypeId": {"1"},
+		"TransactionTypeId":    {"2"},
+		"PriceMin":             {"539000"},
+		"PriceMax":             {"701000"},
+		"BedRange":             {"3-0"},
+		"BathRange":            {"2-0"},
+		"BuildingTypeId":       {"1"},
+		"ConstructionStyleId":  {"3"},
+		"Currency":             {searchCurrency},
+		"RecordsPerPage":       {"20"},
+		"ApplicationId":        {"1"},
+		"CultureId":            {"1"},
+		"Version":              {"7.0"},
+		"CurrentPage":          {""},
+	}
+
+	transactionType := envVar("TRANSACTION_TYPE", "sale")
+	transactionTypeID, ok := transactionTypeIDs[transactionType]
+	if !ok {
+		return nil, fmt.Errorf("unknown TRANSACTION_TYPE %q, expected sale or rent", transactionType)
+	}
+	params.Set("TransactionTypeId", transactionTypeID)
+	if transactionTypeID == transactionTypeForRent {
+		applyRentalDefaults(params)
+	}
+
+	if order := os.Getenv("SORT"); order != "" {
+		sort, ok := sortOrders[order]
+		if !ok {
+			return nil, fmt.Errorf("unknown SORT %q, expected newest, oldest, price_asc or price_desc", order)
+		}
+		params.Set("Sort", sort)
+	}
+
+	for key, param := range searchEnvVars {
+		if v := os.Getenv(key); v != "" {
+			params.Set(param, v)
+		}
+	}
+
+	if err := validateSearchParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// validateSearchParams checks that the transaction type is one we can
+// label and the numeric ranges of a search are well-formed, and clamps
+// RecordsPerPage to what the API takes.
+func validateSearchParams(params url.Values) error {
+	switch id := params.Get("TransactionTypeId"); id {
+	case transactionTypeForSale, transactionTypeForRent:
+	default:
+		return fmt.Errorf("unsupported TransactionTypeId %q, expected %s (sale) or %s (rent)",
+			id, transactionTypeForSale, transactionTypeForRent)
+	}
+
+	if currency := params.Get("Currency"); currency != "" && !validCurrency(currency) {
+		return fmt.Errorf("unsupported Currency %q, expected a code such as CAD or USD", currency)
+	}
+
+	if sort := params.Get("Sort"); sort != "" && !validSort(sort) {
+		return fmt.Errorf("unsupported Sort %q", sort)
+	}
+
+	ranges := [][2]string{
+		{"PriceMin", "PriceMax"},
+		{"LatitudeMin", "LatitudeMax"},
+		{"LongitudeMin", "LongitudeMax"},
+	}
+	for _, r := range ranges {
+		lo, err := floatParam(params, r[0])
+		if err != nil {
+			return err
+		}
+		hi, err := floatParam(params, r[1])
+		if err != nil {
+			return err
+		}
+		if params.Get(r[0]) != "" && params.Get(r[1]) != "" && lo > hi {
+			return fmt.Errorf("%s (%s) is greater than %s (%s)", r[0], params.Get(r[0]), r[1], params.Get(r[1]))
+		}
+	}
+
+	if v := params.Get("RecordsPerPage"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("RecordsPerPage is not a whole number: %q", v)
+		}
+		if clamped := clampRecordsPerPage(perPage); clamped != perPage {
+			slog.Warn(fmt.Sprintf("RecordsPerPage %d is out of range, using %d", perPage, clamped),
+				"records_per_page", clamped, "requested", perPage, "min", minRecordsPerPage, "max", maxRecordsPerPage)
+			params.Set("RecordsPerPage", strconv.Itoa(clamped))
+		}
+	}
+	return nil
+}
+
+func clampRecordsPerPage(perPage int) int {
+	switch {
+	case perPage < minRecordsPerPage:
+		return minRecordsPerPage
+	case perPage > maxRecordsPerPage:
+		return maxRecordsPerPage
+	}
+	return perPage
+}
+
+func floatParam(params url.Values, name string) (float64, error) {
+	v := params.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number: %q", name, v)
+	}
+	return f, nil
+}
+
+func validSort(sort string) bool {
+	for _, v := range sortOrders {
+		if sort == v {
+			return true
+		}
+	}
+	return false
+}
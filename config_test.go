@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestValidateSearchParamsCurrency(t *testing.T) {
+	tests := []struct {
+		currency string
+		wantErr  bool
+	}{
+		{currency: ""},
+		{currency: "CAD"},
+		{currency: "USD"},
+		{currency: "usd", wantErr: true},
+		{currency: "DOLLARS", wantErr: true},
+	}
+	for _, tt := range tests {
+		params := url.Values{"TransactionTypeId": {transactionTypeForSale}}
+		if tt.currency != "" {
+			params.Set("Currency", tt.currency)
+		}
+		if err := validateSearchParams(params); (err != nil) != tt.wantErr {
+			t.Errorf("validateSearchParams with Currency %q: got error %v, want error %v", tt.currency, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClampRecordsPerPage(t *testing.T) {
+	tests := []struct {
+		perPage int
+		want    int
+	}{
+		{perPage: -5, want: minRecordsPerPage},
+		{perPage: 0, want: minRecordsPerPage},
+		{perPage: 1, want: 1},
+		{perPage: 20, want: 20},
+		{perPage: maxRecordsPerPage, want: maxRecordsPerPage},
+		{perPage: maxRecordsPerPage + 1, want: maxRecordsPerPage},
+		{perPage: 1000, want: maxRecordsPerPage},
+	}
+	for _, tt := range tests {
+		if got := clampRecordsPerPage(tt.perPage); got != tt.want {
+			t.Errorf("clampRecordsPerPage(%d) = %d, want %d", tt.perPage, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSearchParamsRecordsPerPage(t *testing.T) {
+	tests := []struct {
+		perPage string
+		want    string
+		wantErr bool
+	}{
+		{perPage: "50", want: "50"},
+		{perPage: "0", want: "1"},
+		{perPage: "-3", want: "1"},
+		{perPage: "500", want: "200"},
+		{perPage: "many", wantErr: true},
+	}
+	for _, tt := range tests {
+		params := url.Values{"TransactionTypeId": {transactionTypeForSale}, "RecordsPerPage": {tt.perPage}}
+		err := validateSearchParams(params)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateSearchParams with RecordsPerPage %q: got error %v, want error %v", tt.perPage, err, tt.wantErr)
+			continue
+		}
+		if got := params.Get("RecordsPerPage"); !tt.wantErr && got != tt.want {
+			t.Errorf("RecordsPerPage %q became %q, want %q", tt.perPage, got, tt.want)
+		}
+	}
+}
+
+func TestBuildPayloadRental(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantMin  string
+		wantMax  string
+		wantSort string
+	}{
+		{name: "sale", env: map[string]string{}, wantMin: "539000", wantMax: "701000", wantSort: sortNewest},
+		{name: "rent", env: map[string]string{"TRANSACTION_TYPE": "rent"}, wantMin: "1500", wantMax: "3000", wantSort: sortCheapest},
+		{
+			name:     "rent with overrides",
+			env:      map[string]string{"TRANSACTION_TYPE": "rent", "SORT": "newest", "PRICE_MAX": "2400"},
+			wantMin:  "1500",
+			wantMax:  "2400",
+			wantSort: sortNewest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"TRANSACTION_TYPE", "SORT", "PRICE_MIN", "PRICE_MAX"} {
+				t.Setenv(key, tt.env[key])
+			}
+			params, err := buildPayload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := params.Get("PriceMin"); got != tt.wantMin {
+				t.Errorf("PriceMin = %s, want %s", got, tt.wantMin)
+			}
+			if got := params.Get("PriceMax"); got != tt.wantMax {
+				t.Errorf("PriceMax = %s, want %s", got, tt.wantMax)
+			}
+			if got := params.Get("Sort"); got != tt.wantSort {
+				t.Errorf("Sort = %s, want %s", got, tt.wantSort)
+			}
+		})
+	}
+}
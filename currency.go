@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultCurrency = "CAD"
+
+var (
+	// searchCurrency is the currency the default search asks prices in,
+	// from CURRENCY.
+	searchCurrency string
+
+	// displayCurrency, when set, has alerts show listing prices converted
+	// to it next to the original, at currencyRate units per unit of
+	// searchCurrency or at the rates currencyRatesURL returns.
+	displayCurrency  string
+	currencyRate     float64
+	currencyRatesURL string
+)
+
+// currencyCodePattern matches ISO 4217 codes such as "CAD".
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+func validCurrency(code string) bool {
+	return currencyCodePattern.MatchString(code)
+}
+
+// CurrencyConverter converts listing prices to displayCurrency. Rates from
+// the API are fetched once per source currency and kept for the run.
+type CurrencyConverter struct {
+	client httpClient
+	target string
+	// rate is the static rate from searchCurrency, or 0 to use ratesURL.
+	rate     float64
+	ratesURL string
+
+	mu    sync.Mutex
+	rates map[string]float64
+}
+
+func NewCurrencyConverter(client httpClient, target string, rate float64, ratesURL string) *CurrencyConverter {
+	return &CurrencyConverter{client: client, target: target, rate: rate, ratesURL: ratesURL, rates: make(map[string]float64)}
+}
+
+// Convert sets the converted price of the listings priced in another
+// currency than the target one. A listing whose price cannot be converted
+// keeps showing just its own price.
+func (c *CurrencyConverter) Convert(ctx context.Context, listings []Listing) error {
+	for i := range listings {
+		listing := &listings[i]
+		if listing.PriceAmount <= 0 || listing.Currency == c.target {
+			continue
+		}
+		rate, err := c.Rate(ctx, listing.Currency)
+		if err != nil {
+			return err
+		}
+		listing.ConvertedPrice = int(float64(listing.PriceAmount)*rate + 0.5)
+		listing.ConvertedCurrency = c.target
+	}
+	return nil
+}
+
+// Rate returns how many units of the target currency one unit of from is
+// worth.
+func (c *CurrencyConverter) Rate(ctx context.Context, from string) (float64, error) {
+	if c.rate > 0 {
+		if from != searchCurrency {
+			return 0, fmt.Errorf("CURRENCY_RATE only converts from %s, not %s", searchCurrency, from)
+		}
+		return c.rate, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rate, ok := c.rates[from]; ok {
+		return rate, nil
+	}
+	rate, err := c.lookup(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+	c.rates[from] = rate
+	return rate, nil
+}
+
+// lookup asks the rates API for the rates from base. The URL may hold a
+// "{base}" placeholder and is expected to return an object with a "rates"
+// map, as https://open.er-api.com/v6/latest/{base} does.
+func (c *CurrencyConverter) lookup(ctx context.Context, base string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.Replace(c.ratesURL, "{base}", base, -1), nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("currency rates lookup failed with HTTP %d", response.StatusCode)
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return 0, err
+	}
+	rate := result.Rates[c.target]
+	if rate <= 0 {
+		return 0, fmt.Errorf("no %s rate from %s in the currency rates", c.target, base)
+	}
+	return rate, nil
+}
+
+// parseCurrencyRate reads CURRENCY_RATE, a positive number.
+func parseCurrencyRate(v string) (float64, error) {
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("not a positive number: %q", v)
+	}
+	return rate, nil
+}
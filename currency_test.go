@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidCurrency(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"CAD", true},
+		{"USD", true},
+		{"cad", false},
+		{"CA", false},
+		{"CADD", false},
+		{"C4D", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validCurrency(tt.code); got != tt.want {
+			t.Errorf("validCurrency(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestParseCurrencyRate(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    float64
+		wantErr bool
+	}{
+		{v: "0.73", want: 0.73},
+		{v: "1", want: 1},
+		{v: "0", wantErr: true},
+		{v: "-0.5", wantErr: true},
+		{v: "abc", wantErr: true},
+		{v: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCurrencyRate(tt.v)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCurrencyRate(%q) = %v, %v, want %v, error %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestConvertStaticRate(t *testing.T) {
+	listings := []Listing{
+		{ID: "1", PriceAmount: 500000, Currency: searchCurrency},
+		{ID: "2", PriceAmount: 400000, Currency: "USD"},
+		{ID: "3", Price: "Price on request", Currency: searchCurrency},
+	}
+	converter := NewCurrencyConverter(http.DefaultClient, "USD", 0.73, "")
+	if err := converter.Convert(context.Background(), listings); err != nil {
+		t.Fatal(err)
+	}
+
+	if listings[0].ConvertedPrice != 365000 || listings[0].ConvertedCurrency != "USD" {
+		t.Errorf("converted %d %s, want 365000 USD", listings[0].ConvertedPrice, listings[0].ConvertedCurrency)
+	}
+	if want := "$500,000 (~365,000 USD)"; listings[0].DisplayPrice() != want {
+		t.Errorf("DisplayPrice() = %q, want %q", listings[0].DisplayPrice(), want)
+	}
+	if listings[1].ConvertedPrice != 0 {
+		t.Errorf("listing already in the target currency converted to %d", listings[1].ConvertedPrice)
+	}
+	if listings[2].ConvertedPrice != 0 || listings[2].DisplayPrice() != "Price on request" {
+		t.Errorf("unpriced listing shows %q", listings[2].DisplayPrice())
+	}
+
+	other := []Listing{{ID: "4", PriceAmount: 100000, Currency: "EUR"}}
+	if err := converter.Convert(context.Background(), other); err == nil {
+		t.Error("static rate converted from a currency other than the search's")
+	}
+}
+
+func TestConvertRatesURL(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/latest/CAD":
+			w.Write([]byte(`{"result":"success","rates":{"CAD":1,"USD":0.73,"EUR":0.68}}`))
+		case "/latest/GBP":
+			w.Write([]byte(`{"result":"success","rates":{"GBP":1}}`))
+		default:
+			http.Error(w, "unknown currency", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	converter := NewCurrencyConverter(server.Client(), "USD", 0, server.URL+"/latest/{base}")
+	listings := []Listing{
+		{ID: "1", PriceAmount: 500000, Currency: "CAD"},
+		{ID: "2", PriceAmount: 1000000, Currency: "CAD"},
+	}
+	if err := converter.Convert(ctx, listings); err != nil {
+		t.Fatal(err)
+	}
+	if listings[0].ConvertedPrice != 365000 || listings[1].ConvertedPrice != 730000 {
+		t.Errorf("converted %d and %d, want 365000 and 730000", listings[0].ConvertedPrice, listings[1].ConvertedPrice)
+	}
+	if requests != 1 {
+		t.Errorf("looked the rate up %d times, want it kept after the first", requests)
+	}
+
+	if _, err := converter.Rate(ctx, "GBP"); err == nil || !strings.Contains(err.Error(), "no USD rate") {
+		t.Errorf("Rate without the target in the response: got error %v", err)
+	}
+	if _, err := converter.Rate(ctx, "XYZ"); err == nil || !strings.Contains(err.Error(), "HTTP 404") {
+		t.Errorf("Rate on a failed lookup: got error %v", err)
+	}
+}
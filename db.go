@@ -0,0 +1,957 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// dynamoAPI is the part of the DynamoDB client this package uses, so tests
+// can stand in a fake for it.
+type dynamoAPI interface {
+	GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error
+	BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+var _ dynamoAPI = (*dynamodb.DynamoDB)(nil)
+
+// SeenListing is the item stored for every listing that has been seen.
+// Items live under a shared partition key with the listing ID as the sort
+// key, so a partition can be read with a single Query.
+type SeenListing struct {
+	PartitionKey string `dynamodbav:"partition_key"`
+	ListingID    string `dynamodbav:"listing_id"`
+	// Price is the last known price of the listing.
+	Price int `dynamodbav:"price,omitempty"`
+	// MissingCount is the number of consecutive runs the listing has been
+	// absent from the search results.
+	MissingCount int `dynamodbav:"missing_count,omitempty"`
+	// FirstSeen is the epoch second the listing was first marked seen, or
+	// 0 for items written before this was recorded.
+	FirstSeen int64 `dynamodbav:"first_seen,omitempty"`
+	// Snapshot holds the listing's snapshotFields as of SnapshotAt, an
+	// epoch second.
+	Snapshot   map[string]string `dynamodbav:"snapshot,omitempty"`
+	SnapshotAt int64             `dynamodbav:"snapshot_at,omitempty"`
+	// Fingerprint is the fingerprintOf the listing as of SnapshotAt. It is
+	// empty for items written before it was recorded.
+	Fingerprint string `dynamodbav:"fingerprint,omitempty"`
+	// Address is the listing's address as last seen, so ignore rules can
+	// still match it once it has gone. Items written before it was
+	// recorded do not have it.
+	Address string `dynamodbav:"address,omitempty"`
+	// AddressKey is the listing's dedupKey, kept when deduplication by
+	// address is enabled.
+	AddressKey string `dynamodbav:"address_key,omitempty"`
+	// URLKey is the listing's urlKey, kept when deduplication by URL is
+	// enabled.
+	URLKey string `dynamodbav:"url_key,omitempty"`
+	// DuplicateOf is the ID of the listing this one duplicates, if it was
+	// suppressed as a duplicate.
+	DuplicateOf string `dynamodbav:"duplicate_of,omitempty"`
+	// Notified is set once the listing was alerted on or queued for a
+	// digest, as opposed to seen and kept quiet. Items written before it
+	// was recorded do not have it.
+	Notified bool `dynamodbav:"notified,omitempty"`
+	// TTL is the epoch second after which DynamoDB may expire the item, or
+	// 0 to keep it forever. Expiry only happens once TTL is enabled on the
+	// table for this attribute:
+	//
+	//   aws dynamodb update-time-to-live --table-name $DYNAMO_TABLE_NAME \
+	//     --time-to-live-specification Enabled=true,AttributeName=ttl
+	TTL int64 `dynamodbav:"ttl,omitempty"`
+}
+
+// ttlRefreshInterval is how far an item's expiry may lag behind before
+// Touch rewrites it, in seconds.
+const ttlRefreshInterval = 24 * 60 * 60
+
+// ListingCache is the in-memory copy of a partition, keyed by listing ID.
+type ListingCache struct {
+	Listings map[string]*SeenListing
+	// Version is the partition version this copy was read at.
+	Version int
+	// FetchCount is the number of listings the last trusted fetch returned.
+	FetchCount int
+	// LastNotified is the epoch second of the last alert sent, or 0.
+	LastNotified int64
+}
+
+// cacheMeta is the metadata item of a partition, stored under
+// dynamoMetaSortKey next to the listings.
+type cacheMeta struct {
+	PartitionKey string `dynamodbav:"partition_key"`
+	ListingID    string `dynamodbav:"listing_id"`
+	Version      int    `dynamodbav:"version"`
+	FetchCount   int    `dynamodbav:"fetch_count,omitempty"`
+	LastNotified int64  `dynamodbav:"last_notified,omitempty"`
+}
+
+// flushMaxAttempts bounds how often Flush retries after losing a race with
+// a concurrent run.
+const flushMaxAttempts = 3
+
+// defaultFlushTimeout is how long the writes at the end of a search may take
+// once the invocation's own context is done.
+const defaultFlushTimeout = 10 * time.Second
+
+// flushTimeout bounds the writes at the end of a search, from
+// FLUSH_TIMEOUT_SECONDS.
+var flushTimeout time.Duration
+
+// flushContext returns a context for the writes at the end of a search that
+// keeps ctx's values but not its cancellation, bounded by flushTimeout
+// instead. A run cut short by the Lambda deadline still saves the listings
+// it saw, so the next run does not notify them all again.
+func flushContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+}
+
+const (
+	// dynamoMaxBatchSize is the most writes BatchWriteItem takes at once.
+	dynamoMaxBatchSize = 25
+
+	// batchMaxRetries is how often a batch with unprocessed items is
+	// retried before Flush gives up.
+	batchMaxRetries = 8
+)
+
+type DB struct {
+	dynamo       dynamoAPI
+	partitionKey string
+	cache        *ListingCache
+
+	// dirty and deleted hold the IDs Flush has to write or remove.
+	dirty   map[string]bool
+	deleted map[string]bool
+
+	// mu guards the fields above, as a search's alerts are sent, and the
+	// cache updated, from several goroutines.
+	mu sync.Mutex
+}
+
+func NewDB(dynamo dynamoAPI, partitionKey string) *DB {
+	return &DB{
+		dynamo:       dynamo,
+		partitionKey: partitionKey,
+		dirty:        make(map[string]bool),
+		deleted:      make(map[string]bool),
+	}
+}
+
+func (db *DB) Seen(ctx context.Context, listing Listing) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return false, err
+	}
+	_, ok := db.cache.Listings[listing.ID]
+	return ok, nil
+}
+
+// LastPrice returns the price the listing had when it was last recorded.
+func (db *DB) LastPrice(ctx context.Context, listing Listing) (int, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return 0, false, err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	if !ok || seen.Price <= 0 {
+		return 0, false, nil
+	}
+	return seen.Price, true, nil
+}
+
+// Recorded returns what is on record for a seen listing: its ID, last
+// known price and address, as far as they are known.
+func (db *DB) Recorded(ctx context.Context, listingID string) (Listing, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return Listing{}, err
+	}
+	listing := Listing{ID: listingID}
+	if seen, ok := db.cache.Listings[listingID]; ok {
+		listing.Address = seen.Address
+		if seen.Price > 0 {
+			listing.PriceAmount = seen.Price
+		}
+	}
+	return listing, nil
+}
+
+// FirstSeen returns when the listing was first marked seen, if known.
+func (db *DB) FirstSeen(ctx context.Context, listing Listing) (time.Time, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return time.Time{}, false, err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	if !ok || seen.FirstSeen == 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(seen.FirstSeen, 0), true, nil
+}
+
+// Changes returns the watched fields of the listing that differ from its
+// snapshot. A listing without a snapshot yet has no changes, and neither
+// has one whose fingerprint is unchanged.
+func (db *DB) Changes(ctx context.Context, listing Listing) ([]FieldChange, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return nil, err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	if !ok || seen.Snapshot == nil {
+		return nil, nil
+	}
+	if seen.Fingerprint != "" && seen.Fingerprint == fingerprintOf(listing) {
+		return nil, nil
+	}
+	return diffSnapshots(seen.Snapshot, snapshotOf(listing)), nil
+}
+
+// UpdateSnapshot records the listing's current snapshot, if it differs
+// from the stored one.
+func (db *DB) UpdateSnapshot(ctx context.Context, listing Listing) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	if !ok {
+		return nil
+	}
+	snapshot, fingerprint := snapshotOf(listing), fingerprintOf(listing)
+	if seen.Snapshot != nil && reflect.DeepEqual(seen.Snapshot, snapshot) && seen.Fingerprint == fingerprint {
+		return nil
+	}
+	seen.Snapshot = snapshot
+	seen.SnapshotAt = time.Now().Unix()
+	seen.Fingerprint = fingerprint
+	db.dirty[listing.ID] = true
+	return nil
+}
+
+// UpdatePrice records the listing's current price, if it has one.
+func (db *DB) UpdatePrice(ctx context.Context, listing Listing) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	if !ok || listing.PriceAmount <= 0 || seen.Price == listing.PriceAmount {
+		return nil
+	}
+	seen.Price = listing.PriceAmount
+	db.dirty[listing.ID] = true
+	return nil
+}
+
+// Touch pushes back the expiry of a listing that is still being seen, so
+// active listings do not expire. To keep writes down the item is only
+// rewritten once its expiry is more than a day behind.
+func (db *DB) Touch(ctx context.Context, listing Listing) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	if !ok {
+		return nil
+	}
+	ttl := expiry()
+	if ttl == 0 && seen.TTL == 0 || ttl != 0 && seen.TTL != 0 && ttl-seen.TTL < ttlRefreshInterval {
+		return nil
+	}
+	seen.TTL = ttl
+	db.dirty[listing.ID] = true
+	return nil
+}
+
+// expiry returns the TTL for an item written now, or 0 when seenTTL is
+// disabled.
+func expiry() int64 {
+	if seenTTL <= 0 {
+		return 0
+	}
+	return time.Now().Add(seenTTL).Unix()
+}
+
+// UpdateMissing bumps the missing count of every seen listing not in
+// present and resets it for those that are. It returns the IDs that have
+// now been missing for removedAfterRuns runs or more.
+func (db *DB) UpdateMissing(ctx context.Context, present map[string]bool) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for id, seen := range db.cache.Listings {
+		if present[id] {
+			if seen.MissingCount > 0 {
+				seen.MissingCount = 0
+				db.dirty[id] = true
+			}
+			continue
+		}
+		seen.MissingCount++
+		db.dirty[id] = true
+		if seen.MissingCount >= removedAfterRuns {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// LastFetchCount returns how many listings the last trusted fetch of the
+// partition's search returned, or 0 if none has been recorded.
+func (db *DB) LastFetchCount(ctx context.Context) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return 0, err
+	}
+	return db.cache.FetchCount, nil
+}
+
+// RecordFetchCount stores the size of this run's fetch, to compare the next
+// run's against.
+func (db *DB) RecordFetchCount(ctx context.Context, count int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	db.cache.FetchCount = count
+	return nil
+}
+
+// LastNotified returns when an alert was last sent for the partition's
+// search, or the zero time if that is not known.
+func (db *DB) LastNotified(ctx context.Context) (time.Time, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return time.Time{}, err
+	}
+	if db.cache.LastNotified == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(db.cache.LastNotified, 0), nil
+}
+
+// RecordNotified stores the time an alert was sent, saved on Flush.
+func (db *DB) RecordNotified(ctx context.Context, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	db.cache.LastNotified = at.Unix()
+	return nil
+}
+
+// Forget drops everything recorded about a listing.
+func (db *DB) Forget(ctx context.Context, listingID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	delete(db.cache.Listings, listingID)
+	delete(db.dirty, listingID)
+	db.deleted[listingID] = true
+	return nil
+}
+
+// Save writes the pending changes to a listing straight away rather than
+// on Flush. It is called once an alert about the listing is out, so a
+// retry after a failure later in the run does not send it again.
+func (db *DB) Save(ctx context.Context, listingID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.deleted[listingID] {
+		_, err := db.dynamo.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			Key:       db.key(listingID),
+			TableName: aws.String(dynamoTableName),
+		})
+		if err != nil {
+			return err
+		}
+		delete(db.deleted, listingID)
+		return nil
+	}
+	if !db.dirty[listingID] {
+		return nil
+	}
+	if err := db.put(ctx, db.cache.Listings[listingID]); err != nil {
+		return err
+	}
+	delete(db.dirty, listingID)
+	return nil
+}
+
+func (db *DB) loadCache(ctx context.Context) error {
+	if db.cache != nil {
+		return nil
+	}
+	return db.refreshCache(ctx)
+}
+
+func (db *DB) refreshCache(ctx context.Context) error {
+	cache, err := db.queryPartition(ctx)
+	if err != nil {
+		return err
+	}
+	db.cache = cache
+
+	// The legacy cache only ever held the default search's listings; a
+	// named search starting out empty is simply new.
+	if len(cache.Listings) == 0 && dynamoLegacyTableName != "" && db.partitionKey == dynamoPartitionKeyValue {
+		return db.migrateLegacyCache(ctx)
+	}
+	return nil
+}
+
+// queryPartition reads every item of the partition, including the version
+// kept in its metadata item.
+func (db *DB) queryPartition(ctx context.Context) (*ListingCache, error) {
+	cache := &ListingCache{Listings: make(map[string]*SeenListing)}
+
+	var unmarshalErr error
+	err := db.dynamo.QueryPagesWithContext(
+		ctx,
+		&dynamodb.QueryInput{
+			KeyConditionExpression: aws.String("#pk = :pk"),
+			ExpressionAttributeNames: map[string]*string{
+				"#pk": aws.String(dynamoPartitionKeyName)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pk": {S: aws.String(db.partitionKey)}},
+			TableName: aws.String(dynamoTableName),
+		},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				if sk := item[dynamoSortKeyName]; sk != nil && aws.StringValue(sk.S) == dynamoMetaSortKey {
+					var meta cacheMeta
+					if unmarshalErr = dynamodbattribute.UnmarshalMap(item, &meta); unmarshalErr != nil {
+						return false
+					}
+					cache.Version = meta.Version
+					cache.FetchCount = meta.FetchCount
+					cache.LastNotified = meta.LastNotified
+					continue
+				}
+
+				var seen SeenListing
+				if unmarshalErr = dynamodbattribute.UnmarshalMap(item, &seen); unmarshalErr != nil {
+					return false
+				}
+				cache.Listings[seen.ListingID] = &seen
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return cache, nil
+}
+
+// MarkSeen records the listing as seen. It is written straight away rather
+// than on Flush, so an alert that went out is not repeated should the run
+// fail later on.
+func (db *DB) MarkSeen(ctx context.Context, listing Listing) error {
+	return db.markSeen(ctx, listing, "", false)
+}
+
+// MarkNotified records the listing as seen and alerted on.
+func (db *DB) MarkNotified(ctx context.Context, listing Listing) error {
+	return db.markSeen(ctx, listing, "", true)
+}
+
+// MarkDuplicate records the listing as seen, and as a duplicate of the
+// listing with ID canonicalID.
+func (db *DB) MarkDuplicate(ctx context.Context, listing Listing, canonicalID string) error {
+	return db.markSeen(ctx, listing, canonicalID, false)
+}
+
+// Notified reports whether a seen listing was recorded as alerted on.
+func (db *DB) Notified(ctx context.Context, listing Listing) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return false, err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	return ok && seen.Notified, nil
+}
+
+// FindDuplicate returns the ID of another seen listing with the dedup key
+// key, if there is one.
+func (db *DB) FindDuplicate(ctx context.Context, key string, listingID string) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return "", false, err
+	}
+	for id, seen := range db.cache.Listings {
+		if id != listingID && seen.AddressKey == key && seen.DuplicateOf == "" {
+			return id, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// FindByURL returns the ID of another seen listing with the URL key key, if
+// there is one. A listing that is not a duplicate is preferred.
+func (db *DB) FindByURL(ctx context.Context, key string, listingID string) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return "", false, err
+	}
+	if key == "" {
+		return "", false, nil
+	}
+	found := ""
+	for id, seen := range db.cache.Listings {
+		if id == listingID || seen.URLKey != key {
+			continue
+		}
+		if seen.DuplicateOf == "" {
+			return id, true, nil
+		}
+		found = id
+	}
+	return found, found != "", nil
+}
+
+// Adopt records the listing as seen under its new ID with what is on record
+// for previousID, the ID it was seen under before, so its price and
+// snapshot carry on. Like MarkSeen it is written straight away.
+func (db *DB) Adopt(ctx context.Context, listing Listing, previousID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	previous, ok := db.cache.Listings[previousID]
+	if !ok {
+		return fmt.Errorf("listing %s is not on record", previousID)
+	}
+	seen := *previous
+	seen.ListingID = listing.ID
+	seen.MissingCount = 0
+	seen.URLKey = urlKey(listing)
+	if listing.Address != "" {
+		seen.Address = listing.Address
+	}
+	seen.TTL = expiry()
+	if err := db.put(ctx, &seen); err != nil {
+		return err
+	}
+	db.cache.Listings[listing.ID] = &seen
+	delete(db.dirty, listing.ID)
+	delete(db.deleted, listing.ID)
+	return nil
+}
+
+// UpdateURLKey records the listing's current URL key, if it changed.
+func (db *DB) UpdateURLKey(ctx context.Context, listing Listing) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+	seen, ok := db.cache.Listings[listing.ID]
+	key := urlKey(listing)
+	if !ok || key == "" || seen.URLKey == key {
+		return nil
+	}
+	seen.URLKey = key
+	db.dirty[listing.ID] = true
+	return nil
+}
+
+// DuplicateOf returns the ID of the listing a seen listing was suppressed
+// as a duplicate of, or an empty string.
+func (db *DB) DuplicateOf(ctx context.Context, listing Listing) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return "", err
+	}
+	if seen, ok := db.cache.Listings[listing.ID]; ok {
+		return seen.DuplicateOf, nil
+	}
+	return "", nil
+}
+
+func (db *DB) markSeen(ctx context.Context, listing Listing, duplicateOf string, notified bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadCache(ctx); err != nil {
+		return err
+	}
+
+	seen := &SeenListing{
+		PartitionKey: db.partitionKey,
+		ListingID:    listing.ID,
+		Price:        listing.PriceAmount,
+		FirstSeen:    time.Now().Unix(),
+		Snapshot:     snapshotOf(listing),
+		SnapshotAt:   time.Now().Unix(),
+		Fingerprint:  fingerprintOf(listing),
+		Address:      listing.Address,
+		DuplicateOf:  duplicateOf,
+		Notified:     notified,
+		TTL:          expiry(),
+	}
+	// A listing alerted on after being seen quietly keeps its first sighting.
+	if previous, ok := db.cache.Listings[listing.ID]; ok && previous.FirstSeen > 0 {
+		seen.FirstSeen = previous.FirstSeen
+	}
+	if dedupByAddress {
+		seen.AddressKey = dedupKey(listing)
+	}
+	if dedupByURL {
+		seen.URLKey = urlKey(listing)
+	}
+	if err := db.put(ctx, seen); err != nil {
+		return err
+	}
+	db.cache.Listings[listing.ID] = seen
+	delete(db.dirty, listing.ID)
+	delete(db.deleted, listing.ID)
+	return nil
+}
+
+// Flush writes back the changes made since the partition was read, in
+// batches.
+//
+// Concurrent runs are detected with the partition's version number: Flush
+// conditionally bumps it from the value read, and if another run got there
+// first the partition is re-read and merged before trying again.
+func (db *DB) Flush(ctx context.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.cache == nil {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := db.bumpVersion(ctx)
+		if err == nil {
+			break
+		}
+		var awsErr awserr.Error
+		if !errors.As(err, &awsErr) || awsErr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return err
+		}
+		if attempt >= flushMaxAttempts {
+			return fmt.Errorf("cache was updated concurrently %d times in a row: %w", attempt, err)
+		}
+		if err = db.mergeConcurrentUpdates(ctx); err != nil {
+			return err
+		}
+	}
+
+	var writes []*dynamodb.WriteRequest
+	for id := range db.dirty {
+		item, err := dynamodbattribute.MarshalMap(db.cache.Listings[id])
+		if err != nil {
+			return err
+		}
+		writes = append(writes, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+	for id := range db.deleted {
+		writes = append(writes, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: db.key(id)}})
+	}
+	if err := batchWrite(ctx, db.dynamo, writes); err != nil {
+		return err
+	}
+	db.dirty = make(map[string]bool)
+	db.deleted = make(map[string]bool)
+
+	return nil
+}
+
+// batchWrite makes the writes in batches of dynamoMaxBatchSize. Items a
+// batch leaves unprocessed, as it does when the table is throttled, are
+// written again with exponential backoff, along with batches that fail
+// outright for a transient reason.
+func batchWrite(ctx context.Context, dynamo dynamoAPI, writes []*dynamodb.WriteRequest) error {
+	for len(writes) > 0 {
+		n := dynamoMaxBatchSize
+		if len(writes) < n {
+			n = len(writes)
+		}
+		pending := writes[:n]
+		writes = writes[n:]
+
+		err := withRetry(ctx, batchMaxRetries, isRetryableBatchError, func() error {
+			output, err := dynamo.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{dynamoTableName: pending},
+			})
+			if err != nil {
+				return err
+			}
+			if unprocessed := output.UnprocessedItems[dynamoTableName]; len(unprocessed) > 0 {
+				pending = unprocessed
+				return &unprocessedItemsError{count: len(unprocessed)}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unprocessedItemsError is a batch write that left some of its items
+// unwritten.
+type unprocessedItemsError struct {
+	count int
+}
+
+func (e *unprocessedItemsError) Error() string {
+	return fmt.Sprintf("%d items were left unprocessed by a batch write", e.count)
+}
+
+func isRetryableBatchError(err error) bool {
+	var unprocessed *unprocessedItemsError
+	if errors.As(err, &unprocessed) || request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeProvisionedThroughputExceededException
+}
+
+// bumpVersion increments the partition's version, provided it is still the
+// one this run read.
+func (db *DB) bumpVersion(ctx context.Context) error {
+	item, err := dynamodbattribute.MarshalMap(cacheMeta{
+		PartitionKey: db.partitionKey,
+		ListingID:    dynamoMetaSortKey,
+		Version:      db.cache.Version + 1,
+		FetchCount:   db.cache.FetchCount,
+		LastNotified: db.cache.LastNotified,
+	})
+	if err != nil {
+		return err
+	}
+
+	condition := "attribute_not_exists(#pk) OR #v = :v"
+	_, err = db.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{
+			"#pk": aws.String(dynamoPartitionKeyName),
+			"#v":  aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {N: aws.String(strconv.Itoa(db.cache.Version))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueNone),
+		TableName:    aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return err
+	}
+	db.cache.Version++
+	return nil
+}
+
+// mergeConcurrentUpdates folds in what another run has written since the
+// partition was read. Changes made by this run win; everything else is
+// taken from the table, so listings the other run marked seen are kept and
+// ones it removed are not written back.
+func (db *DB) mergeConcurrentUpdates(ctx context.Context) error {
+	stored, err := db.queryPartition(ctx)
+	if err != nil {
+		return err
+	}
+
+	for id, seen := range stored.Listings {
+		if !db.dirty[id] && !db.deleted[id] {
+			db.cache.Listings[id] = seen
+		}
+	}
+	for id := range db.cache.Listings {
+		if _, ok := stored.Listings[id]; !ok && !db.dirty[id] {
+			delete(db.cache.Listings, id)
+		}
+	}
+	db.cache.Version = stored.Version
+	if stored.LastNotified > db.cache.LastNotified {
+		db.cache.LastNotified = stored.LastNotified
+	}
+
+	return nil
+}
+
+func (db *DB) put(ctx context.Context, seen *SeenListing) error {
+	item, err := dynamodbattribute.MarshalMap(seen)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:         item,
+		ReturnValues: aws.String(dynamodb.ReturnValueNone),
+		TableName:    aws.String(dynamoTableName),
+	})
+	return err
+}
+
+func (db *DB) key(listingID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamoPartitionKeyName: {S: aws.String(db.partitionKey)},
+		dynamoSortKeyName:      {S: aws.String(listingID)},
+	}
+}
+
+// legacyListingCache is the single item that used to hold every seen
+// listing before they were split into one item each.
+type legacyListingCache struct {
+	PartitionKey  string         `dynamodbav:"partition_key"`
+	SeenIDs       SeenIDs        `dynamodbav:"seen_ids"`
+	Prices        map[string]int `dynamodbav:"prices"`
+	MissingCounts map[string]int `dynamodbav:"missing_counts"`
+}
+
+// migrateLegacyCache fans the legacy single-item cache out into per-listing
+// items of the default search. It only runs while that partition is still
+// empty, so it is a no-op once the first Flush after migration has
+// succeeded.
+func (db *DB) migrateLegacyCache(ctx context.Context) error {
+	item, err := db.dynamo.GetItemWithContext(
+		ctx,
+		&dynamodb.GetItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				dynamoPartitionKeyName: {S: aws.String(dynamoPartitionKeyValue)}},
+			TableName: aws.String(dynamoLegacyTableName),
+		})
+	if err != nil {
+		return err
+	}
+
+	var legacy legacyListingCache
+	if err = dynamodbattribute.UnmarshalMap(item.Item, &legacy); err != nil {
+		return err
+	}
+
+	for _, id := range legacy.SeenIDs {
+		db.cache.Listings[id] = &SeenListing{
+			PartitionKey: db.partitionKey,
+			ListingID:    id,
+			Price:        legacy.Prices[id],
+			MissingCount: legacy.MissingCounts[id],
+			TTL:          expiry(),
+		}
+		db.dirty[id] = true
+	}
+	slog.InfoContext(ctx, "Migrating seen listings from legacy table",
+		"table", dynamoLegacyTableName, "count", len(legacy.SeenIDs))
+
+	return nil
+}
+
+type SeenIDs []string
+
+func (s *SeenIDs) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	var out bytes.Buffer
+
+	j, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	z := zlib.NewWriter(&out)
+
+	if _, err = z.Write(j); err != nil {
+		return err
+	}
+	if err = z.Close(); err != nil {
+		return err
+	}
+
+	av.SetB(out.Bytes())
+
+	return nil
+}
+
+func (s *SeenIDs) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	if av.B != nil {
+		z, err := zlib.NewReader(bytes.NewReader(av.B))
+		if err != nil {
+			return err
+		}
+
+		j := json.NewDecoder(z)
+		if err = j.Decode(s); err != nil {
+			return err
+		}
+	} else if av.L != nil {
+		for _, v := range av.L {
+			*s = append(*s, *v.S)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// fakeDynamo is an in-memory table keyed by partition and sort key. The
+// error fields make the matching calls fail, and so does a done context,
+// as with the SDK.
+type fakeDynamo struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+
+	putErr, queryErr error
+	// batchErrs are returned by the next batch writes, one per call.
+	batchErrs []error
+	// unprocessed is how many more batch writes leave their last item
+	// unprocessed.
+	unprocessed int
+
+	puts, queries, batches int
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func fakeKey(item map[string]*dynamodb.AttributeValue) string {
+	key := aws.StringValue(item[dynamoPartitionKeyName].S)
+	if sk := item[dynamoSortKeyName]; sk != nil {
+		key += "|" + aws.StringValue(sk.S)
+	}
+	return key
+}
+
+// store puts a seen listing straight into the table.
+func (f *fakeDynamo) store(t *testing.T, seen SeenListing) {
+	t.Helper()
+	item, err := dynamodbattribute.MarshalMap(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.items[fakeKey(item)] = item
+}
+
+// stored reads a seen listing back from the table.
+func (f *fakeDynamo) stored(t *testing.T, partitionKey, listingID string) (SeenListing, bool) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[partitionKey+"|"+listingID]
+	if !ok {
+		return SeenListing{}, false
+	}
+	var seen SeenListing
+	if err := dynamodbattribute.UnmarshalMap(item, &seen); err != nil {
+		t.Fatal(err)
+	}
+	return seen, true
+}
+
+func (f *fakeDynamo) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.items[fakeKey(input.Key)]}, nil
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	f.puts++
+	f.items[fakeKey(input.Item)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, fakeKey(input.Key))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeDynamo) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamo) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries++
+	if f.queryErr != nil {
+		return f.queryErr
+	}
+	partitionKey := aws.StringValue(input.ExpressionAttributeValues[":pk"].S)
+	page := &dynamodb.QueryOutput{}
+	for _, item := range f.items {
+		if aws.StringValue(item[dynamoPartitionKeyName].S) == partitionKey {
+			page.Items = append(page.Items, item)
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeDynamo) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.batches++
+	if len(f.batchErrs) > 0 {
+		err := f.batchErrs[0]
+		f.batchErrs = f.batchErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	output := &dynamodb.BatchWriteItemOutput{}
+	for table, writes := range input.RequestItems {
+		if f.unprocessed > 0 && len(writes) > 0 {
+			f.unprocessed--
+			output.UnprocessedItems = map[string][]*dynamodb.WriteRequest{table: writes[len(writes)-1:]}
+			writes = writes[:len(writes)-1]
+		}
+		for _, write := range writes {
+			if write.PutRequest != nil {
+				f.items[fakeKey(write.PutRequest.Item)] = write.PutRequest.Item
+			}
+			if write.DeleteRequest != nil {
+				delete(f.items, fakeKey(write.DeleteRequest.Key))
+			}
+		}
+	}
+	return output, nil
+}
+
+var _ dynamoAPI = (*fakeDynamo)(nil)
+
+func TestSeen(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored []string
+		id     string
+		want   bool
+	}{
+		{name: "empty cache", id: "1", want: false},
+		{name: "seen", stored: []string{"1", "2"}, id: "2", want: true},
+		{name: "not seen", stored: []string{"1", "2"}, id: "3", want: false},
+		{name: "other partition", id: "4", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamo := newFakeDynamo()
+			for _, id := range tt.stored {
+				dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: id})
+			}
+			dynamo.store(t, SeenListing{PartitionKey: "other", ListingID: "4"})
+
+			seen, err := NewDB(dynamo, "search").Seen(context.Background(), Listing{ID: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen != tt.want {
+				t.Errorf("Seen(%s) = %v, want %v", tt.id, seen, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeenCacheNotPopulated(t *testing.T) {
+	ctx := context.Background()
+	dynamo := newFakeDynamo()
+	dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: "1"})
+	dynamo.queryErr = errors.New("throttled")
+	db := NewDB(dynamo, "search")
+
+	if _, err := db.Seen(ctx, Listing{ID: "1"}); !errors.Is(err, dynamo.queryErr) {
+		t.Fatalf("Seen with the partition unreadable: got error %v, want %v", err, dynamo.queryErr)
+	}
+	if err := db.MarkSeen(ctx, Listing{ID: "2"}); !errors.Is(err, dynamo.queryErr) {
+		t.Fatalf("MarkSeen with the partition unreadable: got error %v, want %v", err, dynamo.queryErr)
+	}
+	if dynamo.puts != 0 {
+		t.Errorf("MarkSeen wrote %d items without the cache loaded", dynamo.puts)
+	}
+	if err := db.Flush(ctx); err != nil {
+		t.Fatalf("Flush without the cache loaded: %v", err)
+	}
+	if dynamo.puts != 0 || dynamo.batches != 0 {
+		t.Errorf("Flush without the cache loaded wrote %d items and %d batches", dynamo.puts, dynamo.batches)
+	}
+
+	// A failed read is not kept, so the next call tries again.
+	dynamo.queryErr = nil
+	seen, err := db.Seen(ctx, Listing{ID: "1"})
+	if err != nil || !seen {
+		t.Errorf("Seen once the partition is readable = %v, %v, want true", seen, err)
+	}
+}
+
+func TestMarkSeen(t *testing.T) {
+	tests := []struct {
+		name          string
+		previous      *SeenListing
+		mark          func(*DB, context.Context, Listing) error
+		wantNotified  bool
+		wantFirstSeen int64
+	}{
+		{
+			name:         "new listing",
+			mark:         (*DB).MarkSeen,
+			wantNotified: false,
+		},
+		{
+			name:         "notified",
+			mark:         (*DB).MarkNotified,
+			wantNotified: true,
+		},
+		{
+			name:          "seen quietly before",
+			previous:      &SeenListing{PartitionKey: "search", ListingID: "1", FirstSeen: 1500000000},
+			mark:          (*DB).MarkNotified,
+			wantNotified:  true,
+			wantFirstSeen: 1500000000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dynamo := newFakeDynamo()
+			if tt.previous != nil {
+				dynamo.store(t, *tt.previous)
+			}
+			db := NewDB(dynamo, "search")
+
+			start := time.Now().Unix()
+			if err := tt.mark(db, ctx, Listing{ID: "1", PriceAmount: 500000}); err != nil {
+				t.Fatal(err)
+			}
+			if dynamo.puts != 1 {
+				t.Errorf("wrote %d items, want the listing written straight away", dynamo.puts)
+			}
+			stored, ok := dynamo.stored(t, "search", "1")
+			if !ok {
+				t.Fatal("listing not in the table")
+			}
+			if stored.Price != 500000 || stored.Notified != tt.wantNotified {
+				t.Errorf("stored price %d, notified %v, want 500000, %v", stored.Price, stored.Notified, tt.wantNotified)
+			}
+			if tt.wantFirstSeen != 0 && stored.FirstSeen != tt.wantFirstSeen {
+				t.Errorf("first seen %d, want %d kept", stored.FirstSeen, tt.wantFirstSeen)
+			}
+			if tt.wantFirstSeen == 0 && stored.FirstSeen < start {
+				t.Errorf("first seen %d, want now", stored.FirstSeen)
+			}
+			if seen, _ := db.Seen(ctx, Listing{ID: "1"}); !seen {
+				t.Error("listing not seen after being marked")
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	dynamo := newFakeDynamo()
+	dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: "1", Price: 500000})
+	dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: "2", Price: 600000})
+	dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: "3", Price: 700000})
+	db := NewDB(dynamo, "search")
+
+	if err := db.UpdatePrice(ctx, Listing{ID: "1", PriceAmount: 450000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Forget(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := dynamo.stored(t, "search", "1"); stored.Price != 500000 {
+		t.Fatalf("price written before Flush: %d", stored.Price)
+	}
+
+	if err := db.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := dynamo.stored(t, "search", "1"); stored.Price != 450000 {
+		t.Errorf("price after Flush = %d, want 450000", stored.Price)
+	}
+	if _, ok := dynamo.stored(t, "search", "2"); ok {
+		t.Error("forgotten listing still in the table after Flush")
+	}
+	if stored, _ := dynamo.stored(t, "search", "3"); stored.Price != 700000 {
+		t.Errorf("untouched listing's price after Flush = %d, want 700000", stored.Price)
+	}
+	var meta cacheMeta
+	if err := dynamodbattribute.UnmarshalMap(dynamo.items["search|"+dynamoMetaSortKey], &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != 1 {
+		t.Errorf("partition version after Flush = %d, want 1", meta.Version)
+	}
+
+	// Nothing is left to write the second time.
+	batches := dynamo.batches
+	if err := db.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if dynamo.batches != batches {
+		t.Errorf("second Flush wrote %d batches, want none", dynamo.batches-batches)
+	}
+}
+
+func TestFlushContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "request"))
+	dynamo := newFakeDynamo()
+	dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: "1", Price: 500000})
+	db := NewDB(dynamo, "search")
+	if err := db.RecordFetchCount(parent, 12); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdatePrice(parent, Listing{ID: "1", PriceAmount: 450000}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	if err := db.Flush(parent); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Flush with the invocation's context done: got error %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancelFlush := flushContext(parent)
+	defer cancelFlush()
+	if ctx.Value(key{}) != "request" {
+		t.Error("flush context lost the parent's values")
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > flushTimeout {
+		t.Errorf("flush context deadline %v, want within %v", deadline, flushTimeout)
+	}
+	if err := db.Flush(ctx); err != nil {
+		t.Fatalf("Flush after the invocation's context is done: %v", err)
+	}
+	var meta cacheMeta
+	if err := dynamodbattribute.UnmarshalMap(dynamo.items["search|"+dynamoMetaSortKey], &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.FetchCount != 12 {
+		t.Errorf("stored fetch count %d, want 12", meta.FetchCount)
+	}
+	if stored, _ := dynamo.stored(t, "search", "1"); stored.Price != 450000 {
+		t.Errorf("stored price %d, want 450000", stored.Price)
+	}
+}
+
+func TestBatchWrite(t *testing.T) {
+	putRequests := func(n int) []*dynamodb.WriteRequest {
+		var writes []*dynamodb.WriteRequest
+		for i := 0; i < n; i++ {
+			item, err := dynamodbattribute.MarshalMap(SeenListing{PartitionKey: "search", ListingID: strconv.Itoa(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writes = append(writes, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+		}
+		return writes
+	}
+
+	t.Run("unprocessed items", func(t *testing.T) {
+		dynamo := newFakeDynamo()
+		// The first batch leaves an item unprocessed, and so does its retry.
+		dynamo.unprocessed = 2
+		if err := batchWrite(context.Background(), dynamo, putRequests(dynamoMaxBatchSize+5)); err != nil {
+			t.Fatal(err)
+		}
+		if len(dynamo.items) != dynamoMaxBatchSize+5 {
+			t.Errorf("%d items written, want %d", len(dynamo.items), dynamoMaxBatchSize+5)
+		}
+		if want := 2 + 2; dynamo.batches != want {
+			t.Errorf("%d batch writes, want %d", dynamo.batches, want)
+		}
+	})
+
+	t.Run("transient error", func(t *testing.T) {
+		dynamo := newFakeDynamo()
+		dynamo.batchErrs = []error{awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)}
+		if err := batchWrite(context.Background(), dynamo, putRequests(3)); err != nil {
+			t.Fatal(err)
+		}
+		if len(dynamo.items) != 3 || dynamo.batches != 2 {
+			t.Errorf("%d items written in %d batch writes, want 3 in 2", len(dynamo.items), dynamo.batches)
+		}
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		dynamo := newFakeDynamo()
+		failure := awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no such table", nil)
+		dynamo.batchErrs = []error{failure}
+		if err := batchWrite(context.Background(), dynamo, putRequests(3)); !errors.Is(err, failure) {
+			t.Fatalf("got error %v, want %v", err, failure)
+		}
+		if dynamo.batches != 1 {
+			t.Errorf("%d batch writes, want the error not retried", dynamo.batches)
+		}
+	})
+}
+
+func TestMigrateLegacyCacheDefaultSearchOnly(t *testing.T) {
+	defer func(v string) { dynamoLegacyTableName = v }(dynamoLegacyTableName)
+	dynamoLegacyTableName = "realtorca-legacy"
+
+	ctx := context.Background()
+	legacyTable := newFakeDynamo()
+	legacy, err := dynamodbattribute.MarshalMap(legacyListingCache{
+		PartitionKey: dynamoPartitionKeyValue,
+		SeenIDs:      SeenIDs{"1", "2"},
+		Prices:       map[string]int{"1": 500000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyTable.items[fakeKey(legacy)] = legacy
+
+	// Both searches' partitions start out empty in the new table.
+	for _, tt := range []struct {
+		search   Search
+		wantSeen bool
+	}{
+		{search: Search{}, wantSeen: true},
+		{search: Search{Name: "condos"}, wantSeen: false},
+	} {
+		db := NewDB(migrationDynamo{fakeDynamo: newFakeDynamo(), legacy: legacyTable}, tt.search.PartitionKey())
+		for _, id := range []string{"1", "2"} {
+			seen, err := db.Seen(ctx, Listing{ID: id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen != tt.wantSeen {
+				t.Errorf("search %q: listing %s seen = %v, want %v", tt.search.Name, id, seen, tt.wantSeen)
+			}
+		}
+	}
+}
+
+// migrationDynamo reads items of the legacy table from legacy and everything
+// else from the embedded fake.
+type migrationDynamo struct {
+	*fakeDynamo
+	legacy *fakeDynamo
+}
+
+func (m migrationDynamo) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if aws.StringValue(input.TableName) == dynamoLegacyTableName {
+		return m.legacy.GetItemWithContext(ctx, input, opts...)
+	}
+	return m.fakeDynamo.GetItemWithContext(ctx, input, opts...)
+}
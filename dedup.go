@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// dedupByAddress suppresses alerts on listings with the same address and
+// price as another, which happens when a property is relisted or listed by
+// two brokerages. Only listings seen since it was enabled have their
+// address on record to be matched against.
+var dedupByAddress bool
+
+// dedupByURL treats a new listing whose details page is that of a listing
+// already seen as the same listing, which realtor.ca sometimes gives a new
+// ID. It costs a little storage, as every listing's URL is kept to match.
+var dedupByURL bool
+
+// addressAbbreviations shortens the words realtor.ca spells both ways.
+var addressAbbreviations = map[string]string{
+	"street":    "st",
+	"avenue":    "ave",
+	"av":        "ave",
+	"road":      "rd",
+	"drive":     "dr",
+	"boulevard": "blvd",
+	"crescent":  "cres",
+	"court":     "crt",
+	"ct":        "crt",
+	"place":     "pl",
+	"lane":      "ln",
+	"terrace":   "terr",
+	"circle":    "cir",
+	"square":    "sq",
+	"highway":   "hwy",
+	"parkway":   "pkwy",
+	"unit":      "",
+	"suite":     "",
+	"apt":       "",
+	"north":     "n",
+	"south":     "s",
+	"east":      "e",
+	"west":      "w",
+}
+
+// dedupKey identifies the property a listing is for by its normalized
+// address and price. It is empty when the listing has no usable address or
+// price, and such listings are never treated as duplicates.
+func dedupKey(listing Listing) string {
+	address := normalizeForDedup(listing.Address)
+	if address == "" || address == "address not available" || listing.PriceAmount <= 0 {
+		return ""
+	}
+	return address + "|" + strconv.Itoa(listing.PriceAmount)
+}
+
+// normalizeForDedup lower-cases an address, drops its punctuation and
+// abbreviates common words, so "12 Main Street, Unit #4" and
+// "12 Main St. #4" compare equal.
+func normalizeForDedup(address string) string {
+	words := strings.FieldsFunc(strings.ToLower(address), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	out := words[:0]
+	for _, word := range words {
+		if short, ok := addressAbbreviations[word]; ok {
+			if short == "" {
+				continue
+			}
+			word = short
+		}
+		out = append(out, word)
+	}
+	return strings.Join(out, " ")
+}
+
+// urlKey is the normalized details page of a listing: its path without the
+// query, lower-cased and without a trailing slash. It is empty when the
+// listing has no details page.
+func urlKey(listing Listing) string {
+	path := strings.TrimSpace(listing.RelativeDetailsURL)
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	path = strings.TrimSuffix(strings.ToLower(cleanPath(path)), "/")
+	if path == "" {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestURLKey(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "plain", path: "/real-estate/21933083/12-main-st-toronto", want: "/real-estate/21933083/12-main-st-toronto"},
+		{name: "query", path: "/real-estate/21933083/12-main-st-toronto?view=imagelist", want: "/real-estate/21933083/12-main-st-toronto"},
+		{name: "fragment", path: "/real-estate/21933083/12-main-st-toronto#photos", want: "/real-estate/21933083/12-main-st-toronto"},
+		{name: "trailing slash", path: "/real-estate/21933083/12-main-st-toronto/", want: "/real-estate/21933083/12-main-st-toronto"},
+		{name: "case", path: "/Real-Estate/21933083/12-Main-St-Toronto", want: "/real-estate/21933083/12-main-st-toronto"},
+		{name: "escapes", path: "/real-estate/21933083/12%20main%20st%20%C3%A9cole", want: "/real-estate/21933083/12 main st école"},
+		{name: "no leading slash", path: "real-estate//21933083/12-main-st", want: "/real-estate/21933083/12-main-st"},
+		{name: "whitespace", path: "  /real-estate/21933083/12-main-st  ", want: "/real-estate/21933083/12-main-st"},
+		{name: "empty", path: "", want: ""},
+		{name: "query only", path: "?view=imagelist", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := urlKey(Listing{RelativeDetailsURL: tt.path}); got != tt.want {
+				t.Errorf("urlKey(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeenByURL(t *testing.T) {
+	defer func(v bool) { dedupByURL = v }(dedupByURL)
+	dedupByURL = true
+
+	previous := Listing{ID: "100", RelativeDetailsURL: "/real-estate/100/12-main-st", PriceAmount: 500000}
+	tests := []struct {
+		name        string
+		listing     Listing
+		wantSeen    bool
+		wantPrice   int
+		wantURLKey  string
+		wantRecords int
+	}{
+		{
+			name:        "ID changed, URL the same",
+			listing:     Listing{ID: "200", RelativeDetailsURL: "/real-estate/100/12-Main-St/?ref=map", PriceAmount: 480000},
+			wantSeen:    true,
+			wantPrice:   500000,
+			wantURLKey:  "/real-estate/100/12-main-st",
+			wantRecords: 2,
+		},
+		{
+			name:        "URL changed, ID the same",
+			listing:     Listing{ID: "100", RelativeDetailsURL: "/real-estate/100/12-main-street", PriceAmount: 500000},
+			wantSeen:    true,
+			wantPrice:   500000,
+			wantURLKey:  "/real-estate/100/12-main-street",
+			wantRecords: 1,
+		},
+		{
+			name:        "both changed",
+			listing:     Listing{ID: "300", RelativeDetailsURL: "/real-estate/300/14-main-st", PriceAmount: 500000},
+			wantSeen:    false,
+			wantRecords: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := NewDB(newFakeDynamo(), "search")
+			if err := db.MarkNotified(ctx, previous); err != nil {
+				t.Fatal(err)
+			}
+			r := &searchRun{db: db, logger: testLogger()}
+
+			seen, err := db.Seen(ctx, tt.listing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen, err = r.seenByURL(ctx, tt.listing, seen); err != nil {
+				t.Fatal(err)
+			}
+			if seen != tt.wantSeen {
+				t.Fatalf("seen = %v, want %v", seen, tt.wantSeen)
+			}
+			if n := len(db.cache.Listings); n != tt.wantRecords {
+				t.Errorf("%d listings on record, want %d", n, tt.wantRecords)
+			}
+			if !tt.wantSeen {
+				return
+			}
+			// The record carries over, so a price drop from the old ID's
+			// price is still noticed.
+			price, ok, err := db.LastPrice(ctx, tt.listing)
+			if err != nil || !ok || price != tt.wantPrice {
+				t.Errorf("LastPrice = %d, %v, %v, want %d", price, ok, err, tt.wantPrice)
+			}
+			if notified, _ := db.Notified(ctx, tt.listing); !notified {
+				t.Error("listing not recorded as notified")
+			}
+			if key := db.cache.Listings[tt.listing.ID].URLKey; key != tt.wantURLKey {
+				t.Errorf("URL key = %q, want %q", key, tt.wantURLKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// dynamoDigestPartitionKey prefixes the partitions holding each search's
+// new listings waiting for its next digest, apart from the seen listings.
+const dynamoDigestPartitionKey = "digest"
+
+// queuedListing is a listing waiting for the next digest.
+type queuedListing struct {
+	PartitionKey string  `dynamodbav:"partition_key"`
+	ListingID    string  `dynamodbav:"listing_id"`
+	Listing      Listing `dynamodbav:"listing"`
+	// QueuedAt is the epoch second the listing was queued, which orders
+	// the digest.
+	QueuedAt int64 `dynamodbav:"queued_at"`
+	TTL      int64 `dynamodbav:"ttl,omitempty"`
+}
+
+// digestMeta records when the partition's digest was last sent.
+type digestMeta struct {
+	PartitionKey string `dynamodbav:"partition_key"`
+	ListingID    string `dynamodbav:"listing_id"`
+	LastSent     int64  `dynamodbav:"last_sent"`
+}
+
+// DigestQueue holds the new listings of a search that sends a digest every
+// so often rather than every run.
+type DigestQueue struct {
+	dynamo       dynamoAPI
+	partitionKey string
+}
+
+func NewDigestQueue(dynamo dynamoAPI, searchName string) *DigestQueue {
+	partitionKey := dynamoDigestPartitionKey
+	if searchName != "" {
+		partitionKey += "#" + searchName
+	}
+	return &DigestQueue{dynamo: dynamo, partitionKey: partitionKey}
+}
+
+// Add queues the listing for the next digest.
+func (q *DigestQueue) Add(ctx context.Context, listing Listing) error {
+	item, err := dynamodbattribute.MarshalMap(queuedListing{
+		PartitionKey: q.partitionKey,
+		ListingID:    listing.ID,
+		Listing:      listing,
+		QueuedAt:     time.Now().Unix(),
+		TTL:          expiry(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = q.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dynamoTableName),
+	})
+	return err
+}
+
+// markNewThisRun flags the pending listings that are among the new ones,
+// which were not in the seen-listings cache when the run started, and
+// moves them first, otherwise in queue order.
+func markNewThisRun(pending, newListings []Listing) []Listing {
+	isNew := make(map[string]bool, len(newListings))
+	for _, listing := range newListings {
+		isNew[listing.ID] = true
+	}
+	for i := range pending {
+		pending[i].NewThisRun = isNew[pending[i].ID]
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].NewThisRun && !pending[j].NewThisRun
+	})
+	return pending
+}
+
+// Pending returns the queued listings, oldest first, and when the last
+// digest was sent, or the zero time if none has been.
+func (q *DigestQueue) Pending(ctx context.Context) ([]Listing, time.Time, error) {
+	var (
+		queued       []queuedListing
+		lastSent     time.Time
+		unmarshalErr error
+	)
+	err := q.dynamo.QueryPagesWithContext(
+		ctx,
+		&dynamodb.QueryInput{
+			KeyConditionExpression: aws.String("#pk = :pk"),
+			ExpressionAttributeNames: map[string]*string{
+				"#pk": aws.String(dynamoPartitionKeyName)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pk": {S: aws.String(q.partitionKey)}},
+			TableName: aws.String(dynamoTableName),
+		},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				if sk := item[dynamoSortKeyName]; sk != nil && aws.StringValue(sk.S) == dynamoMetaSortKey {
+					var meta digestMeta
+					if unmarshalErr = dynamodbattribute.UnmarshalMap(item, &meta); unmarshalErr != nil {
+						return false
+					}
+					lastSent = time.Unix(meta.LastSent, 0)
+					continue
+				}
+
+				var listing queuedListing
+				if unmarshalErr = dynamodbattribute.UnmarshalMap(item, &listing); unmarshalErr != nil {
+					return false
+				}
+				queued = append(queued, listing)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if unmarshalErr != nil {
+		return nil, time.Time{}, unmarshalErr
+	}
+
+	sort.SliceStable(queued, func(i, j int) bool { return queued[i].QueuedAt < queued[j].QueuedAt })
+	listings := make([]Listing, len(queued))
+	for i, q := range queued {
+		listings[i] = q.Listing
+	}
+	return listings, lastSent, nil
+}
+
+// MarkSent records that a digest of listings went out at sentAt, taking
+// them off the queue.
+func (q *DigestQueue) MarkSent(ctx context.Context, listings []Listing, sentAt time.Time) error {
+	item, err := dynamodbattribute.MarshalMap(digestMeta{
+		PartitionKey: q.partitionKey,
+		ListingID:    dynamoMetaSortKey,
+		LastSent:     sentAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = q.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, listing := range listings {
+		_, err = q.dynamo.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				dynamoPartitionKeyName: {S: aws.String(q.partitionKey)},
+				dynamoSortKeyName:      {S: aws.String(listing.ID)},
+			},
+			TableName: aws.String(dynamoTableName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger drops what a search run logs.
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestQueueDigestDryRun(t *testing.T) {
+	defer func(v bool) { dryRun = v }(dryRun)
+	dryRun = true
+
+	tests := []struct {
+		name         string
+		lastSent     time.Time
+		wantNotified int
+	}{
+		{name: "digest due", lastSent: time.Now().Add(-48 * time.Hour), wantNotified: 1},
+		{name: "digest not due", lastSent: time.Now().Add(-time.Hour), wantNotified: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dynamo := newFakeDynamo()
+			queue := NewDigestQueue(dynamo, "search")
+			if err := queue.MarkSent(ctx, nil, tt.lastSent); err != nil {
+				t.Fatal(err)
+			}
+			puts := dynamo.puts
+			r := &searchRun{
+				search: Search{Name: "search", DigestInterval: 24 * time.Hour},
+				db:     NewDB(dynamo, "search"),
+				queue:  queue,
+				logger: testLogger(),
+			}
+
+			if err := r.queueDigest(ctx, []Listing{{ID: "1"}, {ID: "2"}}); err != nil {
+				t.Fatal(err)
+			}
+			if r.notified != tt.wantNotified {
+				t.Errorf("counted %d notifications, want %d", r.notified, tt.wantNotified)
+			}
+			if dynamo.puts != puts {
+				t.Errorf("dry run wrote %d items", dynamo.puts-puts)
+			}
+		})
+	}
+}
+
+func TestMarkNewThisRun(t *testing.T) {
+	pending := []Listing{{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"}}
+	got := markNewThisRun(pending, []Listing{{ID: "3"}, {ID: "2"}, {ID: "9"}})
+
+	var ids []string
+	for _, listing := range got {
+		ids = append(ids, listing.ID)
+		if want := listing.ID == "2" || listing.ID == "3"; listing.NewThisRun != want {
+			t.Errorf("listing %s NewThisRun = %v, want %v", listing.ID, listing.NewThisRun, want)
+		}
+	}
+	// New listings go first, each part keeping its queue order.
+	if want := "2,3,1,4"; strings.Join(ids, ",") != want {
+		t.Errorf("order %s, want %s", strings.Join(ids, ","), want)
+	}
+
+	if got := markNewThisRun([]Listing{{ID: "1"}}, nil); got[0].NewThisRun {
+		t.Error("listing marked new without any new listings")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Event is the payload the Lambda function is invoked with. Every field is
+// optional:
+//
+//	{}                                         the scheduled run
+//	{"force": true}                            a run delivering at once
+//	{"lat": 43.4643, "lng": -80.5204}          the listings around a point
+//	{"lat": 43.4643, "lng": -80.5204, "radius": 3}
+//
+// force runs the scheduled pipeline but sends queued digests straight away
+// instead of waiting for their DigestEvery interval, e.g. to check right
+// after changing the filters. lat and lng, given together, ask for the
+// listings within radius kilometres (2 by default, at most 50) of the
+// point instead, e.g. from a phone shortcut; they are returned rather than
+// sent.
+//
+// Any other field is rejected, so a misspelt one is not mistaken for the
+// scheduled run. The default EventBridge schedule event is the exception
+// and is taken as the scheduled run.
+type Event struct {
+	Force     bool     `json:"force"`
+	Latitude  *float64 `json:"lat"`
+	Longitude *float64 `json:"lng"`
+	Radius    float64  `json:"radius"`
+}
+
+// eventBridgeSource is the source of the events EventBridge sends on a
+// schedule when the rule sets no input of its own.
+const eventBridgeSource = "aws.events"
+
+// parseEvent decodes the invocation payload into an Event.
+func parseEvent(payload json.RawMessage) (Event, error) {
+	var event Event
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		return event, nil
+	}
+
+	var envelope struct {
+		Source     string `json:"source"`
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err == nil && envelope.Source == eventBridgeSource && envelope.DetailType != "" {
+		return event, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&event); err != nil {
+		return event, fmt.Errorf("invalid event: %w", err)
+	}
+	if event.Force && event.nearby() {
+		return event, errors.New("invalid event: force cannot be combined with lat, lng or radius")
+	}
+	return event, nil
+}
+
+type forceKey struct{}
+
+// withForce returns a context marking the run as forced by the event.
+func withForce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKey{}, true)
+}
+
+// forced reports whether the run was forced, and should deliver what it
+// finds without waiting for a digest interval.
+func forced(ctx context.Context) bool {
+	force, _ := ctx.Value(forceKey{}).(bool)
+	return force
+}
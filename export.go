@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const defaultExportPrefix = "listings"
+
+var (
+	// exportBucket, when set, has every run write the search's current
+	// listings as JSON to <exportPrefix>/<search>/latest.json in it, and
+	// with exportHistory also to a timestamped object next to it.
+	exportBucket  string
+	exportPrefix  string
+	exportHistory bool
+
+	// exportCSVKey, when set, names a CSV object in exportBucket that
+	// every run appends its new listings to.
+	exportCSVKey string
+)
+
+// csvHeader names the columns of the CSV export.
+var csvHeader = []string{"id", "search_name", "address", "price", "bedrooms", "bathrooms", "sqft", "url", "first_seen", "description"}
+
+// s3API is the part of the S3 client Exporter and PhotoCache use, so tests
+// can stand in a fake for it.
+type s3API interface {
+	HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error)
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+}
+
+var _ s3API = (*s3.S3)(nil)
+
+// Exporter writes snapshots of each search's listings to S3.
+type Exporter struct {
+	s3      s3API
+	bucket  string
+	prefix  string
+	history bool
+	csvKey  string
+}
+
+func NewExporter(client s3API, bucket, prefix string, history bool, csvKey string) *Exporter {
+	return &Exporter{s3: client, bucket: bucket, prefix: prefix, history: history, csvKey: csvKey}
+}
+
+// listingsExport is the JSON document written for a search.
+type listingsExport struct {
+	SearchName string        `json:"search_name,omitempty"`
+	FetchedAt  time.Time     `json:"fetched_at"`
+	Total      int           `json:"total_records"`
+	Listings   []jsonListing `json:"listings"`
+}
+
+// Export writes the listings a search fetched at fetchedAt.
+func (e *Exporter) Export(ctx context.Context, search Search, listings *Listings, fetchedAt time.Time) error {
+	body, err := json.MarshalIndent(listingsExport{
+		SearchName: search.Name,
+		FetchedAt:  fetchedAt.UTC(),
+		Total:      listings.Paging.TotalRecords,
+		Listings:   newJSONListings(listings.Results),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := search.Name
+	if name == "" {
+		name = "default"
+	}
+	keys := []string{path.Join(e.prefix, name, "latest.json")}
+	if e.history {
+		keys = append(keys, path.Join(e.prefix, name, fetchedAt.UTC().Format("20060102T150405Z")+".json"))
+	}
+	for _, key := range keys {
+		_, err = e.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(e.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendCSV adds a row for each of the listings, first seen at seenAt, to
+// the CSV export, writing the header if the object is new. It does nothing
+// when no CSV key is configured.
+//
+// Like the seen-listings cache, concurrent runs are detected optimistically:
+// the object is only written if its ETag is still the one read, and
+// otherwise read again and the rows appended anew.
+func (e *Exporter) AppendCSV(ctx context.Context, listings []Listing, seenAt time.Time) error {
+	if e.csvKey == "" || len(listings) == 0 {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		existing, etag, err := e.readCSV(ctx)
+		if err != nil {
+			return err
+		}
+
+		var out bytes.Buffer
+		out.Write(existing)
+		w := csv.NewWriter(&out)
+		if len(existing) == 0 {
+			w.Write(csvHeader)
+		}
+		for _, listing := range listings {
+			w.Write(csvRow(listing, seenAt))
+		}
+		w.Flush()
+		if err = w.Error(); err != nil {
+			return err
+		}
+
+		condition := map[string]string{"If-None-Match": "*"}
+		if etag != "" {
+			condition = map[string]string{"If-Match": etag}
+		}
+		_, err = e.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(e.bucket),
+			Key:         aws.String(e.csvKey),
+			Body:        bytes.NewReader(out.Bytes()),
+			ContentType: aws.String("text/csv"),
+		}, request.WithSetRequestHeaders(condition))
+		if err == nil {
+			return nil
+		}
+		var failure awserr.RequestFailure
+		if !errors.As(err, &failure) || failure.StatusCode() != http.StatusPreconditionFailed && failure.StatusCode() != http.StatusConflict {
+			return err
+		}
+		if attempt >= flushMaxAttempts {
+			return fmt.Errorf("CSV export was updated concurrently %d times in a row: %w", attempt, err)
+		}
+	}
+}
+
+// readCSV returns the current CSV export and its ETag, or nothing if it
+// does not exist yet.
+func (e *Exporter) readCSV(ctx context.Context) ([]byte, string, error) {
+	object, err := e.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(e.bucket),
+		Key:    aws.String(e.csvKey),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer object.Body.Close()
+
+	data, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	return data, aws.StringValue(object.ETag), nil
+}
+
+func csvRow(listing Listing, seenAt time.Time) []string {
+	price := ""
+	if listing.PriceAmount > 0 {
+		price = strconv.Itoa(listing.PriceAmount)
+	}
+	sqft := ""
+	if listing.SquareFeet > 0 {
+		sqft = strconv.Itoa(listing.SquareFeet)
+	}
+	return []string{
+		listing.ID,
+		listing.SearchName,
+		listing.Address,
+		price,
+		listing.Bedrooms,
+		listing.Bathrooms,
+		sqft,
+		listing.URL(),
+		seenAt.UTC().Format(time.RFC3339),
+		listing.Description,
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ErrorCode struct {
+	Id          int
+	Description string
+	ProductName string
+}
+
+// searchResponse is the envelope returned by the API. Failed searches come
+// back with an empty Results and the reason in ErrorCode.
+type searchResponse struct {
+	Listings
+	ErrorCode ErrorCode
+}
+
+// httpClient is the subset of *http.Client used by Fetcher.
+type httpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Fetcher struct {
+	client  httpClient
+	limiter *rateLimiter
+}
+
+func NewFetcher(client httpClient) *Fetcher {
+	return &Fetcher{client: client, limiter: newRateLimiter(minRequestInterval)}
+}
+
+// FetchListings requests every page of the search, up to maxPages, and
+// merges the results in first-seen order, dropping listings repeated
+// across page boundaries. Pages after the first are only requested while
+// the run is within its runtime budget, the polite delay included.
+func (f *Fetcher) FetchListings(ctx context.Context, search Search) (*Listings, error) {
+	listings := &Listings{}
+	fetched := make(map[string]bool)
+
+	for currentPage := 1; currentPage <= maxPages; currentPage++ {
+		if currentPage > 1 && !withinBudget(ctx, minRequestInterval) {
+			listings.StoppedEarly = true
+			break
+		}
+		page, err := f.fetchPage(ctx, search.Params, currentPage)
+		if err != nil {
+			return listings, err
+		}
+
+		listings.Paging = page.Paging
+		for _, listing := range page.Results {
+			if !fetched[listing.ID] {
+				fetched[listing.ID] = true
+				listing.SearchName = search.Name
+				listing.ForRent = search.Params.Get("TransactionTypeId") == transactionTypeForRent
+				listing.Currency = search.Params.Get("Currency")
+				if listing.Currency == "" {
+					listing.Currency = searchCurrency
+				}
+				listings.Results = append(listings.Results, listing)
+			}
+		}
+
+		if currentPage >= totalPages(page.Paging, search.Params) || page.Paging.TotalRecords > 0 && len(listings.Results) >= page.Paging.TotalRecords {
+			break
+		}
+	}
+
+	return listings, nil
+}
+
+// totalPages returns the number of pages of the search, working it out from
+// the record count and the page size asked for should the API leave it out.
+func totalPages(paging Paging, params url.Values) int {
+	if paging.TotalPages > 0 || paging.TotalRecords == 0 {
+		return paging.TotalPages
+	}
+	perPage, err := strconv.Atoi(params.Get("RecordsPerPage"))
+	if err != nil || perPage < minRecordsPerPage {
+		return 1
+	}
+	return (paging.TotalRecords + perPage - 1) / perPage
+}
+
+func (f *Fetcher) fetchPage(ctx context.Context, params url.Values, currentPage int) (*Listings, error) {
+	listings := &Listings{}
+
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("CurrentPage", strconv.Itoa(currentPage))
+
+	err := withRetry(ctx, httpMaxRetries, isRetryable, func() error {
+		if err := f.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		req, _ := http.NewRequestWithContext(ctx, "POST", apiURL, strings.NewReader(form.Encode()))
+		setRequestHeaders(req)
+		response, err := f.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		body, err := readBody(response)
+		if err != nil {
+			return err
+		}
+
+		// Anti-bot challenges come back as HTML pages, often with a 403
+		// or 503, so they are looked for before the status.
+		if isHTML(response, body) {
+			return &ChallengeError{StatusCode: response.StatusCode, Snippet: snippet(body, challengeSnippetLength)}
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return &HTTPStatusError{StatusCode: response.StatusCode}
+		}
+
+		var result searchResponse
+		if err = json.Unmarshal(body, &result); err != nil {
+			return err
+		}
+		if id := result.ErrorCode.Id; id != 0 && id != apiSuccessCode {
+			return &APIError{Code: id, Description: result.ErrorCode.Description}
+		}
+
+		*listings = result.Listings
+		return nil
+	})
+
+	return listings, err
+}
+
+// The API reports its own status in ErrorCode.Id using HTTP-style numbers;
+// successful searches carry 200.
+const (
+	apiSuccessCode   = 200
+	apiThrottledCode = 429
+)
+
+type APIError struct {
+	Code        int
+	Description string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("realtor.ca API error %d: %s", e.Code, e.Description)
+}
+
+// setRequestHeaders makes the request look like the one the realtor.ca map
+// sends. Without the form Content-Type the body is not always parsed and
+// the search comes back empty.
+func setRequestHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("Origin", baseURL)
+	req.Header.Set("Referer", baseURL+"/")
+}
+
+// rateLimiter spaces out calls by a minimum interval. It is shared by the
+// searches running at once, so it paces the function as a whole.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{interval: interval}
+}
+
+// Wait blocks until the next call is allowed, or the context is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l.interval <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := at.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readBody reads a response body, decompressing it according to its
+// Content-Encoding. As Accept-Encoding is set by hand the transport leaves
+// this to us, and since realtor.ca has been seen to send gzip without
+// saying so, gzip is also recognized by its magic bytes.
+func readBody(response *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	switch {
+	case encoding == "gzip" || encoding == "x-gzip" || bytes.HasPrefix(body, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip response: %w", err)
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case encoding == "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send a raw
+		// deflate stream instead.
+		if reader, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			defer reader.Close()
+			return ioutil.ReadAll(reader)
+		}
+		reader := flate.NewReader(bytes.NewReader(body))
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	return body, nil
+}
+
+// ChallengeError is returned when realtor.ca answers with an HTML page
+// rather than JSON, which is what its anti-bot protection does when it
+// wants a browser to prove itself.
+type ChallengeError struct {
+	StatusCode int
+	// Snippet is the start of the page, for diagnosis.
+	Snippet string
+}
+
+func (e *ChallengeError) Error() string {
+	return fmt.Sprintf("realtor.ca served an HTML challenge page instead of JSON (HTTP %d)", e.StatusCode)
+}
+
+// challengeSnippetLength is how much of a challenge page is logged.
+const challengeSnippetLength = 300
+
+// challengeBackoffFactor lengthens the wait before retrying after a
+// challenge, as retrying quickly only makes one more likely.
+const challengeBackoffFactor = 10
+
+// isHTML reports whether a response is an HTML page, going by its
+// Content-Type or, since that cannot be relied on, a leading '<'.
+func isHTML(response *http.Response, body []byte) bool {
+	if strings.Contains(strings.ToLower(response.Header.Get("Content-Type")), "text/html") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// snippet returns up to max bytes of the start of body, with whitespace
+// runs collapsed so it fits on a log line.
+func snippet(body []byte, max int) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if len(s) > max {
+		s = truncate(s, max) + "..."
+	}
+	return s
+}
+
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+}
+
+var retryableStatuses = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// withRetry calls attempt until it succeeds, fails with an error retryable
+// does not accept, or maxRetries retries have been used up. Waits between
+// attempts grow exponentially from retryBaseDelay, with jitter, and are
+// cut short when ctx is done.
+func withRetry(ctx context.Context, maxRetries int, retryable func(error) bool, attempt func() error) error {
+	var err error
+	for retry := 0; ; retry++ {
+		if err = attempt(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if retry >= maxRetries || !retryable(err) {
+			return err
+		}
+
+		delay := retryBaseDelay << uint(retry)
+		var challengeErr *ChallengeError
+		if errors.As(err, &challengeErr) {
+			delay *= challengeBackoffFactor
+		}
+		delay += time.Duration(rand.Int63n(int64(delay) / 2))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func isRetryable(err error) bool {
+	var challengeErr *ChallengeError
+	if errors.As(err, &challengeErr) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == apiThrottledCode
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return retryableStatuses[statusErr.StatusCode]
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
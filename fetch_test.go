@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI serves search pages from pages, keyed by page number, each after
+// delay. The first request for a page in failures fails with that status.
+type fakeAPI struct {
+	mu       sync.Mutex
+	pages    map[int]Listings
+	failures map[int]int
+	delay    time.Duration
+	requests []int
+}
+
+func (f *fakeAPI) Do(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	form, _ := url.ParseQuery(string(body))
+	page, _ := strconv.Atoi(form.Get("CurrentPage"))
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, page)
+	if status, ok := f.failures[page]; ok {
+		delete(f.failures, page)
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	response, err := json.Marshal(searchResponse{Listings: f.pages[page], ErrorCode: ErrorCode{Id: apiSuccessCode}})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(string(response))),
+	}, nil
+}
+
+// resultIDs returns the IDs of the listings, in order.
+func resultIDs(listings []Listing) string {
+	ids := make([]string, len(listings))
+	for i, listing := range listings {
+		ids[i] = listing.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestFetchListingsRetriedPage(t *testing.T) {
+	paging := Paging{RecordsPerPage: 3, TotalRecords: 5, TotalPages: 2}
+	api := &fakeAPI{
+		pages: map[int]Listings{
+			1: {Results: []Listing{{ID: "1"}, {ID: "2"}, {ID: "3"}}, Paging: paging},
+			// A listing added since page 1 pushed "3" onto page 2.
+			2: {Results: []Listing{{ID: "3"}, {ID: "4"}, {ID: "5"}}, Paging: paging},
+		},
+		failures: map[int]int{2: http.StatusServiceUnavailable},
+	}
+	fetcher := &Fetcher{client: api, limiter: newRateLimiter(0)}
+
+	listings, err := fetcher.FetchListings(context.Background(), Search{Name: "search", Params: url.Values{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultIDs(listings.Results); got != "1,2,3,4,5" {
+		t.Errorf("fetched %s, want 1,2,3,4,5", got)
+	}
+	if len(api.requests) != 3 || api.requests[1] != 2 || api.requests[2] != 2 {
+		t.Errorf("requested pages %v, want 1 and page 2 twice", api.requests)
+	}
+}
+
+func TestParsePaging(t *testing.T) {
+	raw := `{
+		"ErrorCode": {"Id": 200, "Description": "Success - OK", "ProductName": "Realtor.ca API"},
+		"Paging": {"RecordsPerPage": 12, "CurrentPage": 2, "TotalRecords": 37, "MaxRecords": 600, "TotalPages": 4, "RecordsShowing": 12, "Pins": 37},
+		"Results": [{"Id": "26190475", "MlsNumber": "X8235490"}]
+	}`
+	var response searchResponse
+	if err := json.Unmarshal([]byte(raw), &response); err != nil {
+		t.Fatal(err)
+	}
+	want := Paging{RecordsPerPage: 12, CurrentPage: 2, TotalRecords: 37, MaxRecords: 600, TotalPages: 4}
+	if response.Paging != want {
+		t.Errorf("Paging = %+v, want %+v", response.Paging, want)
+	}
+	if len(response.Results) != 1 || response.Results[0].ID != "26190475" {
+		t.Errorf("Results = %+v, want listing 26190475", response.Results)
+	}
+}
+
+func TestTotalPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		paging  Paging
+		perPage string
+		want    int
+	}{
+		{name: "given", paging: Paging{TotalRecords: 37, TotalPages: 4}, perPage: "50", want: 4},
+		{name: "worked out", paging: Paging{TotalRecords: 37}, perPage: "12", want: 4},
+		{name: "worked out exactly", paging: Paging{TotalRecords: 36}, perPage: "12", want: 3},
+		{name: "no page size", paging: Paging{TotalRecords: 37}, want: 1},
+		{name: "bad page size", paging: Paging{TotalRecords: 37}, perPage: "0", want: 1},
+		{name: "no results", paging: Paging{}, perPage: "12", want: 0},
+	}
+	for _, tt := range tests {
+		params := url.Values{}
+		if tt.perPage != "" {
+			params.Set("RecordsPerPage", tt.perPage)
+		}
+		if got := totalPages(tt.paging, params); got != tt.want {
+			t.Errorf("%s: totalPages(%+v) = %d, want %d", tt.name, tt.paging, got, tt.want)
+		}
+	}
+}
+
+func TestFetchListingsStopsAtTotalRecords(t *testing.T) {
+	// The API leaves out TotalPages, so the fetch stops once it has every
+	// matching listing rather than asking for an empty page.
+	paging := Paging{RecordsPerPage: 2, TotalRecords: 3}
+	api := &fakeAPI{pages: map[int]Listings{
+		1: {Results: []Listing{{ID: "1"}, {ID: "2"}}, Paging: paging},
+		2: {Results: []Listing{{ID: "3"}}, Paging: paging},
+	}}
+	fetcher := &Fetcher{client: api, limiter: newRateLimiter(0)}
+
+	listings, err := fetcher.FetchListings(context.Background(), Search{Params: url.Values{"RecordsPerPage": {"2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultIDs(listings.Results); got != "1,2,3" {
+		t.Errorf("fetched %s, want 1,2,3", got)
+	}
+	if len(api.requests) != 2 {
+		t.Errorf("requested pages %v, want 1 and 2", api.requests)
+	}
+	if listings.Paging.TotalRecords != 3 {
+		t.Errorf("TotalRecords = %d, want 3", listings.Paging.TotalRecords)
+	}
+}
+
+// searchFixture is a trimmed search response.
+const searchFixture = `{"ErrorCode":{"Id":200},"Paging":{"TotalRecords":1},"Results":[{"Id":"26190475","Property":{"Address":{"AddressText":"12 Main St|Toronto, Ontario M5V1A1"}}}]}`
+
+// compress returns searchFixture compressed as gzip, zlib or raw flate.
+func compress(t *testing.T, encoding string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if _, err := w.Write([]byte(searchFixture)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "gzip", encoding: "gzip", body: compress(t, "gzip")},
+		{name: "x-gzip", encoding: "x-gzip", body: compress(t, "gzip")},
+		{name: "gzip with mixed-case header", encoding: " GZip ", body: compress(t, "gzip")},
+		{name: "gzip without a header", body: compress(t, "gzip")},
+		{name: "deflate", encoding: "deflate", body: compress(t, "zlib")},
+		{name: "raw deflate", encoding: "deflate", body: compress(t, "flate")},
+		{name: "identity", body: []byte(searchFixture)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(tt.body))}
+			if tt.encoding != "" {
+				response.Header.Set("Content-Encoding", tt.encoding)
+			}
+			body, err := readBody(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result searchResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("decoded body does not parse: %v", err)
+			}
+			if len(result.Results) != 1 || result.Results[0].ID != "26190475" {
+				t.Errorf("Results = %+v, want listing 26190475", result.Results)
+			}
+		})
+	}
+}
+
+func TestReadBodyCorruptGzip(t *testing.T) {
+	response := &http.Response{
+		Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body:   ioutil.NopCloser(strings.NewReader(searchFixture)),
+	}
+	if _, err := readBody(response); err == nil {
+		t.Error("got no error for a body that is not gzip")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	// keywordsInclude and keywordsExclude are lower-cased keywords matched
+	// against listing descriptions. A listing has to mention at least one
+	// of the included keywords, when there are any, and none of the
+	// excluded ones.
+	keywordsInclude []string
+	keywordsExclude []string
+
+	// sqftMin and sqftMax bound the interior size, when non-zero.
+	// sqftUnknownPasses decides the fate of listings without a usable
+	// size.
+	sqftMin           int
+	sqftMax           int
+	sqftUnknownPasses bool
+
+	// maxPricePerSqFt caps the price per square foot, when non-zero.
+	// Listings where it cannot be computed pass unless
+	// pricePerSqFtStrict is set.
+	maxPricePerSqFt    int
+	pricePerSqFtStrict bool
+
+	// newConstructionOnly drops resale listings, and those of unknown
+	// construction status unless newConstructionLenient is set.
+	newConstructionOnly    bool
+	newConstructionLenient bool
+
+	// minLotSqFt is the smallest lot, in square feet, when non-zero. Lots
+	// of unknown area pass only if lotUnknownPasses is set.
+	minLotSqFt       int
+	lotUnknownPasses bool
+
+	// requireGarage and minParkingSpaces filter on parking. Listings that
+	// say nothing about parking pass only if parkingUnknownPasses is set.
+	requireGarage        bool
+	minParkingSpaces     int
+	parkingUnknownPasses bool
+
+	// maxDaysOnMarket drops listings older than this many days, when
+	// non-zero. Listings of unknown age pass.
+	maxDaysOnMarket int
+
+	// openHouseOnly drops listings without an upcoming open house.
+	openHouseOnly bool
+
+	// requirePhotos drops listings without photos. Unless
+	// MARK_FILTERED_SEEN is set they are alerted on once photos are added.
+	requirePhotos bool
+
+	// statusInclude are the lower-cased statuses to alert on, e.g.
+	// "active"; all are when empty. A listing without a status counts as
+	// active.
+	statusInclude []string
+
+	// propertyTypesInclude and propertyTypesExclude are property types to
+	// alert on and not to, all being alerted on when propertyTypesInclude
+	// is empty. Listings of unknown type pass an include list only if
+	// propertyTypeUnknownPasses is set.
+	propertyTypesInclude      []string
+	propertyTypesExclude      []string
+	propertyTypeUnknownPasses bool
+
+	// maxCondoFee caps the monthly condo fee, when non-zero. Listings
+	// without a fee, or whose fee cannot be read, pass unless
+	// condoFeeUnknownPasses is unset.
+	maxCondoFee           int
+	condoFeeUnknownPasses bool
+)
+
+// Filter decides whether a listing is worth an alert. It returns why the
+// listing was rejected, or an empty string to let it through.
+type Filter func(listing Listing) string
+
+// Filters applies several filters in turn; a listing has to pass them all.
+type Filters []Filter
+
+// Reason returns why the first filter to reject the listing did so, or an
+// empty string when it passes every one.
+func (fs Filters) Reason(listing Listing) string {
+	for _, filter := range fs {
+		if reason := filter(listing); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// Filter returns the listings passing every filter. With no filters all of
+// them pass.
+func (l Listings) Filter(filters ...Filter) Listings {
+	passed := Listings{Paging: l.Paging}
+	for _, listing := range l.Results {
+		if Filters(filters).Reason(listing) == "" {
+			passed.Results = append(passed.Results, listing)
+		}
+	}
+	return passed
+}
+
+// configuredFilters returns the filters enabled by the environment.
+func configuredFilters() Filters {
+	var fs Filters
+	if len(keywordsInclude) > 0 || len(keywordsExclude) > 0 {
+		fs = append(fs, keywordFilter(keywordsInclude, keywordsExclude))
+	}
+	if sqftMin > 0 || sqftMax > 0 {
+		fs = append(fs, sqftFilter(sqftMin, sqftMax, sqftUnknownPasses))
+	}
+	if maxPricePerSqFt > 0 {
+		fs = append(fs, pricePerSqFtFilter(maxPricePerSqFt, pricePerSqFtStrict))
+	}
+	if newConstructionOnly {
+		fs = append(fs, newConstructionFilter(newConstructionLenient))
+	}
+	if minLotSqFt > 0 {
+		fs = append(fs, lotFilter(minLotSqFt, lotUnknownPasses))
+	}
+	if requireGarage || minParkingSpaces > 0 {
+		fs = append(fs, parkingFilter(requireGarage, minParkingSpaces, parkingUnknownPasses))
+	}
+	if maxDaysOnMarket > 0 {
+		fs = append(fs, daysOnMarketFilter(maxDaysOnMarket))
+	}
+	if openHouseOnly {
+		fs = append(fs, openHouseFilter())
+	}
+	if len(statusInclude) > 0 {
+		fs = append(fs, statusFilter(statusInclude))
+	}
+	if requirePhotos {
+		fs = append(fs, photoFilter())
+	}
+	if maxCondoFee > 0 {
+		fs = append(fs, condoFeeFilter(maxCondoFee, condoFeeUnknownPasses))
+	}
+	if len(propertyTypesInclude) > 0 || len(propertyTypesExclude) > 0 {
+		fs = append(fs, propertyTypeFilter(propertyTypesInclude, propertyTypesExclude, propertyTypeUnknownPasses))
+	}
+	return fs
+}
+
+// keywordFilter requires the description to mention one of include, when
+// there are any, and none of exclude. Keywords are lower-case.
+func keywordFilter(include, exclude []string) Filter {
+	return func(listing Listing) string {
+		description := strings.ToLower(listing.Description)
+		for _, keyword := range exclude {
+			if strings.Contains(description, keyword) {
+				return "description mentions " + keyword
+			}
+		}
+		if len(include) == 0 {
+			return ""
+		}
+		for _, keyword := range include {
+			if strings.Contains(description, keyword) {
+				return ""
+			}
+		}
+		return "description mentions none of the required keywords"
+	}
+}
+
+// sqftFilter bounds the interior size by min and max, where non-zero.
+func sqftFilter(min, max int, unknownPasses bool) Filter {
+	return func(listing Listing) string {
+		switch {
+		case listing.SquareFeet == 0:
+			if !unknownPasses {
+				return "interior size is unknown"
+			}
+		case min > 0 && listing.SquareFeet < min:
+			return "smaller than " + strconv.Itoa(min) + " sqft"
+		case max > 0 && listing.SquareFeet > max:
+			return "larger than " + strconv.Itoa(max) + " sqft"
+		}
+		return ""
+	}
+}
+
+func pricePerSqFtFilter(max int, strict bool) Filter {
+	return func(listing Listing) string {
+		switch {
+		case listing.PricePerSqFt == 0:
+			if strict {
+				return "price per sqft is unknown"
+			}
+		case listing.PricePerSqFt > max:
+			return "more than " + formatDollars(max) + "/sqft"
+		}
+		return ""
+	}
+}
+
+func newConstructionFilter(lenient bool) Filter {
+	return func(listing Listing) string {
+		switch listing.Construction {
+		case ConstructionResale:
+			return "resale"
+		case "":
+			if !lenient {
+				return "construction status is unknown"
+			}
+		}
+		return ""
+	}
+}
+
+func lotFilter(minSqFt int, unknownPasses bool) Filter {
+	return func(listing Listing) string {
+		switch {
+		case listing.LotSquareFeet == 0:
+			if !unknownPasses {
+				return "lot size is unknown"
+			}
+		case listing.LotSquareFeet < minSqFt:
+			return "lot smaller than " + strconv.Itoa(minSqFt) + " sqft"
+		}
+		return ""
+	}
+}
+
+func parkingFilter(garage bool, minSpaces int, unknownPasses bool) Filter {
+	return func(listing Listing) string {
+		switch {
+		case !listing.ParkingKnown():
+			if !unknownPasses {
+				return "parking is unknown"
+			}
+		case garage && !listing.HasGarage:
+			return "no garage"
+		case minSpaces > 0 && listing.ParkingSpaces < minSpaces:
+			return "fewer than " + strconv.Itoa(minSpaces) + " parking spaces"
+		}
+		return ""
+	}
+}
+
+// daysOnMarketFilter drops listings older than maxDays. Listings of
+// unknown age pass.
+func daysOnMarketFilter(maxDays int) Filter {
+	return func(listing Listing) string {
+		if days, ok := listing.DaysOnMarket(); ok && days > maxDays {
+			return "on the market for " + strconv.Itoa(days) + " days"
+		}
+		return ""
+	}
+}
+
+func openHouseFilter() Filter {
+	return func(listing Listing) string {
+		if _, ok := listing.NextOpenHouse(); !ok {
+			return "no upcoming open house"
+		}
+		return ""
+	}
+}
+
+func photoFilter() Filter {
+	return func(listing Listing) string {
+		if listing.PhotoURL == "" {
+			return "no photos"
+		}
+		return ""
+	}
+}
+
+// statusFilter lets through the listings with one of the lower-case
+// statuses.
+func statusFilter(statuses []string) Filter {
+	return func(listing Listing) string {
+		status := strings.ToLower(listing.Status)
+		for _, s := range statuses {
+			if status == s {
+				return ""
+			}
+		}
+		return "status is " + listing.Status
+	}
+}
+
+// propertyTypeFilter keeps listings of one of the include types, when
+// there are any, and drops those of the exclude types.
+func propertyTypeFilter(include, exclude []string, unknownPasses bool) Filter {
+	return func(listing Listing) string {
+		for _, t := range exclude {
+			if listing.PropertyType == t {
+				return "property type is " + t
+			}
+		}
+		if len(include) == 0 {
+			return ""
+		}
+		if listing.PropertyType == "" {
+			if unknownPasses {
+				return ""
+			}
+			return "property type is unknown"
+		}
+		for _, t := range include {
+			if listing.PropertyType == t {
+				return ""
+			}
+		}
+		return "property type is " + listing.PropertyType
+	}
+}
+
+// condoFeeFilter drops listings whose monthly condo fee is over max.
+func condoFeeFilter(max int, unknownPasses bool) Filter {
+	return func(listing Listing) string {
+		switch {
+		case listing.CondoFee == 0:
+			if !unknownPasses {
+				return "condo fee is unknown"
+			}
+		case listing.CondoFee > max:
+			return "condo fee over " + formatDollars(max) + "/month"
+		}
+		return ""
+	}
+}
+
+func lowerAll(values []string) []string {
+	for i, v := range values {
+		values[i] = strings.ToLower(v)
+	}
+	return values
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFilterCombinesWithAnd(t *testing.T) {
+	listings := Listings{
+		Results: []Listing{
+			{ID: "1", Description: "Renovated kitchen", SquareFeet: 1500},
+			{ID: "2", Description: "Renovated kitchen", SquareFeet: 900},
+			{ID: "3", Description: "Original condition", SquareFeet: 1500},
+			{ID: "4", Description: "Renovated, needs a new roof", SquareFeet: 2000},
+			{ID: "5", Description: "Original condition", SquareFeet: 700},
+		},
+		Paging: Paging{TotalRecords: 5},
+	}
+	filters := []Filter{
+		keywordFilter([]string{"renovated"}, []string{"roof"}),
+		sqftFilter(1000, 0, false),
+	}
+
+	passed := listings.Filter(filters...)
+	if got := resultIDs(passed.Results); got != "1" {
+		t.Errorf("passed %s, want only the listing passing both filters", got)
+	}
+	if passed.Paging != listings.Paging {
+		t.Errorf("Paging = %+v, want %+v kept", passed.Paging, listings.Paging)
+	}
+
+	// The reason is the first filter's to reject the listing.
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "1", want: ""},
+		{id: "2", want: "smaller than 1000 sqft"},
+		{id: "3", want: "description mentions none of the required keywords"},
+		{id: "4", want: "description mentions roof"},
+		{id: "5", want: "description mentions none of the required keywords"},
+	}
+	for i, tt := range tests {
+		if got := Filters(filters).Reason(listings.Results[i]); got != tt.want {
+			t.Errorf("listing %s rejected for %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestFilterNone(t *testing.T) {
+	listings := Listings{Results: []Listing{{ID: "1"}, {ID: "2", SquareFeet: 500}, {ID: "3", Description: "roof"}}}
+	if got := resultIDs(listings.Filter().Results); got != "1,2,3" {
+		t.Errorf("passed %s without filters, want every listing", got)
+	}
+	if reason := (Filters{}).Reason(Listing{ID: "1"}); reason != "" {
+		t.Errorf("rejected for %q without filters", reason)
+	}
+	if got := (Listings{}).Filter(sqftFilter(1000, 0, false)).Results; len(got) != 0 {
+		t.Errorf("filtering no listings passed %d", len(got))
+	}
+}
+
+func TestPhotoFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "no photos", raw: `{"Id":"1","Property":{"Photo":[]}}`, want: "no photos"},
+		{name: "no photo list", raw: `{"Id":"1"}`, want: "no photos"},
+		{name: "photo without a path", raw: `{"Id":"1","Property":{"Photo":[{"HighResPath":""}]}}`, want: "no photos"},
+		{name: "one photo", raw: `{"Id":"1","Property":{"Photo":[{"HighResPath":"https://cdn.realtor.ca/listings/1/a.jpg"}]}}`},
+		{name: "medium resolution only", raw: `{"Id":"1","Property":{"Photo":[{"MedResPath":"https://cdn.realtor.ca/listings/1/a.jpg"}]}}`},
+	}
+	for _, tt := range tests {
+		if got := photoFilter()(parseListing(t, tt.raw)); got != tt.want {
+			t.Errorf("%s: photoFilter gave %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	defer func(v bool) { requirePhotos = v }(requirePhotos)
+	requirePhotos = false
+	if reason := configuredFilters().Reason(Listing{ID: "1"}); reason != "" {
+		t.Errorf("listing without photos rejected without REQUIRE_PHOTOS: %q", reason)
+	}
+	requirePhotos = true
+	if reason := configuredFilters().Reason(Listing{ID: "1"}); reason != "no photos" {
+		t.Errorf("listing without photos rejected for %q with REQUIRE_PHOTOS, want no photos", reason)
+	}
+}
+
+func TestPhotoAddedLater(t *testing.T) {
+	defer func(v, mark bool) { dryRun, markFilteredSeen = v, mark }(dryRun, markFilteredSeen)
+	dryRun = false
+
+	tests := []struct {
+		markFilteredSeen bool
+		wantAlerts       string
+	}{
+		{markFilteredSeen: false, wantAlerts: "new:1"},
+		{markFilteredSeen: true, wantAlerts: ""},
+	}
+	for _, tt := range tests {
+		markFilteredSeen = tt.markFilteredSeen
+		ctx := context.Background()
+		notify := newRecordingNotifier()
+		r := &searchRun{
+			search:  Search{Name: "search"},
+			db:      NewDB(newFakeDynamo(), "search"),
+			notify:  notify,
+			filters: Filters{photoFilter()},
+			logger:  testLogger(),
+		}
+
+		if err := r.process(ctx, &Listings{Results: []Listing{{ID: "1"}}}); err != nil {
+			t.Fatal(err)
+		}
+		if got := notify.alerts(); got != "" {
+			t.Errorf("MARK_FILTERED_SEEN %v: alerted on %s without photos", tt.markFilteredSeen, got)
+		}
+		withPhoto := Listing{ID: "1", PhotoURL: "https://cdn.realtor.ca/listings/1/a.jpg"}
+		if err := r.process(ctx, &Listings{Results: []Listing{withPhoto}}); err != nil {
+			t.Fatal(err)
+		}
+		if got := notify.alerts(); got != tt.wantAlerts {
+			t.Errorf("MARK_FILTERED_SEEN %v: once a photo was added, sent %q, want %q", tt.markFilteredSeen, got, tt.wantAlerts)
+		}
+	}
+}
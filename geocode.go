@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	geocodeURL       = "https://nominatim.openstreetmap.org/search"
+	geocodeUserAgent = "realtorca (https://github.com/alexmorozov/realtorca)"
+
+	// dynamoGeocodePartitionKey holds cached geocoding results, keyed by
+	// lower-cased place name.
+	dynamoGeocodePartitionKey = "geocode"
+)
+
+type BoundingBox struct {
+	LatitudeMin  float64 `dynamodbav:"lat_min"`
+	LatitudeMax  float64 `dynamodbav:"lat_max"`
+	LongitudeMin float64 `dynamodbav:"lng_min"`
+	LongitudeMax float64 `dynamodbav:"lng_max"`
+}
+
+// Apply sets the box as the area of a search.
+func (b BoundingBox) Apply(params url.Values) {
+	params.Set("LatitudeMin", strconv.FormatFloat(b.LatitudeMin, 'f', -1, 64))
+	params.Set("LatitudeMax", strconv.FormatFloat(b.LatitudeMax, 'f', -1, 64))
+	params.Set("LongitudeMin", strconv.FormatFloat(b.LongitudeMin, 'f', -1, 64))
+	params.Set("LongitudeMax", strconv.FormatFloat(b.LongitudeMax, 'f', -1, 64))
+}
+
+// Geocoder turns place names into bounding boxes using OpenStreetMap's
+// Nominatim, remembering the answers in DynamoDB since places do not move.
+type Geocoder struct {
+	client httpClient
+	dynamo dynamoAPI
+}
+
+func NewGeocoder(client httpClient, dynamo dynamoAPI) *Geocoder {
+	return &Geocoder{client: client, dynamo: dynamo}
+}
+
+func (g *Geocoder) BoundingBox(ctx context.Context, place string) (BoundingBox, error) {
+	key := map[string]*dynamodb.AttributeValue{
+		dynamoPartitionKeyName: {S: aws.String(dynamoGeocodePartitionKey)},
+		dynamoSortKeyName:      {S: aws.String(strings.ToLower(place))},
+	}
+
+	var box BoundingBox
+	cached, err := g.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       key,
+		TableName: aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return box, err
+	}
+	if cached.Item != nil {
+		err = dynamodbattribute.UnmarshalMap(cached.Item, &box)
+		return box, err
+	}
+
+	if box, err = g.lookup(ctx, place); err != nil {
+		return box, err
+	}
+
+	item, err := dynamodbattribute.MarshalMap(box)
+	if err != nil {
+		return box, err
+	}
+	for k, v := range key {
+		item[k] = v
+	}
+	_, err = g.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dynamoTableName),
+	})
+	return box, err
+}
+
+func (g *Geocoder) lookup(ctx context.Context, place string) (BoundingBox, error) {
+	var box BoundingBox
+
+	query := url.Values{
+		"q":            {place},
+		"format":       {"json"},
+		"limit":        {"1"},
+		"countrycodes": {"ca"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", geocodeURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return box, err
+	}
+	req.Header.Set("User-Agent", geocodeUserAgent)
+
+	response, err := g.client.Do(req)
+	if err != nil {
+		return box, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return box, &HTTPStatusError{StatusCode: response.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return box, err
+	}
+
+	// Nominatim returns the box as strings: south, north, west, east.
+	var results []struct {
+		BoundingBox []string `json:"boundingbox"`
+	}
+	if err = json.Unmarshal(body, &results); err != nil {
+		return box, err
+	}
+	if len(results) == 0 || len(results[0].BoundingBox) != 4 {
+		return box, errors.New("place not found: " + place)
+	}
+
+	var coords [4]float64
+	for i, v := range results[0].BoundingBox {
+		if coords[i], err = strconv.ParseFloat(v, 64); err != nil {
+			return box, fmt.Errorf("bad bounding box for %s: %w", place, err)
+		}
+	}
+	return BoundingBox{
+		LatitudeMin:  coords[0],
+		LatitudeMax:  coords[1],
+		LongitudeMin: coords[2],
+		LongitudeMax: coords[3],
+	}, nil
+}
@@ -1,8 +1,15 @@
 module github.com/alexmorozov/realtorca
 
-go 1.13
+go 1.21
 
 require (
 	github.com/aws/aws-lambda-go v1.14.0
 	github.com/aws/aws-sdk-go v1.29.3
+	github.com/aws/aws-xray-sdk-go v1.0.0
+	golang.org/x/sync v0.6.0
+)
+
+require (
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 )
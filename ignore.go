@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// dynamoIgnorePartitionKey and dynamoIgnoreSortKey locate the item
+	// holding the ignore list kept in DynamoDB, whose "entries" attribute
+	// is a list of strings, e.g.:
+	//
+	//   aws dynamodb put-item --table-name $DYNAMO_TABLE_NAME --item \
+	//     '{"partition_key":{"S":"ignore"},"listing_id":{"S":"#list"},"entries":{"SS":["21933083","12 Main St"]}}'
+	dynamoIgnorePartitionKey = "ignore"
+	dynamoIgnoreSortKey      = "#list"
+)
+
+// ignoreMarkSeen marks ignored listings seen, so they are not alerted on
+// should they stop matching the ignore list.
+var ignoreMarkSeen bool
+
+// IgnoreList holds the listings never to alert on, whatever happens to
+// them. Entries that are all digits are listing IDs; anything else matches
+// listings whose address contains it, compared after normalizeForDedup.
+type IgnoreList struct {
+	ids       map[string]bool
+	addresses []string
+}
+
+func NewIgnoreList(entries []string) *IgnoreList {
+	ignore := &IgnoreList{ids: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.Trim(entry, "0123456789") == "":
+			ignore.ids[entry] = true
+		default:
+			if address := normalizeForDedup(entry); address != "" {
+				ignore.addresses = append(ignore.addresses, address)
+			}
+		}
+	}
+	return ignore
+}
+
+// loadIgnoreList returns the ignore list made of the entries in
+// IGNORE_LIST and those in the DynamoDB ignore item, if there is one.
+func loadIgnoreList(ctx context.Context, dynamo dynamoAPI) (*IgnoreList, error) {
+	entries := splitList(os.Getenv("IGNORE_LIST"))
+
+	item, err := dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoPartitionKeyName: {S: aws.String(dynamoIgnorePartitionKey)},
+			dynamoSortKeyName:      {S: aws.String(dynamoIgnoreSortKey)},
+		},
+		TableName: aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if item.Item != nil {
+		var stored struct {
+			Entries []string `dynamodbav:"entries"`
+		}
+		if err = dynamodbattribute.UnmarshalMap(item.Item, &stored); err != nil {
+			return nil, err
+		}
+		entries = append(entries, stored.Entries...)
+	}
+	return NewIgnoreList(entries), nil
+}
+
+// Match returns the entry that makes the listing ignored, or an empty
+// string. A listing that has gone is matched on the address on record,
+// so one seen before addresses were kept can only match by ID.
+func (l *IgnoreList) Match(listing Listing) string {
+	if l == nil {
+		return ""
+	}
+	if l.ids[listing.ID] {
+		return listing.ID
+	}
+	if len(l.addresses) == 0 || listing.Address == "" {
+		return ""
+	}
+	address := " " + normalizeForDedup(listing.Address) + " "
+	for _, entry := range l.addresses {
+		// Whole words only, so "12 main st" does not match "112 main st".
+		if strings.Contains(address, " "+entry+" ") {
+			return entry
+		}
+	}
+	return ""
+}
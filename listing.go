@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenHouse is a scheduled open house. End is zero when unknown.
+type OpenHouse struct {
+	Start time.Time
+	End   time.Time
+}
+
+// String formats the open house like "Sat Mar 7, 2:00 PM - 4:00 PM".
+func (o OpenHouse) String() string {
+	s := o.Start.Format("Mon Jan 2, 3:04 PM")
+	if !o.End.IsZero() {
+		s += " - " + o.End.Format("3:04 PM")
+	}
+	return s
+}
+
+type Listing struct {
+	ID                 string
+	RelativeDetailsURL string
+
+	// Price is the asking price exactly as realtor.ca displays it, and
+	// PriceAmount is the same price in whole dollars, or 0 when it could
+	// not be parsed (missing, a range, a foreign currency, ...).
+	Price       string
+	PriceAmount int
+
+	// Address is the civic address on one line. Listings that hide the
+	// exact location may only carry a city or "Address not available".
+	Address string
+	// Latitude and Longitude locate the listing, or are both 0 when not
+	// given.
+	Latitude  float64
+	Longitude float64
+
+	// Bedrooms and Bathrooms are the counts as realtor.ca displays them,
+	// e.g. "3 + 1" for three bedrooms above grade and one below, and the
+	// Total fields their best-effort sum. A count is missing when its raw
+	// string is empty.
+	Bedrooms       string
+	BedroomsTotal  int
+	Bathrooms      string
+	BathroomsTotal int
+
+	// SizeInterior is the interior size as realtor.ca displays it and
+	// SquareFeet the same size in square feet, or 0 when unknown.
+	SizeInterior string
+	SquareFeet   int
+
+	// PricePerSqFt is PriceAmount over SquareFeet in whole dollars, or 0
+	// when either is unknown.
+	PricePerSqFt int
+
+	// Description is the listing's public remarks, which may be empty.
+	Description string
+
+	// PhotoURL is the first listing photo, if any.
+	PhotoURL string
+	// TourURL links to the listing's virtual tour or video, if it has an
+	// http(s) one.
+	TourURL string
+
+	// Status is the listing's status, such as "Active" or "Conditional".
+	// Listings that do not give one are taken to be active.
+	Status string
+
+	// YearBuilt is the year construction finished, or 0 when unknown.
+	YearBuilt int
+	// Construction is ConstructionNew or ConstructionResale, or empty
+	// when the listing gives no indication.
+	Construction string
+
+	// ListedAt is when the listing was put on realtor.ca, if given.
+	// FirstSeen is when this scraper first saw it, filled in from the
+	// seen-listings cache rather than the API.
+	ListedAt  time.Time
+	FirstSeen time.Time
+
+	// LotSize and LotFrontage are the lot's size and frontage as
+	// realtor.ca displays them, e.g. "50 x 120 FT" or "0.5 ac|under 1
+	// acre", and LotSquareFeet the lot's area in square feet, or 0 when it
+	// cannot be worked out, as for frontage-only lots.
+	LotSize       string
+	LotFrontage   string
+	LotSquareFeet int
+
+	// Parking lists the kinds of parking, e.g. "Attached Garage", and
+	// ParkingSpaces their total number of spaces, or 0 when not given.
+	// HasGarage is set when any of them is a garage.
+	Parking       []string
+	ParkingSpaces int
+	HasGarage     bool
+
+	// OpenHouses are the listing's scheduled open houses, soonest first.
+	// Past ones are not removed; see NextOpenHouse.
+	OpenHouses []OpenHouse
+
+	// CondoFeeRaw is the condo or maintenance fee as realtor.ca displays
+	// it, e.g. "$5,400 Yearly", and CondoFee the same fee per month in
+	// whole dollars, or 0 when there is none or it cannot be parsed.
+	CondoFeeRaw string
+	CondoFee    int
+
+	// PropertyType is one of propertyTypes, normalized from realtor.ca's
+	// building and property types, or empty when they are not given or not
+	// recognized.
+	PropertyType string
+
+	// CommuteMinutes is the commute time to COMMUTE_DESTINATION, or 0 when
+	// unknown or no commute destination is configured. Like FirstSeen it
+	// is filled in later, not from the API.
+	CommuteMinutes int
+
+	// Brokerage is the listing brokerage, and AgentName and AgentPhone
+	// the listing agent's name and first phone number. Any of them may be
+	// empty, as for private sales.
+	Brokerage  string
+	AgentName  string
+	AgentPhone string
+
+	// Currency is the currency the search asked prices in. ConvertedPrice
+	// is PriceAmount in ConvertedCurrency, DISPLAY_CURRENCY, or 0 when not
+	// converted.
+	Currency          string
+	ConvertedPrice    int
+	ConvertedCurrency string
+
+	// SearchName is the name of the saved search that found the listing.
+	SearchName string
+	// ForRent is set for listings found by a rental search, whose prices
+	// are monthly rents.
+	ForRent bool
+	// NewThisRun marks, in a queued digest, the listings that were not yet
+	// seen when this run started, as opposed to those carried over from
+	// earlier runs. It is not stored with them.
+	NewThisRun bool `dynamodbav:"-"`
+}
+
+type rawPhone struct {
+	AreaCode    string
+	PhoneNumber string
+}
+
+// rawListing mirrors the nested layout of a search result; Listing flattens
+// the parts we use.
+type rawListing struct {
+	Id                 string
+	RelativeDetailsURL string
+	PublicRemarks      string
+	InsertedDateUTC    string
+	Status             string
+	StatusId           string
+	AlternateURL       struct {
+		VideoLink string
+	}
+	OpenHouse []struct {
+		StartDateTime string
+		EndDateTime   string
+	}
+	Building struct {
+		Bedrooms                    string
+		BathroomTotal               string
+		SizeInterior                string
+		ConstructedDate             string
+		Type                        string
+		ConstructionStyleAttachment string
+	}
+	Land struct {
+		SizeTotal    string
+		SizeFrontage string
+	}
+	Individual []struct {
+		Name         string
+		Organization struct {
+			Name string
+		}
+		Phones []rawPhone
+	}
+	Property struct {
+		Price          string
+		Type           string
+		AssociationFee string
+		MaintenanceFee string
+		Address        struct {
+			AddressText string
+			Latitude    string
+			Longitude   string
+		}
+		Parking []struct {
+			Name string
+		}
+		ParkingSpaceTotal string
+		ParkingType       string
+		Photo             []struct {
+			HighResPath string
+			MedResPath  string
+		}
+	}
+}
+
+func (l *Listing) UnmarshalJSON(data []byte) error {
+	var raw rawListing
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*l = Listing{
+		ID:                 raw.Id,
+		RelativeDetailsURL: raw.RelativeDetailsURL,
+		Price:              strings.TrimSpace(raw.Property.Price),
+		Address:            normalizeAddress(raw.Property.Address.AddressText),
+		Description:        strings.TrimSpace(raw.PublicRemarks),
+	}
+	l.PriceAmount, _ = parsePrice(l.Price)
+	l.Latitude, l.Longitude = parseCoordinates(raw.Property.Address.Latitude, raw.Property.Address.Longitude)
+	l.Bedrooms = strings.TrimSpace(raw.Building.Bedrooms)
+	l.BedroomsTotal, _ = parseRoomCount(l.Bedrooms)
+	l.Bathrooms = strings.TrimSpace(raw.Building.BathroomTotal)
+	l.BathroomsTotal, _ = parseRoomCount(l.Bathrooms)
+	l.SizeInterior = strings.TrimSpace(raw.Building.SizeInterior)
+	l.SquareFeet, _ = parseArea(l.SizeInterior)
+	if l.PriceAmount > 0 && l.SquareFeet > 0 {
+		l.PricePerSqFt = (l.PriceAmount + l.SquareFeet/2) / l.SquareFeet
+	}
+	l.LotSize = strings.TrimSpace(raw.Land.SizeTotal)
+	l.LotFrontage = strings.TrimSpace(raw.Land.SizeFrontage)
+	l.LotSquareFeet, _ = parseLotSize(l.LotSize)
+	for _, parking := range raw.Property.Parking {
+		if name := strings.TrimSpace(parking.Name); name != "" {
+			l.Parking = append(l.Parking, name)
+		}
+	}
+	if len(l.Parking) == 0 && strings.TrimSpace(raw.Property.ParkingType) != "" {
+		l.Parking = []string{strings.TrimSpace(raw.Property.ParkingType)}
+	}
+	for _, name := range l.Parking {
+		if strings.Contains(strings.ToLower(name), "garage") {
+			l.HasGarage = true
+		}
+	}
+	l.ParkingSpaces, _ = strconv.Atoi(strings.TrimSpace(raw.Property.ParkingSpaceTotal))
+	l.Status = listingStatus(raw.Status, raw.StatusId)
+	l.ListedAt, _ = parseDotNetTicks(raw.InsertedDateUTC)
+	l.YearBuilt, _ = strconv.Atoi(strings.TrimSpace(raw.Building.ConstructedDate))
+	l.Construction = constructionStatus(l.YearBuilt, l.Description)
+	l.CondoFeeRaw = strings.TrimSpace(raw.Property.AssociationFee)
+	if l.CondoFeeRaw == "" {
+		l.CondoFeeRaw = strings.TrimSpace(raw.Property.MaintenanceFee)
+	}
+	l.CondoFee, _ = parseCondoFee(l.CondoFeeRaw)
+	l.PropertyType = normalizePropertyType(raw.Building.Type, raw.Building.ConstructionStyleAttachment, raw.Property.Type)
+	l.TourURL = webURL(raw.AlternateURL.VideoLink)
+	for _, rawOpenHouse := range raw.OpenHouse {
+		start, ok := parseOpenHouseTime(rawOpenHouse.StartDateTime)
+		if !ok {
+			continue
+		}
+		end, _ := parseOpenHouseTime(rawOpenHouse.EndDateTime)
+		l.OpenHouses = append(l.OpenHouses, OpenHouse{Start: start, End: end})
+	}
+	sort.Slice(l.OpenHouses, func(i, j int) bool {
+		return l.OpenHouses[i].Start.Before(l.OpenHouses[j].Start)
+	})
+	for _, individual := range raw.Individual {
+		if l.AgentName == "" {
+			l.AgentName = strings.TrimSpace(individual.Name)
+			l.AgentPhone = formatPhone(individual.Phones)
+		}
+		if l.Brokerage == "" {
+			l.Brokerage = strings.TrimSpace(individual.Organization.Name)
+		}
+	}
+	for _, photo := range raw.Property.Photo {
+		path := photo.HighResPath
+		if path == "" {
+			path = photo.MedResPath
+		}
+		if path != "" {
+			l.PhotoURL = cleanPhotoURL(path)
+			break
+		}
+	}
+
+	return nil
+}
+
+// URL returns the listing's page on realtor.ca. The path is tidied up and
+// properly escaped, and with CLEAN_URLS set the query is dropped.
+func (l Listing) URL() string {
+	path, query := strings.TrimSpace(l.RelativeDetailsURL), ""
+	if i := strings.Index(path, "#"); i >= 0 {
+		path = path[:i]
+	}
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+
+	page := &url.URL{Path: cleanPath(path), RawQuery: query}
+	if cleanURLs {
+		page.RawQuery = ""
+	}
+	return baseURL + page.String()
+}
+
+// ShortPath returns the canonical short path of the listing, e.g.
+// /real-estate/21933083, without the address slug and query. realtor.ca
+// redirects it to the full page.
+func (l Listing) ShortPath() string {
+	path := l.RelativeDetailsURL
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	path = cleanPath(path)
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) >= 2 && parts[0] == "real-estate" {
+		path = "/" + parts[0] + "/" + parts[1]
+	}
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// ShortURL is ShortPath on realtor.ca, e.g.
+// https://realtor.ca/real-estate/21933083.
+func (l Listing) ShortURL() string {
+	return baseURL + l.ShortPath()
+}
+
+// MapURL links to the listing on Google Maps: at its coordinates when
+// known, otherwise a search for its address. It is empty when there is
+// neither.
+func (l Listing) MapURL() string {
+	query := ""
+	switch {
+	case l.Latitude != 0 || l.Longitude != 0:
+		query = strconv.FormatFloat(l.Latitude, 'f', -1, 64) + "," + strconv.FormatFloat(l.Longitude, 'f', -1, 64)
+	case l.Address != "" && !strings.EqualFold(l.Address, "Address not available"):
+		query = l.Address
+	default:
+		return ""
+	}
+	return mapsSearchURL + "&query=" + url.QueryEscape(query)
+}
+
+// cleanPath gives a path a single leading slash and collapses repeated
+// slashes.
+func cleanPath(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.Replace(path, "//", "/", -1)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// NextOpenHouse returns the soonest open house that is not over yet.
+func (l Listing) NextOpenHouse() (OpenHouse, bool) {
+	now := time.Now()
+	for _, openHouse := range l.OpenHouses {
+		end := openHouse.End
+		if end.IsZero() {
+			end = openHouse.Start
+		}
+		if end.After(now) {
+			return openHouse, true
+		}
+	}
+	return OpenHouse{}, false
+}
+
+// OpenHouseText describes the next open house, or is empty when none is
+// coming up.
+func (l Listing) OpenHouseText() string {
+	if openHouse, ok := l.NextOpenHouse(); ok {
+		return "Open house: " + openHouse.String()
+	}
+	return ""
+}
+
+// AgentText describes who listed the listing, e.g. "Listed by Jane Doe
+// (519-555-0100), Example Realty Inc." or "Listed by Example Realty Inc.",
+// or is empty when neither agent nor brokerage is given.
+func (l Listing) AgentText() string {
+	agent := l.AgentName
+	if agent != "" && l.AgentPhone != "" {
+		agent += " (" + l.AgentPhone + ")"
+	}
+	switch {
+	case agent != "" && l.Brokerage != "":
+		return "Listed by " + agent + ", " + l.Brokerage
+	case agent != "":
+		return "Listed by " + agent
+	case l.Brokerage != "":
+		return "Listed by " + l.Brokerage
+	}
+	return ""
+}
+
+// formatPhone returns the first of the phone numbers, e.g. "519-555-0100",
+// or an empty string.
+func formatPhone(phones []rawPhone) string {
+	for _, phone := range phones {
+		number := strings.TrimSpace(phone.PhoneNumber)
+		if number == "" {
+			continue
+		}
+		if areaCode := strings.TrimSpace(phone.AreaCode); areaCode != "" {
+			number = areaCode + "-" + number
+		}
+		return number
+	}
+	return ""
+}
+
+// DaysOnMarket returns the listing's age in whole days, from ListedAt or
+// failing that FirstSeen.
+func (l Listing) DaysOnMarket() (int, bool) {
+	listed := l.ListedAt
+	if listed.IsZero() {
+		listed = l.FirstSeen
+	}
+	if listed.IsZero() {
+		return 0, false
+	}
+	return int(time.Since(listed).Hours() / 24), true
+}
+
+// AgeText describes the listing's age, e.g. "Listed 2 days ago", or is
+// empty when unknown.
+func (l Listing) AgeText() string {
+	days, ok := l.DaysOnMarket()
+	switch {
+	case !ok:
+		return ""
+	case days <= 0:
+		return "Listed today"
+	case days == 1:
+		return "Listed yesterday"
+	default:
+		return "Listed " + strconv.Itoa(days) + " days ago"
+	}
+}
+
+// LotText describes the lot, e.g. "Lot: 50 x 120 FT", or is empty when
+// unknown.
+func (l Listing) LotText() string {
+	switch {
+	case l.LotSize != "":
+		text := "Lot: " + strings.Replace(l.LotSize, "|", ", ", -1)
+		if l.LotSquareFeet > 0 && !strings.Contains(strings.ToLower(l.LotSize), "sqft") {
+			text += " (" + strings.TrimPrefix(formatDollars(l.LotSquareFeet), "$") + " sqft)"
+		}
+		return text
+	case l.LotFrontage != "":
+		return "Lot: " + l.LotFrontage + " frontage"
+	}
+	return ""
+}
+
+// ParkingKnown reports whether the listing says anything about parking.
+func (l Listing) ParkingKnown() bool {
+	return len(l.Parking) > 0 || l.ParkingSpaces > 0
+}
+
+// ParkingText summarizes the parking, e.g. "Parking: 2 spaces (Attached
+// Garage)", or is empty when unknown.
+func (l Listing) ParkingText() string {
+	if !l.ParkingKnown() {
+		return ""
+	}
+	var text string
+	switch {
+	case l.ParkingSpaces == 1:
+		text = "1 space"
+	case l.ParkingSpaces > 1:
+		text = strconv.Itoa(l.ParkingSpaces) + " spaces"
+	}
+	if len(l.Parking) > 0 {
+		kinds := strings.Join(l.Parking, ", ")
+		if text == "" {
+			text = kinds
+		} else {
+			text += " (" + kinds + ")"
+		}
+	}
+	return "Parking: " + text
+}
+
+// Area returns the part of the address naming the neighbourhood or city,
+// which is the first component after the street.
+func (l Listing) Area() string {
+	parts := strings.Split(l.Address, ", ")
+	if len(parts) >= 2 {
+		return parts[1]
+	}
+	return l.Address
+}
+
+// DisplayPrice returns the price formatted for alerts, falling back to the
+// raw text when it could not be parsed. Rents are marked as monthly, and
+// the converted price follows when there is one.
+func (l Listing) DisplayPrice() string {
+	price := l.ListedPrice()
+	if l.PriceAmount > 0 && l.ConvertedPrice > 0 {
+		price += " (~" + strings.TrimPrefix(formatDollars(l.ConvertedPrice), "$") + " " + l.ConvertedCurrency + ")"
+	}
+	return price
+}
+
+// ListedPrice is DisplayPrice without the converted price, in the currency
+// the listing was fetched in.
+func (l Listing) ListedPrice() string {
+	if l.PriceAmount <= 0 {
+		return l.Price
+	}
+	price := formatDollars(l.PriceAmount)
+	if l.ForRent {
+		price += "/mo"
+	}
+	return price
+}
+
+// TransactionLabel says whether the listing is for sale or for rent,
+// whether it is new construction, and its status when known, e.g. "For
+// sale (Active)".
+func (l Listing) TransactionLabel() string {
+	label := "For sale"
+	if l.ForRent {
+		label = "For rent"
+	}
+	if name, ok := propertyTypeNames[l.PropertyType]; ok {
+		label = name + " " + strings.ToLower(label)
+	}
+	if l.Construction == ConstructionNew {
+		label += ", new construction"
+	}
+	if l.Status != "" {
+		label += " (" + l.Status + ")"
+	}
+	return label
+}
+
+// DisplayPriceDetails is DisplayPrice followed by the price per square foot
+// when it is known, e.g. "$650,000 ($394/sqft)".
+func (l Listing) DisplayPriceDetails() string {
+	price := l.DisplayPrice()
+	if price != "" && l.PricePerSqFt > 0 {
+		price += " (" + formatDollars(l.PricePerSqFt) + "/sqft)"
+	}
+	return price
+}
+
+// Rooms summarizes the bedroom and bathroom counts, e.g. "3 + 1 bed / 2
+// bath", leaving out whichever is missing.
+func (l Listing) Rooms() string {
+	var parts []string
+	if l.Bedrooms != "" {
+		parts = append(parts, l.Bedrooms+" bed")
+	}
+	if l.Bathrooms != "" {
+		parts = append(parts, l.Bathrooms+" bath")
+	}
+	return strings.Join(parts, " / ")
+}
+
+// parseRoomCount sums a room count such as "3 + 1".
+func parseRoomCount(raw string) (int, bool) {
+	if raw == "" {
+		return 0, false
+	}
+	total := 0
+	for _, part := range strings.Split(raw, "+") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		total += n
+	}
+	return total, true
+}
+
+const squareFeetPerSquareMetre = 10.7639
+
+// areaUnits maps the unit spellings realtor.ca uses to their size in
+// square feet.
+var areaUnits = map[string]float64{
+	"sqft":  1,
+	"sq ft": 1,
+	"sq.ft": 1,
+	"ft2":   1,
+	"m2":    squareFeetPerSquareMetre,
+	"sqm":   squareFeetPerSquareMetre,
+	"sq m":  squareFeetPerSquareMetre,
+}
+
+const (
+	squareFeetPerAcre    = 43560
+	squareFeetPerHectare = 107639
+)
+
+// lotAreaUnits are the units lots are measured in besides areaUnits.
+var lotAreaUnits = map[string]float64{
+	"ac":       squareFeetPerAcre,
+	"acre":     squareFeetPerAcre,
+	"acres":    squareFeetPerAcre,
+	"ha":       squareFeetPerHectare,
+	"hectare":  squareFeetPerHectare,
+	"hectares": squareFeetPerHectare,
+}
+
+// lotDimensions matches lot sizes given as frontage by depth, such as
+// "50 x 120 FT" or "15.24 x 36.58 M".
+var lotDimensions = regexp.MustCompile(`^([0-9.,]+)\s*(?:ft)?\s*x\s*([0-9.,]+)\s*(ft|m)?\b`)
+
+// parseLotSize converts a lot size to square feet. realtor.ca gives either
+// an area ("0.5 ac", "5400 sqft") or frontage by depth ("50 x 120 FT", in
+// feet unless marked in metres), sometimes followed by a size band after a
+// "|", which is ignored.
+func parseLotSize(raw string) (int, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if i := strings.Index(raw, "|"); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+
+	if m := lotDimensions.FindStringSubmatch(raw); m != nil {
+		frontage, err1 := strconv.ParseFloat(strings.Replace(m[1], ",", "", -1), 64)
+		depth, err2 := strconv.ParseFloat(strings.Replace(m[2], ",", "", -1), 64)
+		if err1 != nil || err2 != nil || frontage <= 0 || depth <= 0 {
+			return 0, false
+		}
+		area := frontage * depth
+		if m[3] == "m" {
+			area *= squareFeetPerSquareMetre
+		}
+		return int(area + 0.5), true
+	}
+	if area, ok := parseAreaIn(raw, lotAreaUnits); ok {
+		return area, true
+	}
+	return parseArea(raw)
+}
+
+// parseArea converts a size such as "1650 sqft" or "150 m2" to square
+// feet. For a range ("1100 - 1500 sqft") the lower bound is used.
+func parseArea(raw string) (int, bool) {
+	return parseAreaIn(raw, areaUnits)
+}
+
+// parseAreaIn is parseArea for the given units, each mapped to its size in
+// square feet.
+func parseAreaIn(raw string, units map[string]float64) (int, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if raw == "" {
+		return 0, false
+	}
+
+	end := strings.IndexFunc(raw, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != ','
+	})
+	if end <= 0 {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.Replace(raw[:end], ",", "", -1), 64)
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+
+	unit := strings.TrimSpace(raw[end:])
+	if i := strings.Index(unit, "-"); i >= 0 {
+		// Drop the upper bound of a range, keeping its unit.
+		fields := strings.Fields(unit[i+1:])
+		if len(fields) < 2 {
+			return 0, false
+		}
+		unit = strings.Join(fields[1:], " ")
+	}
+	factor, ok := units[unit]
+	if !ok {
+		return 0, false
+	}
+	return int(value*factor + 0.5), true
+}
+
+// trackingParams are query parameters that only serve to track clicks.
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+// webURL returns raw if it is an absolute http or https URL, and an empty
+// string otherwise, so that nothing else ends up as a link in an alert.
+func webURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return raw
+}
+
+// cleanPhotoURL drops tracking parameters from a photo URL, leaving it as
+// is when it does not parse.
+func cleanPhotoURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return raw
+	}
+	query := u.Query()
+	for key := range query {
+		if trackingParams[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// normalizeAddress joins the lines of a multi-line AddressText (realtor.ca
+// separates them with "|" or newlines) into a single comma-separated line.
+func normalizeAddress(raw string) string {
+	lines := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == '|'
+	})
+	parts := lines[:0]
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			parts = append(parts, line)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// StatusActive is the status of listings that do not give one.
+const StatusActive = "Active"
+
+// statusNames names the status IDs realtor.ca uses; others are shown as
+// "Status <id>".
+var statusNames = map[string]string{
+	"1": StatusActive,
+	"2": "Conditional",
+	"3": "Pending",
+	"4": "Sold",
+}
+
+// listingStatus returns the status named by the listing, or failing that
+// by its status ID, defaulting to StatusActive.
+func listingStatus(name, id string) string {
+	if name = strings.TrimSpace(name); name != "" {
+		return name
+	}
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return StatusActive
+	}
+	if name, ok := statusNames[id]; ok {
+		return name
+	}
+	return "Status " + id
+}
+
+const (
+	ConstructionNew    = "new"
+	ConstructionResale = "resale"
+)
+
+// The property types listings are normalized to.
+const (
+	PropertyTypeDetached     = "detached"
+	PropertyTypeSemiDetached = "semi-detached"
+	PropertyTypeTownhouse    = "townhouse"
+	PropertyTypeCondo        = "condo"
+	PropertyTypeMultiplex    = "multiplex"
+	PropertyTypeMobile       = "mobile"
+	PropertyTypeLand         = "land"
+	PropertyTypeOther        = "other"
+)
+
+// propertyTypeNames names the property types in alerts.
+var propertyTypeNames = map[string]string{
+	PropertyTypeDetached:     "Detached house",
+	PropertyTypeSemiDetached: "Semi-detached house",
+	PropertyTypeTownhouse:    "Townhouse",
+	PropertyTypeCondo:        "Condo",
+	PropertyTypeMultiplex:    "Multiplex",
+	PropertyTypeMobile:       "Mobile home",
+	PropertyTypeLand:         "Land",
+	PropertyTypeOther:        "Other property",
+}
+
+func validPropertyType(name string) bool {
+	_, ok := propertyTypeNames[name]
+	return ok
+}
+
+// normalizePropertyType maps realtor.ca's building type, e.g. "Row /
+// Townhouse" or "Apartment", to one of the property types. Houses are told
+// apart by their attachment style, and listings without a building, such
+// as vacant land, fall back to the property type.
+func normalizePropertyType(buildingType, attachment, propertyType string) string {
+	building := strings.ToLower(strings.TrimSpace(buildingType))
+	switch {
+	case building == "":
+		property := strings.ToLower(strings.TrimSpace(propertyType))
+		if strings.Contains(property, "land") {
+			return PropertyTypeLand
+		}
+		return ""
+	case building == "house":
+		style := strings.ToLower(attachment)
+		switch {
+		case strings.Contains(style, "semi"):
+			return PropertyTypeSemiDetached
+		case strings.Contains(style, "attached") && !strings.Contains(style, "detached"):
+			return PropertyTypeTownhouse
+		}
+		return PropertyTypeDetached
+	case strings.Contains(building, "townhouse"), strings.HasPrefix(building, "row"):
+		return PropertyTypeTownhouse
+	case strings.Contains(building, "apartment"), strings.Contains(building, "condo"):
+		return PropertyTypeCondo
+	case strings.Contains(building, "duplex"), strings.Contains(building, "triplex"),
+		strings.Contains(building, "fourplex"), strings.Contains(building, "multi"):
+		return PropertyTypeMultiplex
+	case strings.Contains(building, "mobile"), strings.Contains(building, "manufactured"):
+		return PropertyTypeMobile
+	case strings.Contains(building, "semi"):
+		return PropertyTypeSemiDetached
+	}
+	return PropertyTypeOther
+}
+
+// newConstructionPhrases mark a listing as new construction in its
+// description when the year built is not given.
+var newConstructionPhrases = []string{"new construction", "newly built", "brand new build", "pre-construction", "never lived in"}
+
+// constructionStatus tells new construction from resale. realtor.ca has no
+// dedicated field, so a listing counts as new when it was built this year
+// or last, or failing a year, when its description says so.
+func constructionStatus(yearBuilt int, description string) string {
+	if yearBuilt > 0 {
+		if yearBuilt >= time.Now().Year()-1 {
+			return ConstructionNew
+		}
+		return ConstructionResale
+	}
+	description = strings.ToLower(description)
+	for _, phrase := range newConstructionPhrases {
+		if strings.Contains(description, phrase) {
+			return ConstructionNew
+		}
+	}
+	return ""
+}
+
+// dotNetTicksAtUnixEpoch is the Unix epoch in .NET ticks, the 100ns
+// intervals since 0001-01-01 that realtor.ca gives dates in.
+const dotNetTicksAtUnixEpoch = 621355968000000000
+
+func parseDotNetTicks(raw string) (time.Time, bool) {
+	ticks, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if err != nil || ticks <= dotNetTicksAtUnixEpoch {
+		return time.Time{}, false
+	}
+	return time.Unix(0, (ticks-dotNetTicksAtUnixEpoch)*100), true
+}
+
+// openHouseTimeLayouts are the formats realtor.ca has been seen to use
+// for open house times, e.g. "03/07/2020 02:00:00 PM".
+var openHouseTimeLayouts = []string{"1/2/2006 3:04:05 PM", "2006-01-02T15:04:05"}
+
+// parseOpenHouseTime parses an open house time, which carries no zone and
+// is read in openHouseLocation.
+func parseOpenHouseTime(raw string) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range openHouseTimeLayouts {
+		if t, err := time.ParseInLocation(layout, raw, openHouseLocation); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parsePrice turns a CAD price such as "$650,000", or a rent such as
+// "$2,500/Monthly", into whole dollars. Anything else, including ranges
+// and other currencies, is rejected.
+func parsePrice(raw string) (int, bool) {
+	if !strings.HasPrefix(raw, "$") {
+		return 0, false
+	}
+	digits := strings.TrimSuffix(raw[1:], "/Monthly")
+	digits = strings.Replace(digits, ",", "", -1)
+	amount, err := strconv.Atoi(digits)
+	if err != nil || amount <= 0 {
+		return 0, false
+	}
+	return amount, true
+}
+
+// condoFeePeriods are the fee frequencies realtor.ca uses, each with the
+// number of payments a year. A fee that names none is taken to be monthly.
+var condoFeePeriods = []struct {
+	word     string
+	payments float64
+}{
+	{"bi-weekly", 26},
+	{"biweekly", 26},
+	{"week", 52},
+	{"quarter", 4},
+	{"semi-annual", 2},
+	{"annual", 1},
+	{"year", 1},
+	{"month", 12},
+}
+
+// parseCondoFee returns a fee such as "$450.00 Monthly" or "$5,400
+// Yearly" per month, in whole dollars.
+func parseCondoFee(raw string) (int, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	amount := strings.TrimPrefix(raw, "$")
+	end := strings.IndexFunc(amount, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != ','
+	})
+	if end < 0 {
+		end = len(amount)
+	}
+	value, err := strconv.ParseFloat(strings.Replace(amount[:end], ",", "", -1), 64)
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+
+	return int(math.Round(value * condoFeePayments(amount[end:]) / 12)), true
+}
+
+// condoFeePayments returns how many times a year a fee is paid, going by
+// the frequency it names.
+func condoFeePayments(raw string) float64 {
+	raw = strings.ToLower(raw)
+	for _, period := range condoFeePeriods {
+		if strings.Contains(raw, period.word) {
+			return period.payments
+		}
+	}
+	return 12
+}
+
+// CondoFeeText describes the fee, e.g. "Condo fee: $450/month ($5,400
+// Yearly)", or is empty when there is none.
+func (l Listing) CondoFeeText() string {
+	if l.CondoFee == 0 {
+		if l.CondoFeeRaw == "" {
+			return ""
+		}
+		return "Condo fee: " + l.CondoFeeRaw
+	}
+	text := "Condo fee: " + formatDollars(l.CondoFee) + "/month"
+	if condoFeePayments(l.CondoFeeRaw) != 12 {
+		text += " (" + l.CondoFeeRaw + ")"
+	}
+	return text
+}
+
+func formatDollars(amount int) string {
+	digits := strconv.Itoa(amount)
+	var out strings.Builder
+	out.WriteString("$")
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			out.WriteByte(',')
+		}
+		out.WriteRune(d)
+	}
+	return out.String()
+}
+
+// Paging describes where a page of results sits in the whole search.
+type Paging struct {
+	RecordsPerPage int
+	CurrentPage    int
+	// TotalRecords is the number of listings matching the search, and
+	// MaxRecords the most realtor.ca will return for it.
+	TotalRecords int
+	MaxRecords   int
+	TotalPages   int
+}
+
+type Listings struct {
+	Results []Listing
+	Paging  Paging
+	// StoppedEarly is set when the fetch gave up on the remaining pages to
+	// stay within the runtime budget.
+	StoppedEarly bool `json:"-"`
+	// Boxes is how many bounding boxes FetchSplit fetched the search as.
+	Boxes int `json:"-"`
+}
+
+// parseCoordinates parses a listing's latitude and longitude, returning
+// zeros unless both are valid.
+func parseCoordinates(rawLat, rawLng string) (float64, float64) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(rawLat), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(rawLng), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return 0, 0
+	}
+	return lat, lng
+}
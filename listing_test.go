@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// parseListing unmarshals a search result as FetchListings does.
+func parseListing(t *testing.T, raw string) Listing {
+	t.Helper()
+	var listing Listing
+	if err := json.Unmarshal([]byte(raw), &listing); err != nil {
+		t.Fatal(err)
+	}
+	return listing
+}
+
+func TestTourURL(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "video link",
+			raw:  `{"Id":"1","AlternateURL":{"VideoLink":"https://my.matterport.com/show/?m=abc123"}}`,
+			want: "https://my.matterport.com/show/?m=abc123",
+		},
+		{
+			name: "plain http",
+			raw:  `{"Id":"1","AlternateURL":{"VideoLink":" http://tours.example.com/12-main "}}`,
+			want: "http://tours.example.com/12-main",
+		},
+		{name: "no alternate URL", raw: `{"Id":"1"}`},
+		{name: "empty link", raw: `{"Id":"1","AlternateURL":{"VideoLink":""}}`},
+		{name: "javascript scheme", raw: `{"Id":"1","AlternateURL":{"VideoLink":"javascript:alert(1)"}}`},
+		{name: "ftp scheme", raw: `{"Id":"1","AlternateURL":{"VideoLink":"ftp://tours.example.com/12-main"}}`},
+		{name: "relative", raw: `{"Id":"1","AlternateURL":{"VideoLink":"/tour/12-main"}}`},
+		{name: "no host", raw: `{"Id":"1","AlternateURL":{"VideoLink":"https:///tour"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listing := parseListing(t, tt.raw)
+			if listing.TourURL != tt.want {
+				t.Errorf("TourURL = %q, want %q", listing.TourURL, tt.want)
+			}
+			if shown := strings.Contains(listingMessage(listing), "Virtual tour"); shown != (tt.want != "") {
+				t.Errorf("virtual tour in the alert = %v, want %v", shown, tt.want != "")
+			}
+		})
+	}
+}
+
+func TestParseCondoFee(t *testing.T) {
+	tests := []struct {
+		raw    string
+		want   int
+		wantOK bool
+	}{
+		{raw: "$450.00 Monthly", want: 450, wantOK: true},
+		{raw: "$1,250 Monthly", want: 1250, wantOK: true},
+		{raw: "$450", want: 450, wantOK: true},
+		{raw: "$5,400 Yearly", want: 450, wantOK: true},
+		{raw: "$1,350 Quarterly", want: 450, wantOK: true},
+		{raw: "$200 Bi-Weekly", want: 433, wantOK: true},
+		{raw: "  $389.50 monthly ", want: 390, wantOK: true},
+		{raw: ""},
+		{raw: "Monthly"},
+		{raw: "$0.00 Monthly"},
+		{raw: "$ Monthly"},
+		{raw: "$1.2.3 Monthly"},
+		{raw: "included"},
+	}
+	for _, tt := range tests {
+		got, ok := parseCondoFee(tt.raw)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseCondoFee(%q) = %d, %v, want %d, %v", tt.raw, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNormalizePropertyType(t *testing.T) {
+	tests := []struct {
+		building, attachment, property string
+		want                           string
+	}{
+		{"House", "Detached", "Single Family", PropertyTypeDetached},
+		{"House", "", "Single Family", PropertyTypeDetached},
+		{"House", "Semi-detached", "Single Family", PropertyTypeSemiDetached},
+		{"House", "Attached", "Single Family", PropertyTypeTownhouse},
+		{"Row / Townhouse", "Attached", "Single Family", PropertyTypeTownhouse},
+		{"Apartment", "", "Single Family", PropertyTypeCondo},
+		{" apartment ", "", "", PropertyTypeCondo},
+		{"Duplex", "", "Multi-family", PropertyTypeMultiplex},
+		{"Triplex", "", "Multi-family", PropertyTypeMultiplex},
+		{"Mobile Home", "", "Single Family", PropertyTypeMobile},
+		{"Manufactured Home/Mobile", "", "Single Family", PropertyTypeMobile},
+		{"", "", "Vacant Land", PropertyTypeLand},
+		{"", "", "Single Family", ""},
+		{"Parking", "", "Parking", PropertyTypeOther},
+	}
+	for _, tt := range tests {
+		if got := normalizePropertyType(tt.building, tt.attachment, tt.property); got != tt.want {
+			t.Errorf("normalizePropertyType(%q, %q, %q) = %q, want %q", tt.building, tt.attachment, tt.property, got, tt.want)
+		}
+	}
+}
+
+func TestMapURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing Listing
+		want    string
+	}{
+		{
+			name:    "coordinates",
+			listing: Listing{Address: "12 Main St, Toronto", Latitude: 43.6532, Longitude: -79.3832},
+			want:    mapsSearchURL + "&query=43.6532%2C-79.3832",
+		},
+		{
+			name:    "address",
+			listing: Listing{Address: "12 Main St, Toronto, Ontario M5V 1A1"},
+			want:    mapsSearchURL + "&query=12+Main+St%2C+Toronto%2C+Ontario+M5V+1A1",
+		},
+		{
+			name:    "address with an ampersand",
+			listing: Listing{Address: "Lot 3 King & Queen St"},
+			want:    mapsSearchURL + "&query=Lot+3+King+%26+Queen+St",
+		},
+		{name: "address not available", listing: Listing{Address: "Address not available"}},
+		{name: "nothing to go on", listing: Listing{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.listing.MapURL(); got != tt.want {
+				t.Errorf("MapURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		cleanURLs bool
+		want      string
+	}{
+		{name: "plain", path: "/real-estate/21933083/12-main-st-toronto", want: "https://realtor.ca/real-estate/21933083/12-main-st-toronto"},
+		{name: "no leading slash", path: "real-estate/21933083/12-main-st", want: "https://realtor.ca/real-estate/21933083/12-main-st"},
+		{name: "double slashes", path: "//real-estate//21933083/12-main-st", want: "https://realtor.ca/real-estate/21933083/12-main-st"},
+		{name: "whitespace", path: " /real-estate/21933083/12-main-st\n", want: "https://realtor.ca/real-estate/21933083/12-main-st"},
+		{name: "space in slug", path: "/real-estate/21933083/12 main st", want: "https://realtor.ca/real-estate/21933083/12%20main%20st"},
+		{name: "already escaped", path: "/real-estate/21933083/12%20main%20st", want: "https://realtor.ca/real-estate/21933083/12%20main%20st"},
+		{name: "accented", path: "/real-estate/21933083/12-rue-sainte-th%C3%A9r%C3%A8se", want: "https://realtor.ca/real-estate/21933083/12-rue-sainte-th%C3%A9r%C3%A8se"},
+		{name: "query kept", path: "/real-estate/21933083/12-main-st?view=photos", want: "https://realtor.ca/real-estate/21933083/12-main-st?view=photos"},
+		{name: "fragment dropped", path: "/real-estate/21933083/12-main-st#photos", want: "https://realtor.ca/real-estate/21933083/12-main-st"},
+		{name: "clean URLs", path: "/real-estate/21933083/12-main-st?utm_source=x#top", cleanURLs: true, want: "https://realtor.ca/real-estate/21933083/12-main-st"},
+	}
+	defer func(v bool) { cleanURLs = v }(cleanURLs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleanURLs = tt.cleanURLs
+			if got := (Listing{RelativeDetailsURL: tt.path}).URL(); got != tt.want {
+				t.Errorf("URL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShortPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/real-estate/21933083/12-main-st-toronto", want: "/real-estate/21933083"},
+		{path: "/real-estate/21933083/12-main-st?view=photos#top", want: "/real-estate/21933083"},
+		{path: "real-estate//21933083/12 main st", want: "/real-estate/21933083"},
+		{path: "/real-estate/21933083", want: "/real-estate/21933083"},
+		{path: "/immobilier/21933083/12-rue-main", want: "/immobilier/21933083/12-rue-main"},
+		{path: "/some path", want: "/some%20path"},
+		{path: "", want: "/"},
+	}
+	for _, tt := range tests {
+		listing := Listing{RelativeDetailsURL: tt.path}
+		if got := listing.ShortPath(); got != tt.want {
+			t.Errorf("ShortPath() of %q = %q, want %q", tt.path, got, tt.want)
+		}
+		if got := listing.ShortURL(); got != baseURL+tt.want {
+			t.Errorf("ShortURL() of %q = %q, want %q", tt.path, got, baseURL+tt.want)
+		}
+	}
+}
+
+func TestParseLotSize(t *testing.T) {
+	tests := []struct {
+		raw    string
+		want   int
+		wantOK bool
+	}{
+		{raw: "0.5 ac", want: 21780, wantOK: true},
+		{raw: "1 acre", want: 43560, wantOK: true},
+		{raw: "2.5 Acres", want: 108900, wantOK: true},
+		{raw: "0.25 - 0.5 acre", want: 10890, wantOK: true},
+		{raw: "1.2 ac|1 - 1.99 acres", want: 52272, wantOK: true},
+		{raw: "1 ha", want: 107639, wantOK: true},
+		{raw: "5400 sqft", want: 5400, wantOK: true},
+		{raw: "1,200 sq ft", want: 1200, wantOK: true},
+		{raw: "500 m2", want: 5382, wantOK: true},
+		{raw: "50 x 120 FT", want: 6000, wantOK: true},
+		{raw: "50 ft x 120 ft", want: 6000, wantOK: true},
+		{raw: "33.5 x 110", want: 3685, wantOK: true},
+		{raw: "50 x 120 FT|under 1/2 acre", want: 6000, wantOK: true},
+		{raw: "15.24 x 36.58 M", want: 6001, wantOK: true},
+		{raw: "0 x 120 FT"},
+		{raw: "under 1/2 acre"},
+		{raw: "Irregular"},
+		{raw: "120 furlongs"},
+		{raw: ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseLotSize(tt.raw)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseLotSize(%q) = %d, %v, want %d, %v", tt.raw, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFrontageOnlyLot(t *testing.T) {
+	listing := parseListing(t, `{"Id":"1","Land":{"SizeFrontage":" 50 ft "}}`)
+	if listing.LotFrontage != "50 ft" || listing.LotSize != "" || listing.LotSquareFeet != 0 {
+		t.Errorf("lot = %q, frontage %q, %d sqft, want only the 50 ft frontage", listing.LotSize, listing.LotFrontage, listing.LotSquareFeet)
+	}
+	if text := listing.LotText(); text != "Lot: 50 ft frontage" {
+		t.Errorf("LotText() = %q, want Lot: 50 ft frontage", text)
+	}
+	if reason := lotFilter(5000, false)(listing); reason != "lot size is unknown" {
+		t.Errorf("strict lot filter gave %q, want the lot size is unknown", reason)
+	}
+	if reason := lotFilter(5000, true)(listing); reason != "" {
+		t.Errorf("lenient lot filter rejected the listing: %q", reason)
+	}
+
+	acre := parseListing(t, `{"Id":"2","Land":{"SizeTotal":"0.5 ac","SizeFrontage":"100 ft"}}`)
+	if acre.LotSquareFeet != 21780 {
+		t.Errorf("LotSquareFeet = %d, want 21780", acre.LotSquareFeet)
+	}
+	if text := acre.LotText(); text != "Lot: 0.5 ac (21,780 sqft)" {
+		t.Errorf("LotText() = %q, want Lot: 0.5 ac (21,780 sqft)", text)
+	}
+}
+
+func TestParseRoomCount(t *testing.T) {
+	tests := []struct {
+		raw    string
+		want   int
+		wantOK bool
+	}{
+		{raw: "3", want: 3, wantOK: true},
+		{raw: "3 + 1", want: 4, wantOK: true},
+		{raw: "2+1+1", want: 4, wantOK: true},
+		{raw: "0", want: 0, wantOK: true},
+		{raw: ""},
+		{raw: "3 +"},
+		{raw: "three"},
+		{raw: "-1"},
+		{raw: "2.5"},
+	}
+	for _, tt := range tests {
+		got, ok := parseRoomCount(tt.raw)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRoomCount(%q) = %d, %v, want %d, %v", tt.raw, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	listing := parseListing(t, `{"Id":"1","Building":{"Bedrooms":" 3 + 1 ","BathroomTotal":"2"}}`)
+	if listing.Bedrooms != "3 + 1" || listing.BedroomsTotal != 4 || listing.Bathrooms != "2" || listing.BathroomsTotal != 2 {
+		t.Errorf("rooms = %q (%d) bed, %q (%d) bath, want 3 + 1 (4) bed, 2 (2) bath",
+			listing.Bedrooms, listing.BedroomsTotal, listing.Bathrooms, listing.BathroomsTotal)
+	}
+	if rooms := listing.Rooms(); rooms != "3 + 1 bed / 2 bath" {
+		t.Errorf("Rooms() = %q, want 3 + 1 bed / 2 bath", rooms)
+	}
+	if missing := parseListing(t, `{"Id":"1"}`); missing.BedroomsTotal != 0 || missing.Rooms() != "" {
+		t.Errorf("rooms of a listing without any = %d, %q", missing.BedroomsTotal, missing.Rooms())
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "12 Main St\nToronto, Ontario M5V1A1", want: "12 Main St, Toronto, Ontario M5V1A1"},
+		{raw: "12 Main St|Toronto, Ontario M5V1A1", want: "12 Main St, Toronto, Ontario M5V1A1"},
+		{raw: "#1203 -88 Bloor St E\r\nToronto (Church-Yonge Corridor), Ontario M4W3G9", want: "#1203 -88 Bloor St E, Toronto (Church-Yonge Corridor), Ontario M4W3G9"},
+		{raw: "  12 Main St \n\n Toronto  |", want: "12 Main St, Toronto"},
+		{raw: "Address not available|Kitchener, Ontario", want: "Address not available, Kitchener, Ontario"},
+		{raw: "Kitchener", want: "Kitchener"},
+		{raw: " \n | ", want: ""},
+		{raw: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeAddress(tt.raw); got != tt.want {
+			t.Errorf("normalizeAddress(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	listing := parseListing(t, `{"Id":"1","Property":{"Address":{"AddressText":"12 Main St\nToronto, Ontario M5V1A1"}}}`)
+	if listing.Address != "12 Main St, Toronto, Ontario M5V1A1" {
+		t.Errorf("Address = %q, want one comma-separated line", listing.Address)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		wantAgent     string
+		wantPhone     string
+		wantBrokerage string
+		wantText      string
+	}{
+		{
+			name: "agent and brokerage",
+			raw: `{"Id":"1","Individual":[
+				{"Name":" Jane Doe ","Organization":{"Name":"Example Realty Inc."},"Phones":[{"AreaCode":"","PhoneNumber":""},{"AreaCode":"519","PhoneNumber":"555-0100"}]},
+				{"Name":"John Roe","Organization":{"Name":"Other Realty"},"Phones":[{"AreaCode":"416","PhoneNumber":"555-0199"}]}
+			]}`,
+			wantAgent:     "Jane Doe",
+			wantPhone:     "519-555-0100",
+			wantBrokerage: "Example Realty Inc.",
+			wantText:      "Listed by Jane Doe (519-555-0100), Example Realty Inc.",
+		},
+		{
+			name:          "brokerage only",
+			raw:           `{"Id":"1","Individual":[{"Name":"","Organization":{"Name":"Example Realty Inc."}}]}`,
+			wantBrokerage: "Example Realty Inc.",
+			wantText:      "Listed by Example Realty Inc.",
+		},
+		{name: "private sale", raw: `{"Id":"1","RelativeDetailsURL":"/real-estate/1/12-main-st"}`},
+		{name: "private sale with an empty list", raw: `{"Id":"1","Individual":[]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listing := parseListing(t, tt.raw)
+			if listing.AgentName != tt.wantAgent || listing.AgentPhone != tt.wantPhone || listing.Brokerage != tt.wantBrokerage {
+				t.Errorf("agent %q, phone %q, brokerage %q, want %q, %q, %q",
+					listing.AgentName, listing.AgentPhone, listing.Brokerage, tt.wantAgent, tt.wantPhone, tt.wantBrokerage)
+			}
+			if text := listing.AgentText(); text != tt.wantText {
+				t.Errorf("AgentText() = %q, want %q", text, tt.wantText)
+			}
+			message := listingMessage(listing)
+			if shown := strings.Contains(message, "Listed by"); shown != (tt.wantText != "") {
+				t.Errorf("agent line in the alert = %v, want %v:\n%s", shown, tt.wantText != "", message)
+			}
+			if strings.Contains(message, "\n\n") || strings.HasPrefix(message, "\n") {
+				t.Errorf("alert has an empty line:\n%q", message)
+			}
+		})
+	}
+}
+
+func TestTransactionLabel(t *testing.T) {
+	tests := []struct {
+		listing Listing
+		want    string
+	}{
+		{listing: Listing{Status: StatusActive}, want: "For sale (Active)"},
+		{listing: Listing{}, want: "For sale"},
+		{listing: Listing{ForRent: true, Status: "Pending"}, want: "For rent (Pending)"},
+		{listing: Listing{PropertyType: PropertyTypeTownhouse, Construction: ConstructionNew}, want: "Townhouse for sale, new construction"},
+	}
+	for _, tt := range tests {
+		if got := tt.listing.TransactionLabel(); got != tt.want {
+			t.Errorf("TransactionLabel() of %+v = %q, want %q", tt.listing, got, tt.want)
+		}
+	}
+}
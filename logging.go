@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Log lines are JSON objects so CloudWatch Logs Insights can query their
+// fields. Besides the message they carry, where relevant:
+//
+//	request_id   the Lambda request ID, added from the context
+//	search_name  the saved search being run
+//	listing_id   the listing concerned
+//	action       fetched, notified, queued, seen, skipped, ignored,
+//	             deduplicated, reconciled, price_dropped, price_increased,
+//	             changed, removed or heartbeat
+//	count        how many listings an action covered
+func init() {
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stdout, nil)}))
+}
+
+// requestIDHandler adds the Lambda request ID to records logged with a
+// context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		r.AddAttrs(slog.String("request_id", lc.AwsRequestID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
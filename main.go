@@ -1,71 +1,387 @@
 package main
 
 import (
-	"bytes"
-	"compress/zlib"
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sns"
-	"io/ioutil"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"golang.org/x/sync/errgroup"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
 )
 
 const (
 	apiURL  = "https://api2.realtor.ca/Listing.svc/PropertySearch_Post"
 	baseURL = "https://realtor.ca"
+	// mapsSearchURL is Google Maps' cross-platform search link, which
+	// opens the app on phones that have it.
+	mapsSearchURL = "https://www.google.com/maps/search/?api=1"
 
 	dynamoPartitionKeyName  = "partition_key"
+	dynamoSortKeyName       = "listing_id"
 	dynamoPartitionKeyValue = "seen-listings"
+	// dynamoMetaSortKey is the sort key of the item holding a partition's
+	// version; it cannot clash with realtor.ca's numeric listing IDs.
+	dynamoMetaSortKey = "#meta"
+
+	defaultMaxPages           = 10
+	defaultReconcileMaxPerRun = 10
+	defaultRemovedAfterRuns   = 3
+	defaultSeenTTLDays        = 90
+	defaultHTTPMaxRetries     = 3
+	defaultHTTPTimeout        = 10 * time.Second
+	retryBaseDelay            = 200 * time.Millisecond
+
+	defaultFetchDropThreshold = 80
+	// fetchGuardMinCount is the smallest previous fetch the drop guard
+	// applies to; small searches swing too much to judge.
+	fetchGuardMinCount = 10
+
+	// defaultOpenHouseTimezone is where open house times are read, as
+	// realtor.ca gives them in local time without a zone.
+	defaultOpenHouseTimezone = "America/Toronto"
+
+	defaultSearchConcurrency = 2
+	defaultNotifyConcurrency = 4
+
+	defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.116 Safari/537.36"
 )
 
 var (
-	payload         url.Values
 	awsRegion       string
 	awsAccountId    string
 	dynamoTableName string
 	snsTopicName    string
+	maxPages        int
+	httpMaxRetries  int
+	userAgent       string
+	httpTimeout     time.Duration
+
+	// dynamoEndpoint and snsEndpoint point the clients somewhere other
+	// than AWS, such as DynamoDB Local or LocalStack, when set.
+	dynamoEndpoint string
+	snsEndpoint    string
+
+	// maxResults keeps only the first this many fetched listings of each
+	// search, in its sort order, when non-zero. Unlike RecordsPerPage,
+	// which only sizes the API's pages, it bounds what is alerted on.
+	maxResults int
+
+	// minRequestInterval is the least time between two realtor.ca API
+	// calls, retries included. 0 disables the limit.
+	minRequestInterval time.Duration
+
+	// A price drop is alerted on when it reaches priceDropMinAmount
+	// dollars or priceDropMinBasisPoints hundredths of a percent of the
+	// previous price, whichever of the two are set; with
+	// priceDropRequireBoth it has to reach both.
+	priceDropMinAmount      int
+	priceDropMinBasisPoints int
+	priceDropRequireBoth    bool
+
+	// priceIncreaseAlerts alerts on seen listings raising their price, a
+	// sign of demand for sellers pricing against them. The thresholds work
+	// as the price drop ones do.
+	priceIncreaseAlerts         bool
+	priceIncreaseMinAmount      int
+	priceIncreaseMinBasisPoints int
+	priceIncreaseRequireBoth    bool
+
+	// reconcileNotified alerts on seen listings that are not recorded as
+	// notified, up to reconcileMaxPerRun per search and run, to recover
+	// from alerts lost to a bug or a hand-edited cache. It is a recovery
+	// tool: items written before the flag was recorded count as never
+	// notified, so expect those to be alerted on again too.
+	reconcileNotified  bool
+	reconcileMaxPerRun int
+
+	// removedAfterRuns is how many consecutive runs a seen listing has to
+	// be missing from the results before it is reported as removed.
+	removedAfterRuns int
+
+	// seenTTL is how long a seen listing is kept after it was last seen;
+	// zero keeps it forever.
+	seenTTL time.Duration
+
+	// dynamoLegacyTableName optionally names the table holding the old
+	// single-item cache to migrate from.
+	dynamoLegacyTableName string
+
+	// searchesJSON and searchesS3URI optionally replace the built-in
+	// payload with a list of saved searches.
+	searchesJSON  string
+	searchesS3URI string
+	// searchPlace names the area to search instead of the coordinates.
+	searchPlace string
+
+	// dryRun fetches and compares listings as usual but only logs the
+	// alerts it would send, leaving the seen-listings cache untouched.
+	dryRun bool
+
+	// digestMode collects the new listings of a run into a single alert
+	// instead of sending one per listing.
+	digestMode bool
+
+	// fetchDropThreshold is the percentage by which a fetch may shrink
+	// against the previous run's before it is treated as a site glitch and
+	// removed-listing detection is skipped. 0 disables the guard.
+	fetchDropThreshold int
+
+	// maxNotificationsPerRun caps the new-listing alerts a search sends
+	// in one run; past it they are sent as a single digest. 0 means no
+	// cap.
+	maxNotificationsPerRun int
+
+	// heartbeatInterval is how long a search may go without an alert
+	// before a heartbeat is sent. 0 disables heartbeats.
+	heartbeatInterval time.Duration
+
+	// searchConcurrency bounds how many searches run at once, and
+	// notifyConcurrency how many alerts a search sends at once.
+	searchConcurrency int
+	notifyConcurrency int
+
+	// enableXRay traces AWS calls and the realtor.ca requests with X-Ray.
+	enableXRay bool
+
+	// metricsNamespace is the CloudWatch namespace metrics are reported in.
+	metricsNamespace string
+
+	// notifierBackend and notifierBackendList select where alerts are
+	// sent, see NewNotifier.
+	notifierBackend     string
+	notifierBackendList []string
+
+	// snsFormat is the message format of the SNS backend: "default", or
+	// "sms" for topics delivering to phones.
+	snsFormat string
+
+	// openHouseLocation is the time zone open house times are read in.
+	openHouseLocation *time.Location
+
+	// cleanURLs drops the query from listing URLs in alerts.
+	cleanURLs bool
+
+	// printAlerts writes alerts to stdout in place of the configured
+	// notifier. It is set when running locally, where it implies dryRun
+	// unless -dry-run=false is given.
+	printAlerts bool
+
+	// markFilteredSeen marks listings rejected by a filter as seen, so they
+	// are not considered again should they start passing it.
+	markFilteredSeen bool
 )
 
 func init() {
-	payload = url.Values{
-		"ZoomLevel":            {"13"},
-		"LatitudeMax":          {"43.51949"},
-		"LongitudeMax":         {"-80.43042"},
-		"LatitudeMin":          {"43.42644"},
-		"LongitudeMin":         {"-80.66406"},
-		"Sort":                 {"6-D"},
-		"PropertyTypeGroupID":  {"1"},
-		"PropertySearchTypeId": {"1"},
-		"TransactionTypeId":    {"2"},
-		"PriceMin":             {"539000"},
-		"PriceMax":             {"701000"},
-		"BedRange":             {"3-0"},
-		"BathRange":            {"2-0"},
-		"BuildingTypeId":       {"1"},
-		"ConstructionStyleId":  {"3"},
-		"Currency":             {"CAD"},
-		"RecordsPerPage":       {"20"},
-		"ApplicationId":        {"1"},
-		"CultureId":            {"1"},
-		"Version":              {"7.0"},
-		"CurrentPage":          {""},
-	}
-
 	awsRegion = requiredEnvVar("AWS_REGION")
 	awsAccountId = requiredEnvVar("AWS_ACCOUNT_ID")
 	dynamoTableName = requiredEnvVar("DYNAMO_TABLE_NAME")
-	snsTopicName = requiredEnvVar("SNS_TOPIC_NAME")
+	dynamoAutocreate = boolEnvVar("DYNAMO_AUTOCREATE")
+	dynamoLegacyTableName = os.Getenv("DYNAMO_LEGACY_TABLE_NAME")
+	snsTopicName = os.Getenv("SNS_TOPIC_NAME")
+	dynamoEndpoint = os.Getenv("DYNAMO_ENDPOINT")
+	snsEndpoint = os.Getenv("SNS_ENDPOINT")
+	maxPages = intEnvVar("MAX_PAGES", defaultMaxPages)
+	splitMaxDepth = intEnvVar("SPLIT_MAX_DEPTH", 0)
+	if splitMaxDepth < 0 {
+		panic("Invalid depth in environment variable SPLIT_MAX_DEPTH: " + os.Getenv("SPLIT_MAX_DEPTH"))
+	}
+	runtimeBudgetPct = intEnvVar("RUNTIME_BUDGET_PCT", 0)
+	if runtimeBudgetPct < 0 || runtimeBudgetPct > 100 {
+		panic("Invalid percentage in environment variable RUNTIME_BUDGET_PCT: " + os.Getenv("RUNTIME_BUDGET_PCT"))
+	}
+	maxResults = intEnvVar("MAX_RESULTS", 0)
+	if maxResults < 0 {
+		panic("Invalid count in environment variable MAX_RESULTS: " + os.Getenv("MAX_RESULTS"))
+	}
+	httpMaxRetries = intEnvVar("HTTP_MAX_RETRIES", defaultHTTPMaxRetries)
+	userAgent = envVar("USER_AGENT", defaultUserAgent)
+	removedAfterRuns = intEnvVar("REMOVED_AFTER_RUNS", defaultRemovedAfterRuns)
+	reconcileNotified = boolEnvVar("RECONCILE_NOTIFIED")
+	reconcileMaxPerRun = intEnvVar("RECONCILE_MAX_PER_RUN", defaultReconcileMaxPerRun)
+	if reconcileMaxPerRun < 1 {
+		panic("Invalid count in environment variable RECONCILE_MAX_PER_RUN: " + os.Getenv("RECONCILE_MAX_PER_RUN"))
+	}
+	seenTTL = time.Duration(intEnvVar("SEEN_TTL_DAYS", defaultSeenTTLDays)) * 24 * time.Hour
+	flushTimeout = time.Duration(intEnvVar("FLUSH_TIMEOUT_SECONDS", int(defaultFlushTimeout/time.Second))) * time.Second
+	priceDropMinAmount, priceDropMinBasisPoints = parsePriceDropThreshold(envVar("PRICE_DROP_THRESHOLD", "0"))
+	if v := os.Getenv("PRICE_DROP_MIN_ABS"); v != "" {
+		priceDropMinAmount = parsePriceDropAmount("PRICE_DROP_MIN_ABS", v)
+	}
+	if v := os.Getenv("PRICE_DROP_MIN_PCT"); v != "" {
+		priceDropMinBasisPoints = parsePriceDropPercent("PRICE_DROP_MIN_PCT", strings.TrimSuffix(v, "%"))
+	}
+	priceDropRequireBoth = boolEnvVar("PRICE_DROP_REQUIRE_BOTH")
+	priceIncreaseAlerts = boolEnvVar("PRICE_INCREASE_ALERTS")
+	priceIncreaseMinAmount = parsePriceDropAmount("PRICE_INCREASE_MIN_ABS", envVar("PRICE_INCREASE_MIN_ABS", "0"))
+	priceIncreaseMinBasisPoints = parsePriceDropPercent("PRICE_INCREASE_MIN_PCT", strings.TrimSuffix(envVar("PRICE_INCREASE_MIN_PCT", "0"), "%"))
+	priceIncreaseRequireBoth = boolEnvVar("PRICE_INCREASE_REQUIRE_BOTH")
+	httpTimeout = time.Duration(intEnvVar("HTTP_TIMEOUT_SECONDS", int(defaultHTTPTimeout/time.Second))) * time.Second
+	minRequestInterval = time.Duration(intEnvVar("MIN_REQUEST_INTERVAL_MS", 0)) * time.Millisecond
+	searchesJSON = os.Getenv("SEARCHES")
+	searchesS3URI = os.Getenv("SEARCHES_S3_URI")
+	searchPlace = os.Getenv("SEARCH_PLACE")
+	dryRun = boolEnvVar("DRY_RUN")
+	digestMode = boolEnvVar("DIGEST_MODE")
+	fetchDropThreshold = intEnvVar("FETCH_DROP_THRESHOLD", defaultFetchDropThreshold)
+	searchCurrency = strings.ToUpper(envVar("CURRENCY", defaultCurrency))
+	if !validCurrency(searchCurrency) {
+		panic("Invalid currency code in environment variable CURRENCY: " + searchCurrency)
+	}
+	displayCurrency = strings.ToUpper(os.Getenv("DISPLAY_CURRENCY"))
+	if displayCurrency != "" {
+		if !validCurrency(displayCurrency) {
+			panic("Invalid currency code in environment variable DISPLAY_CURRENCY: " + displayCurrency)
+		}
+		if v := os.Getenv("CURRENCY_RATE"); v != "" {
+			rate, err := parseCurrencyRate(v)
+			if err != nil {
+				panic("Invalid environment variable CURRENCY_RATE: " + err.Error())
+			}
+			currencyRate = rate
+		}
+		currencyRatesURL = os.Getenv("CURRENCY_RATES_URL")
+		if currencyRate == 0 && currencyRatesURL == "" {
+			panic("DISPLAY_CURRENCY needs CURRENCY_RATE or CURRENCY_RATES_URL")
+		}
+	}
+	maxCommuteMinutes = intEnvVar("MAX_COMMUTE_MINUTES", 0)
+	if maxCommuteMinutes > 0 {
+		commuteDestination = requiredEnvVar("COMMUTE_DESTINATION")
+		googleMapsAPIKey = requiredEnvVar("GOOGLE_MAPS_API_KEY")
+	}
+	commuteMode = envVar("COMMUTE_MODE", defaultCommuteMode)
+	if !validCommuteMode(commuteMode) {
+		panic("Unknown mode in environment variable COMMUTE_MODE: " + commuteMode)
+	}
+	commuteUnknownPasses = boolEnvVarDefault("COMMUTE_UNKNOWN_PASSES", true)
+	comparablesEnabled = boolEnvVar("COMPARABLES_ENABLED")
+	comparablesDays = intEnvVar("COMPARABLES_DAYS", defaultComparablesDays)
+	comparablesInterval = time.Duration(intEnvVar("COMPARABLES_INTERVAL_DAYS", int(defaultComparablesInterval/(24*time.Hour)))) * 24 * time.Hour
+	maxNotificationsPerRun = intEnvVar("MAX_NOTIFICATIONS_PER_RUN", 0)
+	heartbeatInterval = time.Duration(intEnvVar("HEARTBEAT_HOURS", 0)) * time.Hour
+	searchConcurrency = intEnvVar("SEARCH_CONCURRENCY", defaultSearchConcurrency)
+	notifyConcurrency = intEnvVar("NOTIFY_CONCURRENCY", defaultNotifyConcurrency)
+	enableXRay = boolEnvVar("ENABLE_XRAY")
+	metricsNamespace = envVar("METRICS_NAMESPACE", "Realtorca")
+	notifierBackend = envVar("NOTIFIER", "sns")
+	if !validNotifierBackend(notifierBackend) {
+		panic("Unknown notifier in environment variable NOTIFIER: " + notifierBackend)
+	}
+	loadTemplates()
+	operatorTopicName = os.Getenv("OPERATOR_SNS_TOPIC_NAME")
+	usageReport = boolEnvVar("USAGE_REPORT")
+	exportBucket = os.Getenv("EXPORT_S3_BUCKET")
+	exportPrefix = envVar("EXPORT_S3_PREFIX", defaultExportPrefix)
+	exportHistory = boolEnvVar("EXPORT_S3_HISTORY")
+	exportCSVKey = os.Getenv("EXPORT_CSV_KEY")
+	photosBucket = os.Getenv("CACHE_PHOTOS_S3")
+	photosPrefix = envVar("CACHE_PHOTOS_S3_PREFIX", defaultPhotosPrefix)
+	photosBaseURL = os.Getenv("CACHE_PHOTOS_BASE_URL")
+	snsFormat = envVar("SNS_FORMAT", snsFormatDefault)
+	priceTopics, err := parsePriceTopics(os.Getenv("SNS_PRICE_TOPICS"))
+	if err != nil {
+		panic("Invalid environment variable SNS_PRICE_TOPICS: " + err.Error())
+	}
+	snsPriceTopics = priceTopics
+	if snsFormat != snsFormatDefault && snsFormat != snsFormatSMS {
+		panic("Unknown format in environment variable SNS_FORMAT: " + snsFormat)
+	}
+	markFilteredSeen = boolEnvVar("MARK_FILTERED_SEEN")
+	keywordsInclude = lowerAll(splitList(os.Getenv("KEYWORDS_INCLUDE")))
+	keywordsExclude = lowerAll(splitList(os.Getenv("KEYWORDS_EXCLUDE")))
+	sqftMin = intEnvVar("SQFT_MIN", 0)
+	sqftMax = intEnvVar("SQFT_MAX", 0)
+	sqftUnknownPasses = boolEnvVarDefault("SQFT_UNKNOWN_PASSES", true)
+	maxPricePerSqFt = intEnvVar("MAX_PRICE_PER_SQFT", 0)
+	pricePerSqFtStrict = boolEnvVar("PRICE_PER_SQFT_STRICT")
+	newConstructionOnly = boolEnvVar("NEW_CONSTRUCTION_ONLY")
+	newConstructionLenient = boolEnvVar("NEW_CONSTRUCTION_LENIENT")
+	minLotSqFt = intEnvVar("MIN_LOT_SQFT", 0)
+	lotUnknownPasses = boolEnvVarDefault("LOT_UNKNOWN_PASSES", true)
+	requireGarage = boolEnvVar("REQUIRE_GARAGE")
+	minParkingSpaces = intEnvVar("MIN_PARKING_SPACES", 0)
+	parkingUnknownPasses = boolEnvVarDefault("PARKING_UNKNOWN_PASSES", true)
+	maxDaysOnMarket = intEnvVar("MAX_DAYS_ON_MARKET", 0)
+	openHouseOnly = boolEnvVar("OPEN_HOUSE_ONLY")
+	requirePhotos = boolEnvVar("REQUIRE_PHOTOS")
+	statusInclude = lowerAll(splitList(os.Getenv("STATUS_INCLUDE")))
+	propertyTypesInclude = lowerAll(splitList(os.Getenv("PROPERTY_TYPES")))
+	propertyTypesExclude = lowerAll(splitList(os.Getenv("PROPERTY_TYPES_EXCLUDE")))
+	for _, t := range propertyTypesInclude {
+		if !validPropertyType(t) {
+			panic("Unknown property type in environment variable PROPERTY_TYPES: " + t)
+		}
+	}
+	for _, t := range propertyTypesExclude {
+		if !validPropertyType(t) {
+			panic("Unknown property type in environment variable PROPERTY_TYPES_EXCLUDE: " + t)
+		}
+	}
+	propertyTypeUnknownPasses = boolEnvVar("PROPERTY_TYPE_UNKNOWN_PASSES")
+	maxCondoFee = intEnvVar("MAX_CONDO_FEE", 0)
+	condoFeeUnknownPasses = boolEnvVarDefault("CONDO_FEE_UNKNOWN_PASSES", true)
+	dedupByAddress = boolEnvVar("DEDUP_BY_ADDRESS")
+	dedupByURL = boolEnvVar("DEDUP_BY_URL")
+	ignoreMarkSeen = boolEnvVar("IGNORE_MARK_SEEN")
+	cleanURLs = boolEnvVar("CLEAN_URLS")
+	if fields := envVar("WATCH_FIELDS", defaultWatchFields); fields != "none" {
+		watchFields = splitList(fields)
+	}
+	watchBandAbove = intEnvVar("WATCH_BAND_ABOVE", 0)
+	for _, field := range watchFields {
+		if !validWatchField(field) {
+			panic("Unknown field in environment variable WATCH_FIELDS: " + field)
+		}
+	}
+	location, err := time.LoadLocation(envVar("OPEN_HOUSE_TIMEZONE", defaultOpenHouseTimezone))
+	if err != nil {
+		panic("Invalid time zone in environment variable OPEN_HOUSE_TIMEZONE: " + err.Error())
+	}
+	openHouseLocation = location
+	if v := os.Getenv("QUIET_HOURS"); v != "" {
+		location, err := time.LoadLocation(envVar("QUIET_HOURS_TIMEZONE", defaultOpenHouseTimezone))
+		if err != nil {
+			panic("Invalid time zone in environment variable QUIET_HOURS_TIMEZONE: " + err.Error())
+		}
+		if quietHours, err = parseQuietHours(v, location); err != nil {
+			panic("Invalid environment variable QUIET_HOURS: " + err.Error())
+		}
+	}
+	notifierBackendList = splitList(os.Getenv("NOTIFIERS"))
+	for _, name := range notifierBackendList {
+		if !validNotifierBackend(name) {
+			panic("Unknown notifier in environment variable NOTIFIERS: " + name)
+		}
+	}
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func requiredEnvVar(key string) string {
@@ -76,227 +392,1181 @@ func requiredEnvVar(key string) string {
 	return ret
 }
 
-type Listing struct {
-	ID                 string
-	RelativeDetailsURL string
+func envVar(key, fallback string) string {
+	if ret := os.Getenv(key); ret != "" {
+		return ret
+	}
+	return fallback
 }
 
-func (l Listing) URL() string {
-	return baseURL + l.RelativeDetailsURL
+func boolEnvVar(key string) bool {
+	return boolEnvVarDefault(key, false)
 }
 
-type Listings struct {
-	Results []Listing
+func boolEnvVarDefault(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	ret, err := strconv.ParseBool(v)
+	if err != nil {
+		panic("Invalid boolean in environment variable " + key + ": " + v)
+	}
+	return ret
 }
 
-type SeenIDs []string
-
-func (s *SeenIDs) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
-	var out bytes.Buffer
+// splitList splits a comma-separated list, dropping blank entries.
+func splitList(v string) []string {
+	var ret []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
 
-	j, err := json.Marshal(s)
+func intEnvVar(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	ret, err := strconv.Atoi(v)
 	if err != nil {
-		return err
+		panic("Invalid integer in environment variable " + key + ": " + v)
 	}
+	return ret
+}
 
-	z := zlib.NewWriter(&out)
+// parsePriceDropThreshold accepts either a dollar amount ("20000") or a
+// percentage of the previous price ("5%"), returned in basis points.
+func parsePriceDropThreshold(v string) (int, int) {
+	if strings.HasSuffix(v, "%") {
+		return 0, parsePriceDropPercent("PRICE_DROP_THRESHOLD", strings.TrimSuffix(v, "%"))
+	}
+	return parsePriceDropAmount("PRICE_DROP_THRESHOLD", v), 0
+}
 
-	if _, err = z.Write(j); err != nil {
-		return err
+func parsePriceDropAmount(key, v string) int {
+	amount, err := strconv.Atoi(v)
+	if err != nil || amount < 0 {
+		panic("Invalid amount in environment variable " + key + ": " + v)
 	}
-	if err = z.Close(); err != nil {
-		return err
+	return amount
+}
+
+// parsePriceDropPercent returns the percentage v in basis points, so that
+// drops are compared in whole numbers and one of exactly the threshold is
+// not lost to floating point rounding.
+func parsePriceDropPercent(key, v string) int {
+	pct, err := strconv.ParseFloat(v, 64)
+	if err != nil || pct < 0 || pct > 100 {
+		panic("Invalid percentage in environment variable " + key + ": " + v)
 	}
+	return int(math.Round(pct * 100))
+}
 
-	av.SetB(out.Bytes())
+// priceDropped reports whether the move from oldPrice to newPrice is a drop
+// large enough to alert on. Unknown (zero) prices never count.
+func priceDropped(oldPrice, newPrice int) bool {
+	if oldPrice <= 0 || newPrice <= 0 || newPrice >= oldPrice {
+		return false
+	}
+	return priceMoveMet(oldPrice, oldPrice-newPrice, priceDropMinAmount, priceDropMinBasisPoints, priceDropRequireBoth)
+}
 
-	return nil
+// priceIncreased is priceDropped for prices going up, when increases are
+// alerted on at all.
+func priceIncreased(oldPrice, newPrice int) bool {
+	if !priceIncreaseAlerts || oldPrice <= 0 || newPrice <= oldPrice {
+		return false
+	}
+	return priceMoveMet(oldPrice, newPrice-oldPrice, priceIncreaseMinAmount, priceIncreaseMinBasisPoints, priceIncreaseRequireBoth)
 }
 
-func (s *SeenIDs) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
-	if av.B != nil {
-		z, err := zlib.NewReader(bytes.NewReader(av.B))
-		if err != nil {
-			return err
+// priceMoveMet reports whether a price move of delta dollars from oldPrice
+// reaches minAmount or basisPoints, whichever are set, or both of them with
+// requireBoth.
+func priceMoveMet(oldPrice, delta, minAmount, basisPoints int, requireBoth bool) bool {
+	amountMet := delta >= minAmount
+	// delta/oldPrice >= basisPoints/10000, kept exact in integers.
+	percentMet := int64(delta)*10000 >= int64(basisPoints)*int64(oldPrice)
+	switch {
+	case basisPoints == 0:
+		return amountMet
+	case minAmount == 0:
+		return percentMet
+	case requireBoth:
+		return amountMet && percentMet
+	default:
+		return amountMet || percentMet
+	}
+}
+
+// newHTTPClient returns a client for outgoing HTTP calls, traced with
+// X-Ray when enabled.
+func newHTTPClient() *http.Client {
+	return newHTTPClientWithTimeout(httpTimeout)
+}
+
+func newHTTPClientWithTimeout(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if enableXRay {
+		return xray.Client(client)
+	}
+	return client
+}
+
+// HandleRequest runs every configured search and returns a RunResult
+// summing up what was fetched and alerted on, or would have been in dry-run
+// mode. The payload is an Event: with force set the run sends queued
+// digests at once, and with coordinates it instead returns the listings
+// around them as a NearbyResult.
+func HandleRequest(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	event, err := parseEvent(payload)
+	if err != nil {
+		return nil, err
+	}
+	sess := newSession()
+	if event.Force {
+		slog.InfoContext(ctx, "Forced run, sending queued digests now", "action", "forced")
+		return runSearches(withForce(ctx), sess)
+	}
+	if !event.nearby() {
+		return runSearches(ctx, sess)
+	}
+
+	dynamo := newDynamoClient(sess)
+	if err = checkTable(ctx, dynamo); err != nil {
+		return nil, err
+	}
+	ignore, err := loadIgnoreList(ctx, dynamo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the ignore list: %w", err)
+	}
+	return searchNearby(ctx, NewFetcher(newHTTPClient()), ignore, event)
+}
+
+func newSession() *session.Session {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region: aws.String(awsRegion),
+		},
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	if enableXRay {
+		sess = xray.AWSSession(sess)
+	}
+	return sess
+}
+
+// newDynamoClient returns a DynamoDB client, pointed at DYNAMO_ENDPOINT
+// when that is set, e.g. for DynamoDB Local.
+func newDynamoClient(sess *session.Session) *dynamodb.DynamoDB {
+	return dynamodb.New(sess, endpointConfig(dynamoEndpoint))
+}
+
+// newSNSClient returns an SNS client with the given configuration, pointed
+// at SNS_ENDPOINT when that is set.
+func newSNSClient(sess *session.Session, cfgs ...*aws.Config) *sns.SNS {
+	return sns.New(sess, append([]*aws.Config{endpointConfig(snsEndpoint)}, cfgs...)...)
+}
+
+// endpointConfig overrides a client's endpoint, if one is given. Stand-ins
+// for AWS services take any credentials, so dummy ones are used unless real
+// ones are in the environment.
+func endpointConfig(endpoint string) *aws.Config {
+	cfg := aws.NewConfig()
+	if endpoint == "" {
+		return cfg
+	}
+	cfg = cfg.WithEndpoint(endpoint)
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials("local", "local", ""))
+	}
+	return cfg
+}
+
+// runSearches is the scheduled run: it checks every search and alerts on
+// what changed.
+func runSearches(ctx context.Context, sess *session.Session) (*RunResult, error) {
+	ctx = withRuntimeBudget(ctx)
+	searches, err := loadSearches(ctx, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := NewFetcher(newHTTPClient())
+	dynamo := newDynamoClient(sess)
+	if err = checkTable(ctx, dynamo); err != nil {
+		return nil, err
+	}
+	history := NewRunHistory(dynamo)
+	ignore, err := loadIgnoreList(ctx, dynamo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the ignore list: %w", err)
+	}
+	var exporter *Exporter
+	if exportBucket != "" {
+		exporter = NewExporter(s3.New(sess), exportBucket, exportPrefix, exportHistory, exportCSVKey)
+	}
+	var commuter *Commuter
+	if maxCommuteMinutes > 0 {
+		commuter = NewCommuter(newHTTPClient(), dynamo, googleMapsAPIKey, commuteDestination, commuteMode)
+	}
+	var converter *CurrencyConverter
+	if displayCurrency != "" {
+		converter = NewCurrencyConverter(newHTTPClient(), displayCurrency, currencyRate, currencyRatesURL)
+	}
+	var photos *PhotoCache
+	if photosBucket != "" {
+		photos = NewPhotoCache(newHTTPClient(), s3.New(sess), photosBucket, photosPrefix, photosBaseURL)
+	}
+	usage := NewUsage()
+	var backend Notifier = NewStdoutNotifier(os.Stdout)
+	if !printAlerts {
+		if backend, err = NewNotifier(sess, usage); err != nil {
+			return nil, err
 		}
+	}
+	notify := instrumentedNotifier{next: backend}
 
-		j := json.NewDecoder(z)
-		if err = j.Decode(s); err != nil {
-			return err
+	// Searches are independent, so one failing does not stop the others.
+	var (
+		group  errgroup.Group
+		mu     sync.Mutex
+		errs   []error
+		result = &RunResult{DryRun: dryRun, Forced: forced(ctx), Searches: make([]SearchResult, len(searches))}
+	)
+	group.SetLimit(searchConcurrency)
+	for i, search := range searches {
+		i, search := i, search
+		group.Go(func() error {
+			if !withinBudget(ctx, minRequestInterval) {
+				slog.WarnContext(ctx, "Runtime budget used up, skipping search",
+					"action", "skipped", "search_name", search.Name, "budget_percent", runtimeBudgetPct)
+				mu.Lock()
+				defer mu.Unlock()
+				result.add(i, SearchResult{Name: search.Name, Skipped: true})
+				return nil
+			}
+
+			searchResult, err := runSearch(ctx, dynamo, fetcher, history, exporter, commuter, photos, converter, ignore, notify, search)
+			if err != nil {
+				slog.ErrorContext(ctx, "Search failed", "search_name", search.Name, "error", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.add(i, searchResult)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("search %q: %w", search.Name, err))
+			}
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	if operatorTopicName != "" && !dryRun && !printAlerts {
+		alertOperatorOnChallenge(ctx, newSNSClient(sess), operatorTopicArn(), errs)
+	}
+
+	// Comparables are a separate, occasional digest, so they run after the
+	// alerts and do not count towards them.
+	if comparablesEnabled {
+		for _, search := range searches {
+			if !withinBudget(ctx, minRequestInterval) {
+				slog.WarnContext(ctx, "Runtime budget used up, skipping comparables",
+					"action", "skipped", "search_name", search.Name, "budget_percent", runtimeBudgetPct)
+				continue
+			}
+			if err := runComparables(ctx, dynamo, fetcher, notify, search); err != nil {
+				slog.ErrorContext(ctx, "Comparables failed", "search_name", search.Name, "error", err)
+				errs = append(errs, fmt.Errorf("comparables for search %q: %w", search.Name, err))
+			}
+		}
+	}
+
+	// The usage counts are a rough self-check, so failing to keep them only
+	// warrants a warning.
+	var sentThisMonth map[string]int
+	if !dryRun && !printAlerts {
+		now := time.Now()
+		if sentThisMonth, err = usage.Flush(ctx, dynamo, now); err != nil {
+			slog.WarnContext(ctx, "Failed to record notification usage", "error", err)
 		}
-	} else if av.L != nil {
-		for _, v := range av.L {
-			*s = append(*s, *v.S)
+		if usageReport && operatorTopicName != "" {
+			if err = ReportPreviousMonth(ctx, dynamo, newSNSClient(sess), operatorTopicArn(), now); err != nil {
+				slog.WarnContext(ctx, "Failed to send the usage report", "error", err)
+			}
 		}
 	}
 
-	return nil
+	for _, err := range errs {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	slog.InfoContext(ctx, "Run finished", "action", "notified", "count", result.Notified, "dry_run", dryRun, "sent_this_month", sentThisMonth)
+	return result, errors.Join(errs...)
+}
+
+// suspiciousFetch reports whether a fetch of current listings has shrunk by
+// more than fetchDropThreshold percent against the previous one.
+func suspiciousFetch(previous, current int) bool {
+	if fetchDropThreshold <= 0 || previous < fetchGuardMinCount {
+		return false
+	}
+	return current*100 < previous*(100-fetchDropThreshold)
 }
 
-type ListingCache struct {
-	PartitionKey string  `dynamodbav:"partition_key"`
-	SeenIDs      SeenIDs `dynamodbav:"seen_ids"`
+// searchRun is one search being processed.
+type searchRun struct {
+	search Search
+	db     *DB
+	// queue holds the new listings of a search sending a digest every
+	// DigestInterval.
+	queue   *DigestQueue
+	notify  Notifier
+	filters Filters
+	// commuter looks up commute times for the listings that pass filters,
+	// or is nil when MAX_COMMUTE_MINUTES is not set.
+	commuter *Commuter
+	// photos copies the photos of the listings alerted on to S3, or is nil
+	// when CACHE_PHOTOS_S3 is not set.
+	photos *PhotoCache
+	ignore *IgnoreList
+	// exporter writes the listings to S3, or is nil when EXPORT_S3_BUCKET
+	// is not set.
+	exporter *Exporter
+	logger   *slog.Logger
+
+	// bandCeiling is the PriceMax alerts are sent under when the watch
+	// band is on, or 0.
+	bandCeiling int
+
+	// overMaxResults are the fetched listings cut off by MAX_RESULTS. They
+	// are not alerted on but still count as present.
+	overMaxResults []Listing
+
+	// fetched and newCount are recorded in the run history.
+	fetched  int
+	newCount int
+
+	mu       sync.Mutex
+	notified int
 }
 
-type DB struct {
-	dynamo *dynamodb.DynamoDB
-	cache  *ListingCache
+// priceMove is an alert-worthy price change of a seen listing, down or
+// up.
+type priceMove struct {
+	listing  Listing
+	oldPrice int
 }
 
-func NewDB(session *session.Session) *DB {
-	return &DB{dynamo: dynamodb.New(session)}
+// listingChange is a seen listing whose watched fields have changed.
+type listingChange struct {
+	listing Listing
+	changes []FieldChange
 }
 
-func (db *DB) Seen(ctx context.Context, listing Listing) (bool, error) {
-	if db.cache == nil {
-		if err := db.refreshCache(ctx); err != nil {
-			return false, err
+// runSearch alerts on the changes in one search's results. A failure to
+// save the cache at the end fails the search, unless it has already failed
+// for another reason. Every run outside dry-run mode is recorded in the run
+// history.
+func runSearch(ctx context.Context, dynamo dynamoAPI, fetcher *Fetcher, history *RunHistory, exporter *Exporter, commuter *Commuter, photos *PhotoCache, converter *CurrencyConverter, ignore *IgnoreList, notify Notifier, search Search) (result SearchResult, err error) {
+	r := &searchRun{
+		search:   search,
+		db:       NewDB(dynamo, search.PartitionKey()),
+		queue:    NewDigestQueue(dynamo, search.Name),
+		exporter: exporter,
+		notify:   notify,
+		filters:  configuredFilters(),
+		commuter: commuter,
+		photos:   photos,
+		ignore:   ignore,
+		logger:   slog.With("search_name", search.Name),
+	}
+	defer func() {
+		result = SearchResult{Name: search.Name, Fetched: r.fetched, New: r.newCount, Notified: r.notified}
+		if err != nil {
+			result.Error = err.Error()
 		}
+	}()
+
+	metrics := NewMetrics(search.Name)
+	ctx = withMetrics(ctx, metrics)
+	defer metrics.Emit(ctx)
+
+	startedAt := time.Now()
+	r.logLastSuccess(ctx, history, startedAt)
+	defer func() {
+		if dryRun {
+			return
+		}
+		summary := RunSummary{SearchName: search.Name, Fetched: r.fetched, New: r.newCount, Notified: r.notified}
+		if err != nil {
+			summary.Error = err.Error()
+		}
+		flushCtx, cancel := flushContext(ctx)
+		defer cancel()
+		if recordErr := history.Record(flushCtx, startedAt, summary); recordErr != nil {
+			r.logger.ErrorContext(ctx, "Failed to record run history", "error", recordErr)
+		}
+	}()
+
+	fetchSearch, ceiling := watchBand(search)
+	r.bandCeiling = ceiling
+	if watchBandAbove > 0 && ceiling == 0 {
+		r.logger.WarnContext(ctx, "WATCH_BAND_ABOVE needs the search to set PriceMax, ignoring it")
 	}
-	for _, seenId := range db.cache.SeenIDs {
-		if listing.ID == seenId {
-			return true, nil
+
+	fetchStart := time.Now()
+	var listings *Listings
+	if enableXRay {
+		err = xray.Capture(ctx, "FetchListings", func(ctx context.Context) error {
+			listings, err = fetcher.FetchSplit(ctx, fetchSearch)
+			return err
+		})
+	} else {
+		listings, err = fetcher.FetchSplit(ctx, fetchSearch)
+	}
+	addMetric(ctx, metricFetchDurationMs, float64(time.Since(fetchStart).Milliseconds()), "Milliseconds")
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			r.logger.ErrorContext(ctx, "Search rejected by realtor.ca", "code", apiErr.Code, "description", apiErr.Description)
 		}
+		var challengeErr *ChallengeError
+		if errors.As(err, &challengeErr) {
+			r.logger.ErrorContext(ctx, "Blocked by realtor.ca's bot protection",
+				"status", challengeErr.StatusCode, "snippet", challengeErr.Snippet)
+		}
+		return result, err
+	}
+	r.fetched = len(listings.Results)
+	total := listings.Paging.TotalRecords
+	if listings.Boxes > 1 {
+		r.logger.InfoContext(ctx, fmt.Sprintf("Split the search area into %d boxes to get past the results cap", listings.Boxes),
+			"boxes", listings.Boxes, "split_max_depth", splitMaxDepth)
+	}
+	r.logger.InfoContext(ctx, fmt.Sprintf("Fetched %d of %d matching listings", r.fetched, total),
+		"action", "fetched", "count", r.fetched, "total_records", total)
+	if listings.StoppedEarly {
+		r.logger.WarnContext(ctx, "Runtime budget used up, stopped fetching pages early",
+			"count", r.fetched, "total_records", total, "budget_percent", runtimeBudgetPct)
+	} else if r.fetched < total {
+		message := "Not every matching listing was fetched; narrow the search or raise MAX_PAGES or SPLIT_MAX_DEPTH"
+		if r.search.Params.Get("Sort") != sortNewest {
+			message = "Not every matching listing was fetched and the search is not sorted newest first, so new listings may be missed"
+		}
+		r.logger.WarnContext(ctx, message,
+			"count", r.fetched, "total_records", total, "max_pages", maxPages, "sort", r.search.Params.Get("Sort"))
 	}
-	return false, nil
+	if maxResults > 0 && len(listings.Results) > maxResults {
+		r.logger.InfoContext(ctx, fmt.Sprintf("Keeping the first %d of %d fetched listings", maxResults, r.fetched),
+			"count", maxResults, "fetched", r.fetched, "max_results", maxResults)
+		r.overMaxResults = listings.Results[maxResults:]
+		listings.Results = listings.Results[:maxResults]
+	}
+	addMetric(ctx, metricListingsFetched, float64(len(listings.Results)), "Count")
+
+	// A price that cannot be converted is still shown as it is.
+	if converter != nil {
+		if err := converter.Convert(ctx, listings.Results); err != nil {
+			r.logger.WarnContext(ctx, "Failed to convert prices", "currency", displayCurrency, "error", err)
+		}
+	}
+
+	// The export is a convenience, so failing it does not fail the run.
+	if exporter != nil {
+		if err := exporter.Export(ctx, search, listings, fetchStart); err != nil {
+			r.logger.WarnContext(ctx, "Failed to export listings to S3", "bucket", exportBucket, "error", err)
+		}
+	}
+	addMetric(ctx, metricNewListings, 0, "Count")
+
+	defer func() {
+		if dryRun {
+			return
+		}
+		flushCtx, cancel := flushContext(ctx)
+		defer cancel()
+		if flushErr := r.db.Flush(flushCtx); flushErr != nil {
+			r.logger.ErrorContext(ctx, "Failed to flush cache to database", "error", flushErr)
+			if err == nil {
+				err = flushErr
+			}
+		}
+	}()
+
+	err = r.process(ctx, listings)
+	return result, err
 }
 
-func (db *DB) refreshCache(ctx context.Context) error {
-	item, err := db.dynamo.GetItemWithContext(
-		ctx,
-		&dynamodb.GetItemInput{
-			Key: map[string]*dynamodb.AttributeValue{
-				dynamoPartitionKeyName: {S: aws.String(dynamoPartitionKeyValue)}},
-			TableName: aws.String(dynamoTableName),
-		})
+// logLastSuccess reports how long it has been since the search last ran
+// successfully, so a scraper that keeps failing shows up on a dashboard.
+func (r *searchRun) logLastSuccess(ctx context.Context, history *RunHistory, now time.Time) {
+	last, err := history.LastSuccess(ctx, r.search.Name)
+	if err != nil {
+		r.logger.WarnContext(ctx, "Failed to read run history", "error", err)
+		return
+	}
+	if last == nil {
+		r.logger.InfoContext(ctx, "No successful run on record")
+		return
+	}
+
+	since := now.Sub(last.Time())
+	r.logger.InfoContext(ctx, fmt.Sprintf("It has been %s since the last successful run", since.Round(time.Minute)),
+		"last_success", last.StartedAt, "last_fetched", last.Fetched, "last_new", last.New)
+	addMetric(ctx, metricHoursSinceLastSuccess, since.Hours(), "None")
+}
+
+func (r *searchRun) process(ctx context.Context, listings *Listings) error {
+	var (
+		newListings []Listing
+		priceDrops  []priceMove
+		priceRises  []priceMove
+		changed     []listingChange
+		// runKeys maps the dedup keys of this run's new listings to
+		// their IDs.
+		runKeys = make(map[string]string)
+		// reconciled and unreconciled count the seen listings never
+		// notified that are alerted on this run and left for later ones.
+		reconciled, unreconciled int
+	)
+	for _, listing := range listings.Results {
+		seen, err := r.db.Seen(ctx, listing)
+		if err != nil {
+			return err
+		}
+		if dedupByURL {
+			if seen, err = r.seenByURL(ctx, listing, seen); err != nil {
+				return err
+			}
+		}
+		if listing.FirstSeen, _, err = r.db.FirstSeen(ctx, listing); err != nil {
+			return err
+		}
+
+		// Ignored listings are never alerted on, not even for price
+		// drops, so they are dropped before anything else.
+		if rule := r.ignore.Match(listing); rule != "" {
+			r.logger.InfoContext(ctx, "Ignoring listing", "action", "ignored", "listing_id", listing.ID, "rule", rule)
+			if !seen && ignoreMarkSeen && !dryRun {
+				if err = r.db.MarkSeen(ctx, listing); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		reason := r.filters.Reason(listing)
+		if reason == "" && r.commuter != nil {
+			// Commute times cost an API call, so they are only looked up
+			// for listings that pass every other filter.
+			if listing.CommuteMinutes, err = r.commuter.Minutes(ctx, listing); err != nil {
+				r.logger.WarnContext(ctx, "Failed to look up commute time", "listing_id", listing.ID, "error", err)
+			}
+			reason = commuteFilter(maxCommuteMinutes, commuteUnknownPasses)(listing)
+		}
+		if reason != "" {
+			r.logger.InfoContext(ctx, "Skipping listing", "action", "skipped", "listing_id", listing.ID, "reason", reason)
+			if !seen && markFilteredSeen && !dryRun {
+				if err = r.db.MarkSeen(ctx, listing); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		aboveBand := r.bandCeiling > 0 && listing.PriceAmount > r.bandCeiling
+		if !seen && aboveBand {
+			r.logger.InfoContext(ctx, "Watching listing above the alert band", "action", "skipped", "listing_id", listing.ID,
+				"reason", "price above "+formatDollars(r.bandCeiling))
+			if !dryRun {
+				if err = r.db.MarkSeen(ctx, listing); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !seen && dedupByAddress {
+			canonicalID, err := r.duplicateOf(ctx, listing, runKeys)
+			if err != nil {
+				return err
+			}
+			if canonicalID != "" {
+				r.logger.InfoContext(ctx, "Suppressing duplicate listing",
+					"action", "deduplicated", "listing_id", listing.ID, "duplicate_of", canonicalID, "address", listing.Address)
+				if !dryRun {
+					if err = r.db.MarkDuplicate(ctx, listing, canonicalID); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+
+		if !seen {
+			countMetric(ctx, metricNewListings)
+			newListings = append(newListings, listing)
+			continue
+		}
+
+		duplicateOf, err := r.db.DuplicateOf(ctx, listing)
+		if err != nil {
+			return err
+		}
+
+		// Reconciling alerts again on the seen listings that are not
+		// recorded as notified, such as ones lost to a bug, a few a run.
+		if reconcileNotified {
+			notified, err := r.db.Notified(ctx, listing)
+			if err != nil {
+				return err
+			}
+			if !notified && duplicateOf == "" && !aboveBand {
+				if reconciled < reconcileMaxPerRun {
+					reconciled++
+					r.logger.InfoContext(ctx, "Alerting on seen listing never notified", "action", "reconciled", "listing_id", listing.ID)
+					newListings = append(newListings, listing)
+					continue
+				}
+				unreconciled++
+			}
+		}
+
+		// Duplicates are kept quiet for good, so their price changes are
+		// not alerted on twice either.
+		if duplicateOf != "" {
+			if err = r.db.Touch(ctx, listing); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Listings above the band are only kept up to date, to spot them
+		// dropping into it.
+		if aboveBand {
+			if err = r.db.UpdatePrice(ctx, listing); err != nil {
+				return err
+			}
+			if err = r.db.UpdateSnapshot(ctx, listing); err != nil {
+				return err
+			}
+			if err = r.db.Touch(ctx, listing); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lastPrice, ok, err := r.db.LastPrice(ctx, listing)
+		if err != nil {
+			return err
+		}
+		enteredBand := ok && r.bandCeiling > 0 && lastPrice > r.bandCeiling && listing.PriceAmount > 0
+		dropped := ok && priceDropped(lastPrice, listing.PriceAmount) || enteredBand
+		increased := ok && priceIncreased(lastPrice, listing.PriceAmount)
+		switch {
+		case dropped:
+			priceDrops = append(priceDrops, priceMove{listing: listing, oldPrice: lastPrice})
+		case increased:
+			priceRises = append(priceRises, priceMove{listing: listing, oldPrice: lastPrice})
+		default:
+			if err = r.db.UpdatePrice(ctx, listing); err != nil {
+				return err
+			}
+		}
+
+		changes, err := r.db.Changes(ctx, listing)
+		if err != nil {
+			return err
+		}
+		if dropped || increased {
+			// The price alert already covers the price.
+			changes = withoutField(changes, "price")
+		}
+		if len(changes) > 0 {
+			changed = append(changed, listingChange{listing: listing, changes: changes})
+		} else if err = r.db.UpdateSnapshot(ctx, listing); err != nil {
+			return err
+		}
+		if err = r.db.Touch(ctx, listing); err != nil {
+			return err
+		}
+		r.logger.DebugContext(ctx, "Listing already seen", "action", "seen", "listing_id", listing.ID)
+	}
+
+	r.newCount = len(newListings)
+	if reconciled > 0 || unreconciled > 0 {
+		r.logger.InfoContext(ctx, fmt.Sprintf("Reconciled %d seen listings never notified, %d left for later runs", reconciled, unreconciled),
+			"action", "reconciled", "count", reconciled, "remaining", unreconciled, "max_per_run", reconcileMaxPerRun)
+	}
+
+	previousCount, err := r.db.LastFetchCount(ctx)
 	if err != nil {
 		return err
 	}
-	if err = dynamodbattribute.UnmarshalMap(item.Item, &db.cache); err != nil {
+	suspicious := suspiciousFetch(previousCount, len(listings.Results))
+
+	r.cachePhotos(ctx, newListings)
+	r.cachePriceMovePhotos(ctx, priceDrops)
+	r.cachePriceMovePhotos(ctx, priceRises)
+
+	// Alerts are sent by a small pool of workers; each one writes its
+	// listing back as soon as its alert is out, so that a Lambda retry
+	// after a failure does not repeat it.
+	var pool errgroup.Group
+	pool.SetLimit(notifyConcurrency)
+	digest := r.search.Digest()
+	if maxNotificationsPerRun > 0 && len(newListings) > maxNotificationsPerRun && !digest {
+		r.logger.WarnContext(ctx, "Too many new listings to alert on one by one, sending a digest instead",
+			"count", len(newListings), "max_notifications", maxNotificationsPerRun)
+		digest = true
+	}
+	quiet := quietHours.Contains(time.Now()) && !forced(ctx)
+	if quietHours != nil && !quiet && !(digest && r.search.DigestInterval > 0) {
+		// Send what was held back during the quiet hours.
+		pool.Go(func() error { return r.queueDigest(ctx, nil) })
+	}
+	switch {
+	case digest && r.search.DigestInterval > 0 || quiet:
+		pool.Go(func() error { return r.queueDigest(ctx, newListings) })
+	case digest && len(newListings) > 0:
+		pool.Go(func() error { return r.sendDigest(ctx, newListings) })
+	default:
+		for _, listing := range newListings {
+			listing := listing
+			pool.Go(func() error { return r.alertNew(ctx, listing) })
+		}
+	}
+	for _, drop := range priceDrops {
+		drop := drop
+		pool.Go(func() error { return r.alertPriceDrop(ctx, drop) })
+	}
+	for _, rise := range priceRises {
+		rise := rise
+		pool.Go(func() error { return r.alertPriceIncrease(ctx, rise) })
+	}
+	for _, change := range changed {
+		change := change
+		pool.Go(func() error { return r.alertChanged(ctx, change) })
+	}
+	if err = pool.Wait(); err != nil {
 		return err
 	}
 
-	return nil
-}
+	if r.exporter != nil && !dryRun {
+		if err = r.exporter.AppendCSV(ctx, newListings, time.Now()); err != nil {
+			r.logger.WarnContext(ctx, "Failed to append new listings to the CSV export", "key", exportCSVKey, "error", err)
+		}
+	}
 
-func (db *DB) MarkSeen(ctx context.Context, listing Listing) error {
-	_ = ctx
-	if db.cache == nil {
-		return errors.New("cache is not populated yet")
+	// A fetch much smaller than the last one is more likely a realtor.ca
+	// hiccup than listings vanishing, so it is not allowed to count
+	// listings as missing.
+	if suspicious {
+		r.logger.WarnContext(ctx, "Fetch much smaller than the previous run's, skipping removed-listing detection",
+			"count", len(listings.Results), "previous_count", previousCount, "threshold_percent", fetchDropThreshold)
+	} else if listings.StoppedEarly {
+		// The pages not fetched would make their listings look removed.
+		r.logger.InfoContext(ctx, "Fetch stopped early, skipping removed-listing detection")
+	} else {
+		if err = r.db.RecordFetchCount(ctx, len(listings.Results)); err != nil {
+			return err
+		}
+		if err = r.detectRemoved(ctx, listings); err != nil {
+			return err
+		}
 	}
-	db.cache.SeenIDs = append(db.cache.SeenIDs, listing.ID)
-	return nil
+
+	return r.heartbeat(ctx)
 }
 
-func (db *DB) Flush(ctx context.Context) error {
-	// Set the partition key in case of empty cache
-	db.cache.PartitionKey = dynamoPartitionKeyValue
+// heartbeat sends a "still watching" alert when nothing has been sent for
+// heartbeatInterval, so a quiet market can be told from a broken scraper.
+func (r *searchRun) heartbeat(ctx context.Context) error {
+	if dryRun {
+		return nil
+	}
+	now := time.Now()
+	if r.notified > 0 {
+		return r.db.RecordNotified(ctx, now)
+	}
+	if heartbeatInterval <= 0 || quietHours.Contains(now) {
+		return nil
+	}
 
-	item, err := dynamodbattribute.MarshalMap(db.cache)
+	last, err := r.db.LastNotified(ctx)
 	if err != nil {
 		return err
 	}
+	if last.IsZero() {
+		// Start counting from the first run that knows about heartbeats.
+		return r.db.RecordNotified(ctx, now)
+	}
+	if now.Sub(last) < heartbeatInterval {
+		return nil
+	}
 
-	_, err = db.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
-		Item:         item,
-		ReturnValues: aws.String(dynamodb.ReturnValueNone),
-		TableName:    aws.String(dynamoTableName),
-	})
-	return err
+	if err = r.notify.SendHeartbeat(ctx, r.search.Name, r.fetched, last); err != nil {
+		return err
+	}
+	r.logger.InfoContext(ctx, "Sent heartbeat", "action", "heartbeat", "last_notified", last.Format(time.RFC3339))
+	return r.db.RecordNotified(ctx, now)
 }
 
-type Notifier struct {
-	sns      *sns.SNS
-	topicArn *string
+// duplicateOf returns the ID of the listing a new listing duplicates,
+// either earlier in this run or in the cache, or an empty string.
+func (r *searchRun) duplicateOf(ctx context.Context, listing Listing, runKeys map[string]string) (string, error) {
+	key := dedupKey(listing)
+	if key == "" {
+		return "", nil
+	}
+	if id, ok := runKeys[key]; ok {
+		return id, nil
+	}
+	id, ok, err := r.db.FindDuplicate(ctx, key, listing.ID)
+	if err != nil || ok {
+		return id, err
+	}
+	runKeys[key] = listing.ID
+	return "", nil
 }
 
-func NewNotifier(sess *session.Session) *Notifier {
-	return &Notifier{
-		sns:      sns.New(sess),
-		topicArn: aws.String("arn:aws:sns:" + *sess.Config.Region + ":" + awsAccountId + ":" + snsTopicName),
+// seenByURL reports whether the listing was seen, either under its own ID
+// or, if not, as its URL under another ID, in which case the record is
+// carried over to the new ID. A seen listing has its URL key kept up to
+// date, should its URL change instead.
+func (r *searchRun) seenByURL(ctx context.Context, listing Listing, seen bool) (bool, error) {
+	if seen {
+		if dryRun {
+			return true, nil
+		}
+		return true, r.db.UpdateURLKey(ctx, listing)
 	}
+	previousID, ok, err := r.db.FindByURL(ctx, urlKey(listing), listing.ID)
+	if err != nil || !ok {
+		return false, err
+	}
+	r.logger.InfoContext(ctx, "Listing reappeared under a new ID", "action", "deduplicated",
+		"listing_id", listing.ID, "previous_id", previousID, "url", listing.URL())
+	if dryRun {
+		return true, nil
+	}
+	return true, r.db.Adopt(ctx, listing, previousID)
 }
 
-func (n *Notifier) SendListingAlert(ctx context.Context, listing Listing) error {
-	_, err := n.sns.PublishWithContext(ctx, &sns.PublishInput{
-		Message:  aws.String(n.formatMessage(listing)),
-		Subject:  aws.String(n.formatSubject(listing)),
-		TopicArn: n.topicArn,
-	})
-	return err
+func (r *searchRun) countNotified() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notified++
 }
 
-func (n *Notifier) formatMessage(listing Listing) string {
-	return listing.URL()
+func (r *searchRun) alertNew(ctx context.Context, listing Listing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if dryRun {
+		r.logger.InfoContext(ctx, "Dry run: would alert on new listing",
+			"action", "notified", "listing_id", listing.ID, "url", listing.URL(), "reason", "not seen before")
+		r.countNotified()
+		return nil
+	}
+
+	if err := r.notify.SendListingAlert(ctx, listing); err != nil {
+		return err
+	}
+	r.logger.InfoContext(ctx, "Alerted on new listing", "action", "notified", "listing_id", listing.ID)
+	r.countNotified()
+
+	return r.db.MarkNotified(ctx, listing)
 }
 
-func (n *Notifier) formatSubject(listing Listing) string {
-	_ = listing
-	return "New listing on Realtor.ca"
+// cachePhotos points the listings' photos at their copies in S3. A photo
+// that cannot be copied keeps its original URL; an alert with a broken
+// image beats no alert.
+func (r *searchRun) cachePhotos(ctx context.Context, listings []Listing) {
+	if r.photos == nil || dryRun {
+		return
+	}
+	var pool errgroup.Group
+	pool.SetLimit(notifyConcurrency)
+	for i := range listings {
+		listing := &listings[i]
+		if listing.PhotoURL == "" {
+			continue
+		}
+		pool.Go(func() error {
+			cached, err := r.photos.URL(ctx, *listing)
+			if err != nil {
+				r.logger.WarnContext(ctx, "Failed to cache listing photo, using the original",
+					"listing_id", listing.ID, "url", listing.PhotoURL, "error", err)
+				return nil
+			}
+			listing.PhotoURL = cached
+			return nil
+		})
+	}
+	_ = pool.Wait()
 }
 
-func HandleRequest(ctx context.Context) error {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region: aws.String(awsRegion),
-		},
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+// cachePriceMovePhotos is cachePhotos for the listings of price alerts.
+func (r *searchRun) cachePriceMovePhotos(ctx context.Context, moves []priceMove) {
+	listings := make([]Listing, len(moves))
+	for i, move := range moves {
+		listings[i] = move.listing
+	}
+	r.cachePhotos(ctx, listings)
+	for i := range moves {
+		moves[i].listing = listings[i]
+	}
+}
+
+// queueDigest adds the new listings to the search's digest queue, and
+// sends the digest once DigestInterval has passed since the last one, or
+// at once in a forced run. Outside a forced run nothing is sent during
+// quiet hours.
+func (r *searchRun) queueDigest(ctx context.Context, listings []Listing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, listing := range listings {
+		if dryRun {
+			r.logger.InfoContext(ctx, "Dry run: would queue new listing for the next digest",
+				"action", "queued", "listing_id", listing.ID, "url", listing.URL(), "reason", "not seen before")
+			continue
+		}
+		if err := r.queue.Add(ctx, listing); err != nil {
+			return err
+		}
+		r.logger.InfoContext(ctx, "Queued new listing for the next digest", "action", "queued", "listing_id", listing.ID)
+		if err := r.db.MarkNotified(ctx, listing); err != nil {
+			return err
+		}
+	}
 
-	listings, err := fetchListings(ctx)
+	pending, lastSent, err := r.queue.Pending(ctx)
 	if err != nil {
 		return err
 	}
+	if dryRun {
+		// The listings were not actually queued.
+		pending = append(pending, listings...)
+	}
+	pending = markNewThisRun(pending, listings)
+	if len(pending) == 0 || time.Since(lastSent) < r.search.DigestInterval && !forced(ctx) {
+		return nil
+	}
+	if quietHours.Contains(time.Now()) && !forced(ctx) {
+		r.logger.InfoContext(ctx, "Quiet hours, holding the digest back", "action", "queued", "count", len(pending))
+		return nil
+	}
+	if dryRun {
+		r.logger.InfoContext(ctx, "Dry run: would send digest", "action", "notified", "count", len(pending))
+		r.countNotified()
+		return nil
+	}
+	if err = r.notify.SendDigest(ctx, pending); err != nil {
+		return err
+	}
+	r.logger.InfoContext(ctx, "Sent digest", "action", "notified", "count", len(pending))
+	r.countNotified()
+	return r.queue.MarkSent(ctx, pending, time.Now())
+}
 
-	db := NewDB(sess)
-	defer func() {
-		if err = db.Flush(ctx); err != nil {
-			log.Println("Failed to flush cache to database")
-			log.Fatal(err)
+func (r *searchRun) sendDigest(ctx context.Context, listings []Listing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if dryRun {
+		for _, listing := range listings {
+			r.logger.InfoContext(ctx, "Dry run: would include new listing in digest",
+				"action", "notified", "listing_id", listing.ID, "url", listing.URL(), "reason", "not seen before")
 		}
-	}()
+		r.countNotified()
+		return nil
+	}
 
-	notify := NewNotifier(sess)
+	if err := r.notify.SendDigest(ctx, listings); err != nil {
+		return err
+	}
+	r.logger.InfoContext(ctx, "Sent digest", "action", "notified", "count", len(listings))
+	r.countNotified()
 
-	for _, listing := range listings.Results {
-		seen, err := db.Seen(ctx, listing)
-		if err != nil {
+	for _, listing := range listings {
+		if err := r.db.MarkNotified(ctx, listing); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		if !seen {
-			if err = notify.SendListingAlert(ctx, listing); err != nil {
-				return err
-			}
+func (r *searchRun) alertPriceDrop(ctx context.Context, drop priceMove) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	listing := drop.listing
+	if dryRun {
+		r.logger.InfoContext(ctx, "Dry run: would alert on price drop",
+			"action", "price_dropped", "listing_id", listing.ID, "url", listing.URL(),
+			"old_price", drop.oldPrice, "new_price", listing.PriceAmount)
+		r.countNotified()
+		return nil
+	}
 
-			_ = db.MarkSeen(ctx, listing)
-		}
+	if err := r.notify.SendPriceDropAlert(ctx, listing, drop.oldPrice); err != nil {
+		return err
 	}
+	r.logger.InfoContext(ctx, "Alerted on price drop",
+		"action", "price_dropped", "listing_id", listing.ID, "old_price", drop.oldPrice, "new_price", listing.PriceAmount)
+	r.countNotified()
 
-	return nil
+	if err := r.db.UpdatePrice(ctx, listing); err != nil {
+		return err
+	}
+	return r.db.Save(ctx, listing.ID)
 }
 
-func fetchListings(ctx context.Context) (*Listings, error) {
-	listings := &Listings{}
+func (r *searchRun) alertPriceIncrease(ctx context.Context, rise priceMove) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	listing := rise.listing
+	if dryRun {
+		r.logger.InfoContext(ctx, "Dry run: would alert on price increase",
+			"action", "price_increased", "listing_id", listing.ID, "url", listing.URL(),
+			"old_price", rise.oldPrice, "new_price", listing.PriceAmount)
+		r.countNotified()
+		return nil
+	}
 
-	req, _ := http.NewRequestWithContext(ctx, "POST", apiURL, strings.NewReader(payload.Encode()))
-	response, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return listings, err
+	if err := r.notify.SendPriceIncreaseAlert(ctx, listing, rise.oldPrice); err != nil {
+		return err
 	}
+	r.logger.InfoContext(ctx, "Alerted on price increase",
+		"action", "price_increased", "listing_id", listing.ID, "old_price", rise.oldPrice, "new_price", listing.PriceAmount)
+	r.countNotified()
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return listings, err
+	if err := r.db.UpdatePrice(ctx, listing); err != nil {
+		return err
+	}
+	return r.db.Save(ctx, listing.ID)
+}
+
+func (r *searchRun) alertChanged(ctx context.Context, change listingChange) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	listing := change.listing
+	fields := make([]string, len(change.changes))
+	for i, c := range change.changes {
+		fields[i] = c.Field
+	}
+	if dryRun {
+		r.logger.InfoContext(ctx, "Dry run: would alert on changed listing",
+			"action", "changed", "listing_id", listing.ID, "url", listing.URL(), "fields", fields)
+		r.countNotified()
+		return nil
+	}
+
+	if err := r.notify.SendChangedAlert(ctx, listing, change.changes); err != nil {
+		return err
 	}
+	r.logger.InfoContext(ctx, "Alerted on changed listing", "action", "changed", "listing_id", listing.ID, "fields", fields)
+	r.countNotified()
 
-	if err = json.Unmarshal(body, listings); err != nil {
-		return listings, err
+	if err := r.db.UpdateSnapshot(ctx, listing); err != nil {
+		return err
+	}
+	return r.db.Save(ctx, listing.ID)
+}
+
+// detectRemoved alerts on seen listings that have been missing from the
+// results for removedAfterRuns runs, and forgets them.
+func (r *searchRun) detectRemoved(ctx context.Context, listings *Listings) error {
+	present := make(map[string]bool, len(listings.Results)+len(r.overMaxResults))
+	for _, listing := range listings.Results {
+		present[listing.ID] = true
+	}
+	for _, listing := range r.overMaxResults {
+		present[listing.ID] = true
+	}
+	removed, err := r.db.UpdateMissing(ctx, present)
+	if err != nil {
+		return err
 	}
 
-	return listings, nil
+	for _, id := range removed {
+		gone, err := r.db.Recorded(ctx, id)
+		if err != nil {
+			return err
+		}
+		gone.SearchName = r.search.Name
+		if rule := r.ignore.Match(gone); rule != "" {
+			r.logger.InfoContext(ctx, "Ignoring removed listing", "action", "ignored", "listing_id", id, "rule", rule)
+			if !dryRun {
+				if err = r.db.Forget(ctx, id); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if dryRun {
+			r.logger.InfoContext(ctx, "Dry run: would alert on removed listing",
+				"action", "removed", "listing_id", id, "missing_runs", removedAfterRuns)
+			r.countNotified()
+			continue
+		}
+
+		if err = r.notify.SendRemovedAlert(ctx, gone); err != nil {
+			return err
+		}
+		r.logger.InfoContext(ctx, "Alerted on removed listing", "action", "removed", "listing_id", id)
+		r.countNotified()
+		if err = r.db.Forget(ctx, id); err != nil {
+			return err
+		}
+		if err = r.db.Save(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// main runs as a Lambda function, or, outside Lambda or with -local, runs
+// the searches once and prints the alerts instead of sending them:
+//
+//	go run . -local -dry-run
 func main() {
-	lambda.Start(HandleRequest)
+	local := flag.Bool("local", false, "run once here instead of as a Lambda function")
+	send := flag.Bool("send", false, "in local mode, send alerts through the configured notifier")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "do not update the seen-listings cache (the default in local mode without -send)")
+	flag.Parse()
+
+	if !*local && os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		lambda.Start(HandleRequest)
+		return
+	}
+
+	// Logs go to stderr so stdout only has the alerts.
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, nil)}))
+	printAlerts = !*send
+	// A listing printed here and marked seen would never be alerted on by
+	// the deployed function, so printing implies a dry run unless asked
+	// otherwise with -dry-run=false.
+	if printAlerts && !flagSet("dry-run") {
+		dryRun = true
+	}
+
+	result, err := runSearches(context.Background(), newSession())
+	if result != nil {
+		summary, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(summary))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// init reads its configuration from the environment and panics without the
+// required variables. Package variables are initialized before any init
+// function runs, so setting them here lets the tests load the package.
+var _ = setTestEnv()
+
+func setTestEnv() bool {
+	for key, value := range map[string]string{
+		"AWS_REGION":        "ca-central-1",
+		"AWS_ACCOUNT_ID":    "123456789012",
+		"DYNAMO_TABLE_NAME": "realtorca-test",
+	} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, value)
+		}
+	}
+	return true
+}
+
+func TestPriceMoveMet(t *testing.T) {
+	tests := []struct {
+		name                   string
+		oldPrice, delta        int
+		minAmount, basisPoints int
+		requireBoth            bool
+		want                   bool
+	}{
+		{name: "no threshold", oldPrice: 500000, delta: 1, want: true},
+		{name: "exactly the amount", oldPrice: 500000, delta: 10000, minAmount: 10000, want: true},
+		{name: "a dollar short of the amount", oldPrice: 500000, delta: 9999, minAmount: 10000, want: false},
+		{name: "exactly the percentage", oldPrice: 500000, delta: 10000, basisPoints: 200, want: true},
+		{name: "a dollar short of the percentage", oldPrice: 500000, delta: 9999, basisPoints: 200, want: false},
+		// 1.15% of $123,457 is $1,419.7555, so $1,420 reaches it and
+		// $1,419 does not.
+		{name: "fractional percentage met", oldPrice: 123457, delta: 1420, basisPoints: 115, want: true},
+		{name: "fractional percentage missed", oldPrice: 123457, delta: 1419, basisPoints: 115, want: false},
+		{name: "either, amount met", oldPrice: 1200000, delta: 20000, minAmount: 20000, basisPoints: 500, want: true},
+		{name: "either, percentage met", oldPrice: 200000, delta: 10000, minAmount: 20000, basisPoints: 500, want: true},
+		{name: "either, neither met", oldPrice: 500000, delta: 19999, minAmount: 20000, basisPoints: 500, want: false},
+		{name: "both, only amount met", oldPrice: 1200000, delta: 20000, minAmount: 20000, basisPoints: 500, requireBoth: true, want: false},
+		{name: "both, only percentage met", oldPrice: 200000, delta: 10000, minAmount: 20000, basisPoints: 500, requireBoth: true, want: false},
+		{name: "both met exactly", oldPrice: 400000, delta: 20000, minAmount: 20000, basisPoints: 500, requireBoth: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := priceMoveMet(tt.oldPrice, tt.delta, tt.minAmount, tt.basisPoints, tt.requireBoth); got != tt.want {
+				t.Errorf("priceMoveMet(%d, %d, %d, %d, %v) = %v, want %v",
+					tt.oldPrice, tt.delta, tt.minAmount, tt.basisPoints, tt.requireBoth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePriceDropPercent(t *testing.T) {
+	tests := []struct {
+		v    string
+		want int
+	}{
+		{"2", 200},
+		{"2.5", 250},
+		{"1.15", 115},
+		{"0.1", 10},
+		{"0", 0},
+		{"100", 10000},
+	}
+	for _, tt := range tests {
+		if got := parsePriceDropPercent("PRICE_DROP_MIN_PCT", tt.v); got != tt.want {
+			t.Errorf("parsePriceDropPercent(%q) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestPriceDropped(t *testing.T) {
+	defer func(amount, bp int, both bool) {
+		priceDropMinAmount, priceDropMinBasisPoints, priceDropRequireBoth = amount, bp, both
+	}(priceDropMinAmount, priceDropMinBasisPoints, priceDropRequireBoth)
+	priceDropMinAmount, priceDropMinBasisPoints, priceDropRequireBoth = 0, 200, false
+
+	tests := []struct {
+		oldPrice, newPrice int
+		want               bool
+	}{
+		{500000, 490000, true},
+		{500000, 490001, false},
+		{500000, 500000, false},
+		{500000, 510000, false},
+		{0, 490000, false},
+		{500000, 0, false},
+	}
+	for _, tt := range tests {
+		if got := priceDropped(tt.oldPrice, tt.newPrice); got != tt.want {
+			t.Errorf("priceDropped(%d, %d) = %v, want %v", tt.oldPrice, tt.newPrice, got, tt.want)
+		}
+	}
+}
+
+func TestPriceIncreased(t *testing.T) {
+	defer func(on bool, amount, bp int, both bool) {
+		priceIncreaseAlerts, priceIncreaseMinAmount, priceIncreaseMinBasisPoints, priceIncreaseRequireBoth = on, amount, bp, both
+	}(priceIncreaseAlerts, priceIncreaseMinAmount, priceIncreaseMinBasisPoints, priceIncreaseRequireBoth)
+	priceIncreaseMinAmount, priceIncreaseMinBasisPoints, priceIncreaseRequireBoth = 10000, 0, false
+
+	tests := []struct {
+		oldPrice, newPrice int
+		want               bool
+	}{
+		{500000, 510000, true},
+		{500000, 509999, false},
+		{500000, 500000, false},
+		{500000, 490000, false},
+		{0, 510000, false},
+		{500000, 0, false},
+	}
+	for _, on := range []bool{true, false} {
+		priceIncreaseAlerts = on
+		for _, tt := range tests {
+			want := tt.want && on
+			if got := priceIncreased(tt.oldPrice, tt.newPrice); got != want {
+				t.Errorf("with increase alerts %v: priceIncreased(%d, %d) = %v, want %v", on, tt.oldPrice, tt.newPrice, got, want)
+			}
+		}
+	}
+}
+
+func TestProcessPriceIncrease(t *testing.T) {
+	defer func(v, on bool, amount, bp int) {
+		dryRun, priceIncreaseAlerts, priceIncreaseMinAmount, priceIncreaseMinBasisPoints = v, on, amount, bp
+	}(dryRun, priceIncreaseAlerts, priceIncreaseMinAmount, priceIncreaseMinBasisPoints)
+	dryRun, priceIncreaseMinAmount, priceIncreaseMinBasisPoints = false, 10000, 0
+
+	tests := []struct {
+		name       string
+		on         bool
+		price      int
+		wantAlerts string
+	}{
+		{name: "increase alerted", on: true, price: 520000, wantAlerts: "increase:1"},
+		{name: "increase alerts off", on: false, price: 520000},
+		{name: "increase too small", on: true, price: 505000},
+		{name: "no change", on: true, price: 500000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			priceIncreaseAlerts = tt.on
+			ctx := context.Background()
+			dynamo := newFakeDynamo()
+			dynamo.store(t, SeenListing{PartitionKey: "search", ListingID: "1", Price: 500000})
+			notify := newRecordingNotifier()
+			r := &searchRun{
+				search: Search{Name: "search"},
+				db:     NewDB(dynamo, "search"),
+				notify: notify,
+				logger: testLogger(),
+			}
+
+			if err := r.process(ctx, &Listings{Results: []Listing{{ID: "1", PriceAmount: tt.price}}}); err != nil {
+				t.Fatal(err)
+			}
+			if got := notify.alerts(); got != tt.wantAlerts {
+				t.Errorf("sent %q, want %q", got, tt.wantAlerts)
+			}
+			if price, _, _ := r.db.LastPrice(ctx, Listing{ID: "1"}); price != tt.price {
+				t.Errorf("price on record %d, want %d", price, tt.price)
+			}
+		})
+	}
+}
+
+func TestDetectRemovedIgnoresByAddress(t *testing.T) {
+	defer func(runs int, v bool) { removedAfterRuns, dryRun = runs, v }(removedAfterRuns, dryRun)
+	removedAfterRuns, dryRun = 1, false
+
+	ctx := context.Background()
+	dynamo := newFakeDynamo()
+	db := NewDB(dynamo, "search")
+	for _, listing := range []Listing{
+		{ID: "1", Address: "12 Main St, Toronto", PriceAmount: 650000},
+		{ID: "2", Address: "1 Bay St, Toronto", PriceAmount: 900000},
+	} {
+		if err := db.MarkSeen(ctx, listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	r := &searchRun{
+		search: Search{Name: "search"},
+		db:     db,
+		notify: NewStdoutNotifier(&out),
+		ignore: NewIgnoreList([]string{"12 Main St"}),
+		logger: testLogger(),
+	}
+
+	if err := r.detectRemoved(ctx, &Listings{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Listing 1 ") {
+		t.Errorf("alerted on the removal of an ignored address:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Listing 2 ") {
+		t.Errorf("no alert on the removal of listing 2:\n%s", out.String())
+	}
+	for _, id := range []string{"1", "2"} {
+		if seen, _ := db.Seen(ctx, Listing{ID: id}); seen {
+			t.Errorf("removed listing %s still on record", id)
+		}
+	}
+}
+
+// TestRunSearchFlushError checks that a failed flush fails the search,
+// whose error runSearches joins into the one the handler returns.
+func TestRunSearchFlushError(t *testing.T) {
+	defer func(v bool) { dryRun = v }(dryRun)
+	dryRun = false
+
+	search := Search{Name: "search", Params: url.Values{}}
+	dynamo := newFakeDynamo()
+	// A seen listing missing from the results leaves the cache to flush.
+	dynamo.store(t, SeenListing{PartitionKey: search.PartitionKey(), ListingID: "1", Price: 500000})
+	failure := awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found", nil)
+	dynamo.batchErrs = []error{failure}
+	api := &fakeAPI{pages: map[int]Listings{
+		1: {Results: []Listing{{ID: "2"}}, Paging: Paging{TotalRecords: 1, TotalPages: 1}},
+	}}
+	fetcher := &Fetcher{client: api, limiter: newRateLimiter(0)}
+	var out bytes.Buffer
+
+	result, err := runSearch(context.Background(), dynamo, fetcher, NewRunHistory(dynamo), nil, nil, nil, nil, nil, NewStdoutNotifier(&out), search)
+	if !errors.Is(err, failure) {
+		t.Fatalf("got error %v, want the flush error %v", err, failure)
+	}
+	if result.Error != failure.Error() {
+		t.Errorf("result error %q, want %q", result.Error, failure.Error())
+	}
+	if dynamo.batches != 1 {
+		t.Errorf("%d batch writes, want 1", dynamo.batches)
+	}
+	if !strings.Contains(out.String(), "New listing") {
+		t.Errorf("the new listing was not alerted on before the flush:\n%s", out.String())
+	}
+}
+
+// recordingNotifier records the alerts sent through it as "kind:id", e.g.
+// "new:1". Alerts on the listings in fail return an error instead.
+type recordingNotifier struct {
+	*StdoutNotifier
+	mu   sync.Mutex
+	fail map[string]bool
+	sent []string
+}
+
+func newRecordingNotifier() *recordingNotifier {
+	return &recordingNotifier{StdoutNotifier: NewStdoutNotifier(io.Discard), fail: make(map[string]bool)}
+}
+
+func (n *recordingNotifier) record(kind string, listing Listing) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.fail[listing.ID] {
+		return errors.New("send failed")
+	}
+	n.sent = append(n.sent, kind+":"+listing.ID)
+	return nil
+}
+
+// alerts returns the alerts sent so far, sorted, and forgets them.
+func (n *recordingNotifier) alerts() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sent := n.sent
+	n.sent = nil
+	sort.Strings(sent)
+	return strings.Join(sent, ",")
+}
+
+func (n *recordingNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	return n.record("new", listing)
+}
+
+func (n *recordingNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.record("drop", listing)
+}
+
+func (n *recordingNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.record("increase", listing)
+}
+
+func TestRunSearchRetryAfterFailedSend(t *testing.T) {
+	defer func(v bool) { dryRun = v }(dryRun)
+	dryRun = false
+
+	search := Search{Name: "search", Params: url.Values{}}
+	dynamo := newFakeDynamo()
+	api := &fakeAPI{pages: map[int]Listings{
+		1: {Results: []Listing{{ID: "1"}, {ID: "2"}}, Paging: Paging{TotalRecords: 2, TotalPages: 1}},
+	}}
+	fetcher := &Fetcher{client: api, limiter: newRateLimiter(0)}
+	notify := newRecordingNotifier()
+	notify.fail["2"] = true
+
+	if _, err := runSearch(context.Background(), dynamo, fetcher, NewRunHistory(dynamo), nil, nil, nil, nil, nil, notify, search); err == nil {
+		t.Fatal("run with a failed alert succeeded")
+	}
+	if got := notify.alerts(); got != "new:1" {
+		t.Fatalf("first run sent %s, want new:1", got)
+	}
+
+	// Lambda retries the failed invocation.
+	delete(notify.fail, "2")
+	if _, err := runSearch(context.Background(), dynamo, fetcher, NewRunHistory(dynamo), nil, nil, nil, nil, nil, notify, search); err != nil {
+		t.Fatal(err)
+	}
+	if got := notify.alerts(); got != "new:2" {
+		t.Errorf("retry sent %s, want only the alert that failed, new:2", got)
+	}
+	if seen, ok := dynamo.stored(t, search.PartitionKey(), "1"); !ok || !seen.Notified {
+		t.Errorf("listing 1 on record as %+v, want notified", seen)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	metricListingsFetched       = "ListingsFetched"
+	metricNewListings           = "NewListings"
+	metricNotificationsSent     = "NotificationsSent"
+	metricNotificationErrors    = "NotificationErrors"
+	metricFetchDurationMs       = "FetchDurationMs"
+	metricHoursSinceLastSuccess = "HoursSinceLastSuccess"
+)
+
+// Metrics collects the values of one search run and publishes them as a
+// CloudWatch embedded metric format log line, dimensioned by search name.
+// Emission is best-effort: a metrics problem is logged and otherwise
+// ignored.
+type Metrics struct {
+	searchName string
+
+	mu     sync.Mutex
+	values map[string]float64
+	units  map[string]string
+}
+
+func NewMetrics(searchName string) *Metrics {
+	return &Metrics{
+		searchName: searchName,
+		values:     make(map[string]float64),
+		units:      make(map[string]string),
+	}
+}
+
+type metricsKey struct{}
+
+// withMetrics returns a context through which code further down the call
+// chain can record into m with addMetric.
+func withMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// addMetric adds value to the named metric of the run in ctx, if any.
+func addMetric(ctx context.Context, name string, value float64, unit string) {
+	if m, ok := ctx.Value(metricsKey{}).(*Metrics); ok {
+		m.Add(name, value, unit)
+	}
+}
+
+func countMetric(ctx context.Context, name string) {
+	addMetric(ctx, name, 1, "Count")
+}
+
+func (m *Metrics) Add(name string, value float64, unit string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[name] += value
+	m.units[name] = unit
+}
+
+// Emit writes the collected metrics to stdout, where the Lambda log agent
+// picks them up.
+func (m *Metrics) Emit(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type metric struct {
+		Name string
+		Unit string
+	}
+	var metrics []metric
+	line := map[string]interface{}{"SearchName": m.searchName}
+	for name, value := range m.values {
+		metrics = append(metrics, metric{Name: name, Unit: m.units[name]})
+		line[name] = value
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+
+	line["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []interface{}{map[string]interface{}{
+			"Namespace":  metricsNamespace,
+			"Dimensions": [][]string{{"SearchName"}},
+			"Metrics":    metrics,
+		}},
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to encode metrics", "error", err)
+		return
+	}
+	if _, err = fmt.Fprintln(os.Stdout, string(data)); err != nil {
+		slog.WarnContext(ctx, "Failed to emit metrics", "error", err)
+	}
+}
+
+// instrumentedNotifier counts the alerts sent and failed through it into
+// the metrics of the run in the context.
+type instrumentedNotifier struct {
+	next Notifier
+}
+
+func (n instrumentedNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	return n.count(ctx, n.next.SendListingAlert(ctx, listing))
+}
+
+func (n instrumentedNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.count(ctx, n.next.SendDigest(ctx, listings))
+}
+
+func (n instrumentedNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.count(ctx, n.next.SendPriceDropAlert(ctx, listing, oldPrice))
+}
+
+func (n instrumentedNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.count(ctx, n.next.SendPriceIncreaseAlert(ctx, listing, oldPrice))
+}
+
+func (n instrumentedNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return n.count(ctx, n.next.SendRemovedAlert(ctx, listing))
+}
+
+func (n instrumentedNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	return n.count(ctx, n.next.SendChangedAlert(ctx, listing, changes))
+}
+
+func (n instrumentedNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.count(ctx, n.next.SendHeartbeat(ctx, searchName, fetched, lastNotified))
+}
+
+func (n instrumentedNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.count(ctx, n.next.SendComparables(ctx, searchName, listings))
+}
+
+func (n instrumentedNotifier) count(ctx context.Context, err error) error {
+	if err != nil {
+		countMetric(ctx, metricNotificationErrors)
+	} else {
+		countMetric(ctx, metricNotificationsSent)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+const (
+	// defaultNearbyRadiusKm and maxNearbyRadiusKm bound the area of an
+	// on-demand search around the caller's coordinates.
+	defaultNearbyRadiusKm = 2
+	maxNearbyRadiusKm     = 50
+
+	// kmPerDegreeLatitude is near enough everywhere for a search box.
+	kmPerDegreeLatitude = 111.32
+)
+
+// nearby reports whether the event asks for the listings around a point
+// rather than a scheduled run.
+func (e Event) nearby() bool {
+	return e.Latitude != nil || e.Longitude != nil || e.Radius != 0
+}
+
+// validate checks the coordinates and radius of a nearby search.
+func (e Event) validate() error {
+	if e.Latitude == nil || e.Longitude == nil {
+		return errors.New("lat and lng must both be given")
+	}
+	if lat := *e.Latitude; math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("lat must be between -90 and 90, not %v", lat)
+	}
+	if lng := *e.Longitude; math.IsNaN(lng) || lng < -180 || lng > 180 {
+		return fmt.Errorf("lng must be between -180 and 180, not %v", lng)
+	}
+	if math.IsNaN(e.Radius) || e.Radius < 0 || e.Radius > maxNearbyRadiusKm {
+		return fmt.Errorf("radius must be between 0 and %d km, not %v", maxNearbyRadiusKm, e.Radius)
+	}
+	return nil
+}
+
+// box returns the bounding box reaching the event's radius from its
+// coordinates.
+func (e Event) box() BoundingBox {
+	radius, lat, lng := e.Radius, *e.Latitude, *e.Longitude
+	latDelta := radius / kmPerDegreeLatitude
+	// A degree of longitude shrinks towards the poles; near them, take in
+	// every longitude rather than divide by almost nothing.
+	lngDelta := 180.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > radius/(180*kmPerDegreeLatitude) {
+		lngDelta = math.Min(radius/(kmPerDegreeLatitude*cos), 180)
+	}
+	if lngDelta == 180 {
+		lng = 0
+	}
+	return BoundingBox{
+		LatitudeMin:  math.Max(lat-latDelta, -90),
+		LatitudeMax:  math.Min(lat+latDelta, 90),
+		LongitudeMin: math.Max(lng-lngDelta, -180),
+		LongitudeMax: math.Min(lng+lngDelta, 180),
+	}
+}
+
+// NearbyResult is what an on-demand search around a point returns to the
+// caller.
+type NearbyResult struct {
+	Latitude     float64       `json:"lat"`
+	Longitude    float64       `json:"lng"`
+	Radius       float64       `json:"radius"`
+	TotalRecords int           `json:"total_records"`
+	Listings     []jsonListing `json:"listings"`
+}
+
+// searchNearby fetches the listings matching the configured search inside
+// the event's area, filtered and ignored as alerts would be, and returns
+// them. It sends nothing and leaves the seen-listings cache alone.
+func searchNearby(ctx context.Context, fetcher *Fetcher, ignore *IgnoreList, event Event) (*NearbyResult, error) {
+	if err := event.validate(); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	if event.Radius == 0 {
+		event.Radius = defaultNearbyRadiusKm
+	}
+	params, err := buildPayload()
+	if err != nil {
+		return nil, fmt.Errorf("invalid search configuration: %w", err)
+	}
+	event.box().Apply(params)
+
+	listings, err := fetcher.FetchListings(ctx, Search{Params: params})
+	if err != nil {
+		return nil, err
+	}
+
+	filters := configuredFilters()
+	var matching []Listing
+	for _, listing := range listings.Results {
+		if ignore.Match(listing) == "" && filters.Reason(listing) == "" {
+			matching = append(matching, listing)
+		}
+	}
+	slog.InfoContext(ctx, fmt.Sprintf("Found %d listings nearby", len(matching)),
+		"action", "fetched", "count", len(matching), "total_records", listings.Paging.TotalRecords,
+		"lat", *event.Latitude, "lng", *event.Longitude, "radius", event.Radius)
+
+	return &NearbyResult{
+		Latitude:     *event.Latitude,
+		Longitude:    *event.Longitude,
+		Radius:       event.Radius,
+		TotalRecords: listings.Paging.TotalRecords,
+		Listings:     newJSONListings(matching),
+	}, nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Notifier delivers alerts about listings to one channel.
+type Notifier interface {
+	SendListingAlert(ctx context.Context, listing Listing) error
+	// SendDigest sends a single alert summarizing several new listings.
+	SendDigest(ctx context.Context, listings []Listing) error
+	// SendComparables sends a digest of listings in the search's area that
+	// sold recently, for pricing offers.
+	SendComparables(ctx context.Context, searchName string, listings []Listing) error
+	// SendPriceDropAlert notifies about an already seen listing whose
+	// price went down from oldPrice.
+	SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error
+	// SendPriceIncreaseAlert notifies about an already seen listing whose
+	// price went up from oldPrice.
+	SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error
+	// SendRemovedAlert notifies that a seen listing has dropped out of the
+	// search results, most likely because it sold or was delisted. Only
+	// the ID, search name and last known price of the listing are set.
+	SendRemovedAlert(ctx context.Context, listing Listing) error
+	// SendChangedAlert notifies that watched fields of a seen listing
+	// have changed since it was last recorded.
+	SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error
+	// SendHeartbeat tells that the search is still running but nothing
+	// has been alerted on since lastNotified. fetched is the number of
+	// listings the search found this time.
+	SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error
+}
+
+var (
+	_ Notifier = (*MultiNotifier)(nil)
+	_ Notifier = (*SNSNotifier)(nil)
+	_ Notifier = (*TelegramNotifier)(nil)
+	_ Notifier = (*SlackNotifier)(nil)
+	_ Notifier = (*SESNotifier)(nil)
+	_ Notifier = (*TwilioNotifier)(nil)
+	_ Notifier = (*WebhookNotifier)(nil)
+	_ Notifier = (*StdoutNotifier)(nil)
+)
+
+// notifierBackends lists the values NOTIFIER and NOTIFIERS may name.
+var notifierBackends = []string{"sns", "telegram", "slack", "ses", "twilio", "webhook", "stdout"}
+
+func validNotifierBackend(name string) bool {
+	for _, backend := range notifierBackends {
+		if name == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// NewNotifier returns the configured notifier: a MultiNotifier over the
+// backends listed in NOTIFIERS when that is set, otherwise the single
+// backend named by NOTIFIER.
+func NewNotifier(sess *session.Session, usage *Usage) (Notifier, error) {
+	if len(notifierBackendList) == 0 {
+		backend, err := newBackend(sess, notifierBackend)
+		if err != nil {
+			return nil, err
+		}
+		return countedNotifier{name: notifierBackend, next: backend, usage: usage}, nil
+	}
+
+	multi := &MultiNotifier{}
+	for _, name := range notifierBackendList {
+		backend, err := newBackend(sess, name)
+		if err != nil {
+			return nil, err
+		}
+		multi.names = append(multi.names, name)
+		multi.notifiers = append(multi.notifiers, countedNotifier{name: name, next: backend, usage: usage})
+	}
+	return multi, nil
+}
+
+// newBackend returns the backend called name: "sns", "telegram", "slack",
+// "ses", "twilio", "webhook" or "stdout".
+func newBackend(sess *session.Session, name string) (Notifier, error) {
+	switch name {
+	case "sns":
+		if snsTopicName == "" {
+			return nil, errors.New("SNS_TOPIC_NAME must be set for the sns notifier")
+		}
+		topicArn := "arn:aws:sns:" + *sess.Config.Region + ":" + awsAccountId + ":" + snsTopicName
+		return NewSNSNotifier(newSNSClient(sess, aws.NewConfig().WithMaxRetries(0)), topicArn, snsPriceTopics), nil
+	case "telegram":
+		token, chatID := os.Getenv("TELEGRAM_BOT_TOKEN"), os.Getenv("TELEGRAM_CHAT_ID")
+		if token == "" || chatID == "" {
+			return nil, errors.New("TELEGRAM_BOT_TOKEN and TELEGRAM_CHAT_ID must be set for the telegram notifier")
+		}
+		return NewTelegramNotifier(newHTTPClient(), token, chatID), nil
+	case "slack":
+		webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
+		if webhookURL == "" {
+			return nil, errors.New("SLACK_WEBHOOK_URL must be set for the slack notifier")
+		}
+		return NewSlackNotifier(newHTTPClient(), webhookURL), nil
+	case "ses":
+		from, to := os.Getenv("SES_FROM"), splitList(os.Getenv("SES_TO"))
+		if from == "" || len(to) == 0 {
+			return nil, errors.New("SES_FROM and SES_TO must be set for the ses notifier")
+		}
+		return NewSESNotifier(sess, from, to), nil
+	case "twilio":
+		accountSID, authToken := os.Getenv("TWILIO_ACCOUNT_SID"), os.Getenv("TWILIO_AUTH_TOKEN")
+		from, to := os.Getenv("TWILIO_FROM"), os.Getenv("TWILIO_TO")
+		if accountSID == "" || authToken == "" || from == "" || to == "" {
+			return nil, errors.New("TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN, TWILIO_FROM and TWILIO_TO must be set for the twilio notifier")
+		}
+		channel := envVar("TWILIO_CHANNEL", twilioChannelSMS)
+		if channel != twilioChannelSMS && channel != twilioChannelWhatsApp {
+			return nil, errors.New("unknown channel in TWILIO_CHANNEL: " + channel)
+		}
+		return NewTwilioNotifier(newHTTPClient(), accountSID, authToken, from, to, channel), nil
+	case "webhook":
+		webhookURL := os.Getenv("WEBHOOK_URL")
+		if webhookURL == "" {
+			return nil, errors.New("WEBHOOK_URL must be set for the webhook notifier")
+		}
+		headers, err := parseWebhookHeaders(os.Getenv("WEBHOOK_HEADERS"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_HEADERS: %w", err)
+		}
+		timeout := time.Duration(intEnvVar("WEBHOOK_TIMEOUT_SECONDS", int(httpTimeout/time.Second))) * time.Second
+		return NewWebhookNotifier(newHTTPClientWithTimeout(timeout), webhookURL, os.Getenv("WEBHOOK_SECRET"), headers), nil
+	case "stdout":
+		// Prints what the other backends would send, to check the formatting
+		// locally or in CI without any credentials.
+		return NewStdoutNotifier(os.Stdout), nil
+	default:
+		return nil, errors.New("unknown notifier: " + name)
+	}
+}
+
+// MultiNotifier fans every alert out to several backends. A backend
+// failing does not stop delivery to the others. An alert that reached at
+// least one backend counts as delivered, so that the run carries on and
+// the backends that got it are not sent it again; only when every backend
+// fails are the failures returned, joined together.
+type MultiNotifier struct {
+	names     []string
+	notifiers []Notifier
+}
+
+func (m *MultiNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendListingAlert(ctx, listing) })
+}
+
+func (m *MultiNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendDigest(ctx, listings) })
+}
+
+func (m *MultiNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendComparables(ctx, searchName, listings) })
+}
+
+func (m *MultiNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendPriceDropAlert(ctx, listing, oldPrice) })
+}
+
+func (m *MultiNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendPriceIncreaseAlert(ctx, listing, oldPrice) })
+}
+
+func (m *MultiNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendRemovedAlert(ctx, listing) })
+}
+
+func (m *MultiNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendChangedAlert(ctx, listing, changes) })
+}
+
+func (m *MultiNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return m.each(ctx, func(n Notifier) error { return n.SendHeartbeat(ctx, searchName, fetched, lastNotified) })
+}
+
+func (m *MultiNotifier) each(ctx context.Context, send func(Notifier) error) error {
+	var errs []error
+	var delivered []string
+	for i, n := range m.notifiers {
+		if err := send(n); err != nil {
+			slog.ErrorContext(ctx, "Notifier failed", "notifier", m.names[i], "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", m.names[i], err))
+			continue
+		}
+		delivered = append(delivered, m.names[i])
+	}
+	if len(errs) > 0 && len(delivered) > 0 {
+		slog.WarnContext(ctx, "Alert partially delivered", "delivered", delivered, "error", errors.Join(errs...))
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// The plain-text formats below are shared by backends without richer
+// formatting of their own.
+
+func listingSubject(listing Listing) string {
+	if subject, ok := renderTemplate(subjectTemplate, listing); ok {
+		return subject
+	}
+	var details []string
+	if listing.Address != "" {
+		details = append(details, listing.Address)
+	}
+	if price := listing.DisplayPrice(); price != "" {
+		details = append(details, price)
+	}
+	kind := "New listing for sale"
+	if listing.ForRent {
+		kind = "New listing for rent"
+	}
+	if len(details) == 0 {
+		return searchPrefix(listing) + kind + " on Realtor.ca"
+	}
+	return searchPrefix(listing) + kind + ": " + strings.Join(details, " - ")
+}
+
+func listingMessage(listing Listing) string {
+	if message, ok := customBody(formatPlain, listing); ok {
+		return message
+	}
+	message := listing.URL()
+	if mapURL := listing.MapURL(); mapURL != "" {
+		message += "\nMap: " + mapURL
+	}
+	if listing.TourURL != "" {
+		message += "\nVirtual tour: " + listing.TourURL
+	}
+	if agent := listing.AgentText(); agent != "" {
+		message = agent + "\n" + message
+	}
+	if openHouse := listing.OpenHouseText(); openHouse != "" {
+		message = openHouse + "\n" + message
+	}
+	if commute := listing.CommuteText(); commute != "" {
+		message = commute + "\n" + message
+	}
+	if age := listing.AgeText(); age != "" {
+		message = age + "\n" + message
+	}
+	if parking := listing.ParkingText(); parking != "" {
+		message = parking + "\n" + message
+	}
+	if fee := listing.CondoFeeText(); fee != "" {
+		message = fee + "\n" + message
+	}
+	if lot := listing.LotText(); lot != "" {
+		message = lot + "\n" + message
+	}
+	if rooms := listing.Rooms(); rooms != "" {
+		message = rooms + "\n" + message
+	}
+	if price := listing.DisplayPriceDetails(); price != "" {
+		message = price + "\n" + message
+	}
+	message = listing.TransactionLabel() + "\n" + message
+	if listing.PhotoURL != "" {
+		message += "\nPhoto: " + listing.PhotoURL
+	}
+	return message
+}
+
+func digestSubject(listings []Listing) string {
+	subject := strconv.Itoa(len(listings)) + " new listings on Realtor.ca"
+	if len(listings) == 1 {
+		subject = "1 new listing on Realtor.ca"
+	}
+	return searchPrefix(listings[0]) + subject
+}
+
+// digestMessage lists the listings one per line, keeping the message
+// within maxLength bytes. Listings that do not fit are only counted.
+func digestMessage(listings []Listing, maxLength int) string {
+	var out strings.Builder
+	for i, listing := range listings {
+		var details []string
+		if price := listing.DisplayPrice(); price != "" {
+			details = append(details, price)
+		}
+		if listing.Address != "" {
+			details = append(details, listing.Address)
+		}
+		details = append(details, listing.URL())
+		entry := "- " + newMarker(listing) + strings.Join(details, ", ") + "\n"
+
+		more := "...and " + strconv.Itoa(len(listings)-i) + " more\n"
+		if out.Len()+len(entry)+len(more) > maxLength {
+			out.WriteString(more)
+			break
+		}
+		out.WriteString(entry)
+	}
+	return out.String()
+}
+
+// newMarker tags the listings of a digest that are new since the last run
+// from those carried over.
+func newMarker(listing Listing) string {
+	if listing.NewThisRun {
+		return "NEW "
+	}
+	return ""
+}
+
+func comparablesSubject(searchName string, listings []Listing) string {
+	return searchPrefix(Listing{SearchName: searchName}) + strconv.Itoa(len(listings)) + " recent sales nearby"
+}
+
+func priceDropSubject(listing Listing) string {
+	subject := searchPrefix(listing) + "Price reduced: " + listing.DisplayPrice()
+	if listing.Address != "" {
+		subject += " - " + listing.Address
+	}
+	return subject
+}
+
+func priceChangeMessage(listing Listing, oldPrice int) string {
+	return priceChange(listing, oldPrice) + "\n" + listing.URL()
+}
+
+func priceIncreaseSubject(listing Listing) string {
+	subject := searchPrefix(listing) + "Price raised: " + listing.DisplayPrice()
+	if listing.Address != "" {
+		subject += " - " + listing.Address
+	}
+	return subject
+}
+
+// priceChange reads e.g. "Price reduced from $500,000 to $480,000
+// (-$20,000)", or "raised" with a "+" for an increase.
+func priceChange(listing Listing, oldPrice int) string {
+	if listing.PriceAmount > oldPrice {
+		return "Price raised from " + formatDollars(oldPrice) +
+			" to " + formatDollars(listing.PriceAmount) +
+			" (+" + formatDollars(listing.PriceAmount-oldPrice) + ")"
+	}
+	return "Price reduced from " + formatDollars(oldPrice) +
+		" to " + formatDollars(listing.PriceAmount) +
+		" (-" + formatDollars(oldPrice-listing.PriceAmount) + ")"
+}
+
+func removedSubject(listing Listing) string {
+	return searchPrefix(listing) + "Listing removed from Realtor.ca"
+}
+
+func removedMessage(listing Listing) string {
+	message := "Listing " + listing.ID + " is no longer in the search results."
+	if listing.PriceAmount > 0 {
+		message += "\nLast known price: " + formatDollars(listing.PriceAmount)
+	}
+	return message
+}
+
+func changedSubject(listing Listing) string {
+	return searchPrefix(listing) + "Listing updated: " + headline(listing)
+}
+
+func changedMessage(listing Listing, changes []FieldChange) string {
+	return changeList(changes) + "\n" + listing.URL()
+}
+
+// changeList describes the changes one per line.
+func changeList(changes []FieldChange) string {
+	lines := make([]string, len(changes))
+	for i, change := range changes {
+		lines[i] = change.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func heartbeatSubject(searchName string) string {
+	return searchPrefix(Listing{SearchName: searchName}) + "Still watching Realtor.ca"
+}
+
+func heartbeatMessage(fetched int, lastNotified time.Time) string {
+	hours := int(time.Since(lastNotified).Hours())
+	since := strconv.Itoa(hours) + " hours"
+	if hours >= 48 {
+		since = strconv.Itoa(hours/24) + " days"
+	}
+	return "Nothing new in the last " + since + ". The search currently matches " + strconv.Itoa(fetched) + " listings."
+}
+
+// headline names the listing by its address, when known.
+func headline(listing Listing) string {
+	if listing.Address != "" {
+		return listing.Address
+	}
+	return "New listing on Realtor.ca"
+}
+
+// searchPrefix tags alerts from named searches with the search name.
+func searchPrefix(listing Listing) string {
+	if listing.SearchName == "" {
+		return ""
+	}
+	return "[" + listing.SearchName + "] "
+}
+
+// truncate shortens s to at most max bytes without splitting a UTF-8
+// sequence.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMultiNotifier(t *testing.T) {
+	ctx := context.Background()
+	first, second := newRecordingNotifier(), newRecordingNotifier()
+	multi := &MultiNotifier{names: []string{"first", "second"}, notifiers: []Notifier{first, second}}
+
+	second.fail["1"] = true
+	if err := multi.SendListingAlert(ctx, Listing{ID: "1"}); err != nil {
+		t.Errorf("partly delivered alert failed: %v", err)
+	}
+	if got := first.alerts(); got != "new:1" {
+		t.Errorf("first backend got %q, want new:1", got)
+	}
+
+	first.fail["1"] = true
+	err := multi.SendListingAlert(ctx, Listing{ID: "1"})
+	if err == nil || !strings.Contains(err.Error(), "first:") || !strings.Contains(err.Error(), "second:") {
+		t.Errorf("alert no backend delivered gave error %v, want both failures", err)
+	}
+}
+
+func TestRunSearchPartialDelivery(t *testing.T) {
+	defer func(v bool) { dryRun = v }(dryRun)
+	dryRun = false
+
+	search := Search{Name: "search", Params: url.Values{}}
+	dynamo := newFakeDynamo()
+	api := &fakeAPI{pages: map[int]Listings{
+		1: {Results: []Listing{{ID: "1"}}, Paging: Paging{TotalRecords: 1, TotalPages: 1}},
+	}}
+	fetcher := &Fetcher{client: api, limiter: newRateLimiter(0)}
+	working, failing := newRecordingNotifier(), newRecordingNotifier()
+	failing.fail["1"] = true
+	multi := &MultiNotifier{names: []string{"working", "failing"}, notifiers: []Notifier{working, failing}}
+
+	for run := 1; run <= 2; run++ {
+		if _, err := runSearch(context.Background(), dynamo, fetcher, NewRunHistory(dynamo), nil, nil, nil, nil, nil, multi, search); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+	if got := working.alerts(); got != "new:1" {
+		t.Errorf("working backend got %q over two runs, want new:1 once", got)
+	}
+	if seen, ok := dynamo.stored(t, search.PartitionKey(), "1"); !ok || !seen.Notified {
+		t.Errorf("listing 1 on record as %+v, want notified", seen)
+	}
+}
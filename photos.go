@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultPhotosPrefix = "photos"
+
+	// photoMaxBytes bounds the size of a photo copied to S3; realtor.ca's
+	// high resolution photos are well under it.
+	photoMaxBytes = 10 << 20
+)
+
+var (
+	// photosBucket, when set, has the first photo of each listing alerted on
+	// copied to <photosPrefix>/<listing ID>.jpg in it, and the copy used in
+	// notifications instead of realtor.ca's URL, which may expire or refuse
+	// hotlinking.
+	photosBucket string
+	photosPrefix string
+
+	// photosBaseURL is the public URL the photos prefix is served from,
+	// e.g. a CloudFront distribution, when the bucket's policy makes it
+	// readable. Without it the copies are uploaded public-read and linked
+	// straight from S3.
+	photosBaseURL string
+)
+
+// PhotoCache keeps copies of listing photos in S3.
+type PhotoCache struct {
+	client  httpClient
+	s3      s3API
+	bucket  string
+	prefix  string
+	baseURL string
+}
+
+func NewPhotoCache(client httpClient, s3Client s3API, bucket, prefix, baseURL string) *PhotoCache {
+	return &PhotoCache{client: client, s3: s3Client, bucket: bucket, prefix: prefix, baseURL: baseURL}
+}
+
+// URL returns the URL of the copy of the listing's photo, copying it to S3
+// first if it is not there yet.
+func (c *PhotoCache) URL(ctx context.Context, listing Listing) (string, error) {
+	key := path.Join(c.prefix, listing.ID+".jpg")
+	_, err := c.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return c.objectURL(key), nil
+	}
+	var failure awserr.RequestFailure
+	if !errors.As(err, &failure) || failure.StatusCode() != http.StatusNotFound {
+		return "", err
+	}
+
+	data, contentType, err := c.download(ctx, listing.PhotoURL)
+	if err != nil {
+		return "", err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String(contentType),
+		CacheControl: aws.String("public, max-age=31536000"),
+	}
+	if c.baseURL == "" {
+		input.ACL = aws.String(s3.ObjectCannedACLPublicRead)
+	}
+	if _, err = c.s3.PutObjectWithContext(ctx, input); err != nil {
+		return "", err
+	}
+	return c.objectURL(key), nil
+}
+
+func (c *PhotoCache) download(ctx context.Context, photoURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", photoURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	response, err := c.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("photo download failed with HTTP %d", response.StatusCode)
+	}
+	contentType := response.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("photo download returned %q rather than an image", contentType)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, photoMaxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > photoMaxBytes {
+		return nil, "", fmt.Errorf("photo is over %d bytes", photoMaxBytes)
+	}
+	return data, contentType, nil
+}
+
+func (c *PhotoCache) objectURL(key string) string {
+	escaped := (&url.URL{Path: key}).EscapedPath()
+	if c.baseURL != "" {
+		return strings.TrimSuffix(c.baseURL, "/") + "/" + escaped
+	}
+	return "https://" + c.bucket + ".s3." + awsRegion + ".amazonaws.com/" + escaped
+}
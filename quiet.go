@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// quietHours, when set, holds back new-listing alerts between its start
+// and end: the listings found are queued as for a digest, and sent as one
+// by the first run after the window closes.
+var quietHours *QuietHours
+
+// QuietHours is a daily window of local time, which may cross midnight.
+type QuietHours struct {
+	// Start and End are minutes after midnight in Location.
+	Start, End int
+	Location   *time.Location
+}
+
+// parseQuietHours reads a window such as "22:00-07:00" in location.
+func parseQuietHours(v string, location *time.Location) (*QuietHours, error) {
+	startText, endText, ok := strings.Cut(v, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected a window such as 22:00-07:00, not %q", v)
+	}
+	start, err := parseClock(startText)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(endText)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("window %q is empty", v)
+	}
+	return &QuietHours{Start: start, End: end, Location: location}, nil
+}
+
+// parseClock reads a time of day as "HH:MM" into minutes after midnight.
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls in the window, its start included and
+// its end not.
+func (q *QuietHours) Contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	local := t.In(q.Location)
+	minute := local.Hour()*60 + local.Minute()
+	if q.Start < q.End {
+		return minute >= q.Start && minute < q.End
+	}
+	// The window crosses midnight.
+	return minute >= q.Start || minute < q.End
+}
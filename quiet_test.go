@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursContains(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, time.July, 14, hour, minute, 0, 0, toronto)
+	}
+
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		// Crossing midnight.
+		{"22:00-07:00", at(21, 59), false},
+		{"22:00-07:00", at(22, 0), true},
+		{"22:00-07:00", at(23, 30), true},
+		{"22:00-07:00", at(0, 0), true},
+		{"22:00-07:00", at(6, 59), true},
+		{"22:00-07:00", at(7, 0), false},
+		{"22:00-07:00", at(12, 0), false},
+		// Within a day.
+		{"09:00-17:00", at(8, 59), false},
+		{"09:00-17:00", at(9, 0), true},
+		{"09:00-17:00", at(12, 0), true},
+		{"09:00-17:00", at(16, 59), true},
+		{"09:00-17:00", at(17, 0), false},
+		{"09:00-17:00", at(23, 0), false},
+		// Times in another zone are read in the window's: 02:30 UTC is
+		// 22:30 in Toronto in the summer, and 13:00 UTC is 09:00.
+		{"22:00-07:00", time.Date(2026, time.July, 14, 2, 30, 0, 0, time.UTC), true},
+		{"22:00-07:00", time.Date(2026, time.July, 14, 12, 0, 0, 0, time.UTC), false},
+		{"09:00-17:00", time.Date(2026, time.July, 14, 13, 0, 0, 0, time.UTC), true},
+		{"09:00-17:00", time.Date(2026, time.July, 14, 21, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		q, err := parseQuietHours(tt.window, toronto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.Contains(tt.t); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.window, tt.t.Format(time.RFC3339), got, tt.want)
+		}
+	}
+
+	var unset *QuietHours
+	if unset.Contains(at(23, 0)) {
+		t.Error("no quiet hours contain a time")
+	}
+}
+
+func TestParseQuietHours(t *testing.T) {
+	for _, v := range []string{"", "22:00", "22:00-22:00", "25:00-07:00", "22:00-7", "late-early"} {
+		if _, err := parseQuietHours(v, time.UTC); err == nil {
+			t.Errorf("parseQuietHours(%q) accepted an invalid window", v)
+		}
+	}
+	q, err := parseQuietHours(" 22:30 - 06:15 ", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Start != 22*60+30 || q.End != 6*60+15 {
+		t.Errorf("parsed %d-%d, want %d-%d", q.Start, q.End, 22*60+30, 6*60+15)
+	}
+}
+
+func TestQueueDigestQuietHours(t *testing.T) {
+	defer func(q *QuietHours) { quietHours = q }(quietHours)
+	defer func(v bool) { dryRun = v }(dryRun)
+	dryRun = false
+	// A window around now, so the run is always in it.
+	now := time.Now().UTC()
+	quietHours = &QuietHours{
+		Start:    (now.Hour()*60 + now.Minute() + 23*60) % (24 * 60),
+		End:      (now.Hour()*60 + now.Minute() + 60) % (24 * 60),
+		Location: time.UTC,
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantSent bool
+	}{
+		{name: "scheduled run", ctx: context.Background(), wantSent: false},
+		{name: "forced run", ctx: withForce(context.Background()), wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			dynamo := newFakeDynamo()
+			r := &searchRun{
+				search: Search{Name: "search"},
+				db:     NewDB(dynamo, "search"),
+				queue:  NewDigestQueue(dynamo, "search"),
+				notify: NewStdoutNotifier(&out),
+				logger: testLogger(),
+			}
+
+			if err := r.queueDigest(tt.ctx, []Listing{{ID: "1", RelativeDetailsURL: "/real-estate/1/a"}}); err != nil {
+				t.Fatal(err)
+			}
+			if sent := out.Len() > 0; sent != tt.wantSent {
+				t.Errorf("digest sent = %v, want %v", sent, tt.wantSent)
+			}
+			pending, _, err := r.queue.Pending(tt.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held := len(pending) > 0; held == tt.wantSent {
+				t.Errorf("%d listings left queued, want them held only when not sent", len(pending))
+			}
+		})
+	}
+}
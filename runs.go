@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// dynamoRunsPartitionKey prefixes the partitions holding each search's run
+// history, keyed by run start time. They are kept apart from the seen
+// listings so reading those does not drag the history along.
+const dynamoRunsPartitionKey = "runs"
+
+// RunSummary is the record of one run of a search.
+type RunSummary struct {
+	PartitionKey string `dynamodbav:"partition_key"`
+	// StartedAt is the run's start time in RFC 3339, which sorts in time
+	// order.
+	StartedAt  string `dynamodbav:"listing_id"`
+	SearchName string `dynamodbav:"search_name,omitempty"`
+	Fetched    int    `dynamodbav:"fetched"`
+	New        int    `dynamodbav:"new"`
+	Notified   int    `dynamodbav:"notified"`
+	// Error is why the run failed, or empty if it succeeded.
+	Error string `dynamodbav:"error,omitempty"`
+	// TTL expires the record after SEEN_TTL_DAYS, like the seen listings.
+	TTL int64 `dynamodbav:"ttl,omitempty"`
+}
+
+// Time returns when the run started.
+func (s *RunSummary) Time() time.Time {
+	t, _ := time.Parse(time.RFC3339, s.StartedAt)
+	return t
+}
+
+// RunResult is what a scheduled run returns to its invoker: the totals of
+// every search, each search's own, and the errors that failed any of them.
+type RunResult struct {
+	Fetched  int            `json:"fetched"`
+	New      int            `json:"new"`
+	Notified int            `json:"notified"`
+	DryRun   bool           `json:"dry_run,omitempty"`
+	Forced   bool           `json:"forced,omitempty"`
+	Searches []SearchResult `json:"searches"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+// SearchResult sums up one search's part of a run.
+type SearchResult struct {
+	Name     string `json:"name,omitempty"`
+	Fetched  int    `json:"fetched"`
+	New      int    `json:"new"`
+	Notified int    `json:"notified"`
+	// Skipped is set for a search not run for lack of runtime budget.
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// add records the result of the i-th search.
+func (r *RunResult) add(i int, search SearchResult) {
+	r.Searches[i] = search
+	r.Fetched += search.Fetched
+	r.New += search.New
+	r.Notified += search.Notified
+}
+
+// RunHistory stores and reads back run summaries.
+type RunHistory struct {
+	dynamo dynamoAPI
+}
+
+func NewRunHistory(dynamo dynamoAPI) *RunHistory {
+	return &RunHistory{dynamo: dynamo}
+}
+
+func runsPartitionKey(searchName string) string {
+	if searchName == "" {
+		return dynamoRunsPartitionKey
+	}
+	return dynamoRunsPartitionKey + "#" + searchName
+}
+
+// Record stores the summary of a run that started at startedAt.
+func (h *RunHistory) Record(ctx context.Context, startedAt time.Time, summary RunSummary) error {
+	summary.PartitionKey = runsPartitionKey(summary.SearchName)
+	summary.StartedAt = startedAt.UTC().Format(time.RFC3339)
+	summary.TTL = expiry()
+
+	item, err := dynamodbattribute.MarshalMap(summary)
+	if err != nil {
+		return err
+	}
+	_, err = h.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dynamoTableName),
+	})
+	return err
+}
+
+// LastSuccess returns the latest successful run of a search, or nil if
+// there is none on record.
+func (h *RunHistory) LastSuccess(ctx context.Context, searchName string) (*RunSummary, error) {
+	var (
+		last         *RunSummary
+		unmarshalErr error
+	)
+	err := h.dynamo.QueryPagesWithContext(
+		ctx,
+		&dynamodb.QueryInput{
+			KeyConditionExpression: aws.String("#pk = :pk"),
+			FilterExpression:       aws.String("attribute_not_exists(#err)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#pk":  aws.String(dynamoPartitionKeyName),
+				"#err": aws.String("error")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pk": {S: aws.String(runsPartitionKey(searchName))}},
+			ScanIndexForward: aws.Bool(false),
+			TableName:        aws.String(dynamoTableName),
+		},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			if len(page.Items) == 0 {
+				return true
+			}
+			last = &RunSummary{}
+			unmarshalErr = dynamodbattribute.UnmarshalMap(page.Items[0], last)
+			return false
+		})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return last, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Search is one saved search. Params are sent to the API as they are; a
+// search loaded from configuration starts from the default parameters and
+// overrides only the ones it names.
+type Search struct {
+	Name   string
+	Params url.Values
+
+	// Mode is searchModeAlerts to alert on each new listing or
+	// searchModeDigest to send them as a digest. When empty, DIGEST_MODE
+	// decides.
+	Mode string
+	// DigestInterval, in digest mode, collects the new listings of every
+	// run into one digest sent at most this often, instead of one digest
+	// per run.
+	DigestInterval time.Duration
+}
+
+const (
+	searchModeAlerts = "alerts"
+	searchModeDigest = "digest"
+)
+
+// digestIntervals are the names DigestEvery may use besides a Go duration
+// such as "12h".
+var digestIntervals = map[string]time.Duration{
+	"run":    0,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Digest reports whether the search sends its new listings as a digest.
+func (s Search) Digest() bool {
+	switch s.Mode {
+	case searchModeDigest:
+		return true
+	case searchModeAlerts:
+		return false
+	}
+	return digestMode
+}
+
+// PartitionKey returns the DynamoDB partition holding the listings seen by
+// this search. The unnamed default search keeps the original partition.
+func (s Search) PartitionKey() string {
+	if s.Name == "" {
+		return dynamoPartitionKeyValue
+	}
+	return dynamoPartitionKeyValue + "#" + s.Name
+}
+
+func (s *Search) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Name        string
+		Params      map[string]string
+		Mode        string
+		DigestEvery string
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Name == "" {
+		return errors.New("search is missing a name")
+	}
+	switch raw.Mode {
+	case "", searchModeAlerts, searchModeDigest:
+	default:
+		return fmt.Errorf("search %q has unknown Mode %q, expected alerts or digest", raw.Name, raw.Mode)
+	}
+	if raw.DigestEvery != "" {
+		interval, ok := digestIntervals[raw.DigestEvery]
+		if !ok {
+			var err error
+			if interval, err = time.ParseDuration(raw.DigestEvery); err != nil || interval < 0 {
+				return fmt.Errorf("search %q has invalid DigestEvery %q, expected run, daily, weekly or a duration", raw.Name, raw.DigestEvery)
+			}
+		}
+		if raw.Mode != searchModeDigest {
+			return fmt.Errorf("search %q sets DigestEvery without Mode digest", raw.Name)
+		}
+		s.DigestInterval = interval
+	}
+
+	s.Name = raw.Name
+	s.Mode = raw.Mode
+	s.Params = url.Values{}
+	for k, v := range raw.Params {
+		s.Params.Set(k, v)
+	}
+	return nil
+}
+
+// loadSearches returns the configured searches: a JSON list from the
+// SEARCHES environment variable, or from the S3 object named by
+// SEARCHES_S3_URI ("s3://bucket/key"). Without either, the default search
+// parameters are the only search. SEARCH_PLACE, when set, replaces the
+// default bounding box with the area of the named place. Rental searches
+// get the rentalDefaults unless they name their own values.
+func loadSearches(ctx context.Context, sess *session.Session) ([]Search, error) {
+	defaults, err := buildPayload()
+	if err != nil {
+		return nil, fmt.Errorf("invalid search configuration: %w", err)
+	}
+
+	if searchPlace != "" {
+		geocoder := NewGeocoder(newHTTPClient(), newDynamoClient(sess))
+		box, err := geocoder.BoundingBox(ctx, searchPlace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to geocode SEARCH_PLACE %q: %w", searchPlace, err)
+		}
+		box.Apply(defaults)
+	}
+
+	var data []byte
+	switch {
+	case searchesJSON != "":
+		data = []byte(searchesJSON)
+	case searchesS3URI != "":
+		if data, err = readS3Object(ctx, sess, searchesS3URI); err != nil {
+			return nil, err
+		}
+	default:
+		return []Search{{Params: defaults}}, nil
+	}
+
+	var searches []Search
+	if err := json.Unmarshal(data, &searches); err != nil {
+		return nil, err
+	}
+	if len(searches) == 0 {
+		return nil, errors.New("no searches configured")
+	}
+	names := make(map[string]bool)
+	for i, search := range searches {
+		if names[search.Name] {
+			return nil, errors.New("duplicate search name: " + search.Name)
+		}
+		names[search.Name] = true
+
+		params := url.Values{}
+		for k, v := range defaults {
+			params[k] = v
+		}
+		// A rental search among purchase defaults starts from the rental
+		// ones, so it does not inherit a purchase price range.
+		if search.Params.Get("TransactionTypeId") == transactionTypeForRent && defaults.Get("TransactionTypeId") != transactionTypeForRent {
+			applyRentalDefaults(params)
+		}
+		for k, v := range search.Params {
+			params[k] = v
+		}
+		if err = validateSearchParams(params); err != nil {
+			return nil, fmt.Errorf("invalid search %q: %w", search.Name, err)
+		}
+		searches[i].Params = params
+	}
+	return searches, nil
+}
+
+func readS3Object(ctx context.Context, sess *session.Session, uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, errors.New("not an s3:// URI: " + uri)
+	}
+
+	object, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	return ioutil.ReadAll(object.Body)
+}
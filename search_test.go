@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLoadSearchesRentalDefaults(t *testing.T) {
+	for _, key := range []string{"TRANSACTION_TYPE", "SORT", "PRICE_MIN", "PRICE_MAX"} {
+		t.Setenv(key, "")
+	}
+	defer func(v string) { searchesJSON = v }(searchesJSON)
+	searchesJSON = `[
+		{"Name": "homes"},
+		{"Name": "rentals", "Params": {"TransactionTypeId": "3"}},
+		{"Name": "lofts", "Params": {"TransactionTypeId": "3", "PriceMax": "4000", "Sort": "6-D"}}
+	]`
+
+	searches, err := loadSearches(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][3]string{
+		"homes":   {"539000", "701000", sortNewest},
+		"rentals": {"1500", "3000", sortCheapest},
+		"lofts":   {"1500", "4000", sortNewest},
+	}
+	for _, search := range searches {
+		got := [3]string{search.Params.Get("PriceMin"), search.Params.Get("PriceMax"), search.Params.Get("Sort")}
+		if got != want[search.Name] {
+			t.Errorf("search %s has PriceMin, PriceMax and Sort %v, want %v", search.Name, got, want[search.Name])
+		}
+	}
+}
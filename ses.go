@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// SESNotifier emails alerts as HTML through Amazon SES.
+type SESNotifier struct {
+	ses  *ses.SES
+	from string
+	to   []string
+}
+
+func NewSESNotifier(sess *session.Session, from string, to []string) *SESNotifier {
+	return &SESNotifier{
+		ses:  ses.New(sess),
+		from: from,
+		to:   to,
+	}
+}
+
+type sesEmail struct {
+	Title    string
+	Message  string
+	Listings []Listing
+}
+
+var sesTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 600px">
+<h2>{{.Title}}</h2>
+{{with .Message}}<p>{{.}}</p>{{end}}
+{{range .Listings}}
+<div style="margin-bottom: 32px">
+  {{with .PhotoURL}}<img src="{{.}}" alt="" style="width: 100%; max-width: 600px"><br>{{end}}
+  <h3 style="margin-bottom: 4px">{{if .NewThisRun}}<span style="color: #c00">NEW</span> {{end}}{{if .Address}}{{.Address}}{{else}}Listing {{.ID}}{{end}}</h3>
+  <p style="margin: 4px 0; color: #666">{{.TransactionLabel}}</p>
+  {{with .DisplayPriceDetails}}<p style="font-size: 20px; margin: 4px 0">{{.}}</p>{{end}}
+  {{with .Rooms}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .LotText}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .ParkingText}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .CondoFeeText}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .AgeText}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .OpenHouseText}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .CommuteText}}<p style="margin: 4px 0">{{.}}</p>{{end}}
+  {{with .AgentText}}<p style="margin: 4px 0; color: #666">{{.}}</p>{{end}}
+  <p><a href="{{.URL}}" style="display: inline-block; padding: 10px 16px; background: #c00; color: #fff; text-decoration: none; border-radius: 4px">View on Realtor.ca</a>{{with .MapURL}} <a href="{{.}}" style="margin-left: 12px">Map</a>{{end}}{{with .TourURL}} <a href="{{.}}" style="margin-left: 12px">Virtual tour</a>{{end}}</p>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+func (n *SESNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	if html, ok := customBody(formatHTML, listing); ok {
+		return n.sendHTML(ctx, listingSubject(listing), listingMessage(listing), html)
+	}
+	return n.send(ctx, listingSubject(listing), listingMessage(listing), sesEmail{
+		Title:    listingSubject(listing),
+		Listings: []Listing{listing},
+	})
+}
+
+func (n *SESNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.send(ctx, digestSubject(listings), digestMessage(listings, snsMaxMessageLength), sesEmail{
+		Title:    digestSubject(listings),
+		Listings: listings,
+	})
+}
+
+func (n *SESNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	subject := comparablesSubject(searchName, listings)
+	return n.send(ctx, subject, digestMessage(listings, snsMaxMessageLength), sesEmail{
+		Title:    subject,
+		Listings: listings,
+	})
+}
+
+func (n *SESNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.send(ctx, priceDropSubject(listing), priceChangeMessage(listing, oldPrice), sesEmail{
+		Title:    priceDropSubject(listing),
+		Message:  priceChange(listing, oldPrice),
+		Listings: []Listing{listing},
+	})
+}
+
+func (n *SESNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.send(ctx, priceIncreaseSubject(listing), priceChangeMessage(listing, oldPrice), sesEmail{
+		Title:    priceIncreaseSubject(listing),
+		Message:  priceChange(listing, oldPrice),
+		Listings: []Listing{listing},
+	})
+}
+
+func (n *SESNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return n.send(ctx, removedSubject(listing), removedMessage(listing), sesEmail{
+		Title:   removedSubject(listing),
+		Message: removedMessage(listing),
+	})
+}
+
+func (n *SESNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	return n.send(ctx, changedSubject(listing), changedMessage(listing, changes), sesEmail{
+		Title:    changedSubject(listing),
+		Message:  changeList(changes),
+		Listings: []Listing{listing},
+	})
+}
+
+func (n *SESNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.send(ctx, heartbeatSubject(searchName), heartbeatMessage(fetched, lastNotified), sesEmail{
+		Title:   heartbeatSubject(searchName),
+		Message: heartbeatMessage(fetched, lastNotified),
+	})
+}
+
+// send emails the rendered HTML along with text as the plain-text part.
+func (n *SESNotifier) send(ctx context.Context, subject, text string, email sesEmail) error {
+	var html strings.Builder
+	if err := sesTemplate.Execute(&html, email); err != nil {
+		return err
+	}
+	return n.sendHTML(ctx, subject, text, html.String())
+}
+
+func (n *SESNotifier) sendHTML(ctx context.Context, subject, text, html string) error {
+	_, err := n.ses.SendEmailWithContext(ctx, &ses.SendEmailInput{
+		Source:      aws.String(n.from),
+		Destination: &ses.Destination{ToAddresses: aws.StringSlice(n.to)},
+		Message: &ses.Message{
+			Subject: &ses.Content{Charset: aws.String("UTF-8"), Data: aws.String(subject)},
+			Body: &ses.Body{
+				Html: &ses.Content{Charset: aws.String("UTF-8"), Data: aws.String(html)},
+				Text: &ses.Content{Charset: aws.String("UTF-8"), Data: aws.String(text)},
+			},
+		},
+	})
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Slack allows at most 50 blocks per message and 150 characters in a
+	// header.
+	slackMaxBlocks       = 50
+	slackMaxHeaderLength = 150
+)
+
+// SlackNotifier posts Block Kit messages to a Slack incoming webhook.
+type SlackNotifier struct {
+	client     httpClient
+	webhookURL string
+}
+
+func NewSlackNotifier(client httpClient, webhookURL string) *SlackNotifier {
+	return &SlackNotifier{client: client, webhookURL: webhookURL}
+}
+
+type slackBlock map[string]interface{}
+
+func (n *SlackNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	blocks := []slackBlock{slackHeader(searchPrefix(listing) + headline(listing))}
+	if text, ok := customBody(formatMarkdown, listing); ok {
+		blocks = append(blocks, slackSection(text))
+	} else if fields := slackListingFields(listing); len(fields) > 0 {
+		blocks = append(blocks, slackBlock{"type": "section", "fields": fields})
+	}
+	if listing.PhotoURL != "" {
+		blocks = append(blocks, slackBlock{"type": "image", "image_url": listing.PhotoURL, "alt_text": headline(listing)})
+	}
+	blocks = append(blocks, slackButton(listing))
+	return n.post(ctx, listingSubject(listing), blocks)
+}
+
+func (n *SlackNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.postList(ctx, digestSubject(listings), listings)
+}
+
+func (n *SlackNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.postList(ctx, comparablesSubject(searchName, listings), listings)
+}
+
+// postList posts a titled list of listings, cut short with a count of the
+// rest when it runs out of blocks.
+func (n *SlackNotifier) postList(ctx context.Context, title string, listings []Listing) error {
+	blocks := []slackBlock{slackHeader(title)}
+	for i, listing := range listings {
+		// Keep room for the header and the "more" note.
+		if len(blocks) == slackMaxBlocks-1 {
+			blocks = append(blocks, slackContext(fmt.Sprintf("…and %d more", len(listings)-i)))
+			break
+		}
+		text := "<" + listing.URL() + "|" + slackEscape(headline(listing)) + ">"
+		if listing.NewThisRun {
+			text = "*NEW* " + text
+		}
+		if price := listing.DisplayPrice(); price != "" {
+			text += " – " + slackEscape(price)
+		}
+		blocks = append(blocks, slackSection(text))
+	}
+	return n.post(ctx, title, blocks)
+}
+
+func (n *SlackNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	blocks := []slackBlock{
+		slackHeader(searchPrefix(listing) + "Price reduced: " + headline(listing)),
+		slackSection(slackEscape(priceChange(listing, oldPrice))),
+		slackButton(listing),
+	}
+	return n.post(ctx, priceDropSubject(listing), blocks)
+}
+
+func (n *SlackNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	blocks := []slackBlock{
+		slackHeader(searchPrefix(listing) + "Price raised: " + headline(listing)),
+		slackSection(slackEscape(priceChange(listing, oldPrice))),
+		slackButton(listing),
+	}
+	return n.post(ctx, priceIncreaseSubject(listing), blocks)
+}
+
+func (n *SlackNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	blocks := []slackBlock{
+		slackHeader(removedSubject(listing)),
+		slackSection(slackEscape(removedMessage(listing))),
+	}
+	return n.post(ctx, removedSubject(listing), blocks)
+}
+
+func (n *SlackNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	blocks := []slackBlock{
+		slackHeader(changedSubject(listing)),
+		slackSection(slackEscape(changeList(changes))),
+		slackButton(listing),
+	}
+	return n.post(ctx, changedSubject(listing), blocks)
+}
+
+func (n *SlackNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	blocks := []slackBlock{
+		slackHeader(heartbeatSubject(searchName)),
+		slackSection(slackEscape(heartbeatMessage(fetched, lastNotified))),
+	}
+	return n.post(ctx, heartbeatSubject(searchName), blocks)
+}
+
+// post sends the blocks, with text as the fallback shown in notifications.
+// Slack answers anything but a 2xx with a short reason in the body.
+func (n *SlackNotifier) post(ctx context.Context, text string, blocks []slackBlock) error {
+	body, err := json.Marshal(map[string]interface{}{"text": text, "blocks": blocks})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		reason, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("slack webhook failed with HTTP %d: %s", response.StatusCode, strings.TrimSpace(string(reason)))
+	}
+	return nil
+}
+
+func slackListingFields(listing Listing) []slackBlock {
+	fields := []slackBlock{{"type": "mrkdwn", "text": "*Type*\n" + listing.TransactionLabel()}}
+	if price := listing.DisplayPriceDetails(); price != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Price*\n" + slackEscape(price)})
+	}
+	if rooms := listing.Rooms(); rooms != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Rooms*\n" + slackEscape(rooms)})
+	}
+	if lot := listing.LotText(); lot != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Lot*\n" + slackEscape(strings.TrimPrefix(lot, "Lot: "))})
+	}
+	if parking := listing.ParkingText(); parking != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Parking*\n" + slackEscape(strings.TrimPrefix(parking, "Parking: "))})
+	}
+	if fee := listing.CondoFeeText(); fee != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Condo fee*\n" + slackEscape(strings.TrimPrefix(fee, "Condo fee: "))})
+	}
+	if age := listing.AgeText(); age != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Age*\n" + slackEscape(age)})
+	}
+	if openHouse, ok := listing.NextOpenHouse(); ok {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Open house*\n" + slackEscape(openHouse.String())})
+	}
+	if commute := listing.CommuteText(); commute != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Commute*\n" + slackEscape(strings.TrimPrefix(commute, "Commute: "))})
+	}
+	if agent := listing.AgentText(); agent != "" {
+		fields = append(fields, slackBlock{"type": "mrkdwn", "text": "*Listed by*\n" + slackEscape(strings.TrimPrefix(agent, "Listed by "))})
+	}
+	return fields
+}
+
+func slackHeader(text string) slackBlock {
+	return slackBlock{
+		"type": "header",
+		"text": slackBlock{"type": "plain_text", "text": truncate(text, slackMaxHeaderLength)},
+	}
+}
+
+func slackSection(text string) slackBlock {
+	return slackBlock{"type": "section", "text": slackBlock{"type": "mrkdwn", "text": text}}
+}
+
+func slackContext(text string) slackBlock {
+	return slackBlock{"type": "context", "elements": []slackBlock{{"type": "plain_text", "text": text}}}
+}
+
+func slackButton(listing Listing) slackBlock {
+	buttons := []slackBlock{{
+		"type": "button",
+		"text": slackBlock{"type": "plain_text", "text": "View on Realtor.ca"},
+		"url":  listing.URL(),
+	}}
+	if mapURL := listing.MapURL(); mapURL != "" {
+		buttons = append(buttons, slackBlock{
+			"type": "button",
+			"text": slackBlock{"type": "plain_text", "text": "Map"},
+			"url":  mapURL,
+		})
+	}
+	if listing.TourURL != "" {
+		buttons = append(buttons, slackBlock{
+			"type": "button",
+			"text": slackBlock{"type": "plain_text", "text": "Virtual tour"},
+			"url":  listing.TourURL,
+		})
+	}
+	return slackBlock{"type": "actions", "elements": buttons}
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func slackEscape(s string) string {
+	return slackEscaper.Replace(s)
+}
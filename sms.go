@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// smsMaxLength is what the SMS formats aim for, leaving room in a
+// 160-character text for the sender prefix SNS adds. Links are never cut,
+// so a message can still run over.
+const smsMaxLength = 140
+
+// smsLine joins head, some descriptive text and a link, shortening the
+// text so the whole fits in smsMaxLength.
+func smsLine(head, text, link string) string {
+	room := smsMaxLength - len(head) - len(link) - 2
+	if text != "" && room > 3 {
+		if len(text) > room {
+			text = truncate(text, room-3) + "..."
+		}
+		head += " " + text
+	}
+	return head + " " + link
+}
+
+func smsListingMessage(listing Listing) string {
+	if message, ok := customBody(formatSMS, listing); ok {
+		return message
+	}
+	return smsLine(searchPrefix(listing)+"New: "+listing.DisplayPrice(), listing.Area(), listing.ShortURL())
+}
+
+func smsDigestMessage(listings []Listing) string {
+	head := strconv.Itoa(len(listings)) + " new listings"
+	if len(listings) == 1 {
+		head = "1 new listing"
+	}
+
+	var areas []string
+	seen := make(map[string]bool)
+	for _, listing := range listings {
+		if area := listing.Area(); area != "" && !seen[area] {
+			seen[area] = true
+			areas = append(areas, area)
+		}
+	}
+	return smsLine(searchPrefix(listings[0])+head+":", strings.Join(areas, ", "), listings[0].ShortURL())
+}
+
+func smsPriceDropMessage(listing Listing, oldPrice int) string {
+	head := searchPrefix(listing) + "Price drop: " + formatDollars(oldPrice) + " -> " + formatDollars(listing.PriceAmount)
+	return smsLine(head, listing.Area(), listing.ShortURL())
+}
+
+func smsPriceIncreaseMessage(listing Listing, oldPrice int) string {
+	head := searchPrefix(listing) + "Price up: " + formatDollars(oldPrice) + " -> " + formatDollars(listing.PriceAmount)
+	return smsLine(head, listing.Area(), listing.ShortURL())
+}
+
+func smsChangedMessage(listing Listing, changes []FieldChange) string {
+	fields := make([]string, len(changes))
+	for i, change := range changes {
+		fields[i] = change.Field
+	}
+	return smsLine(searchPrefix(listing)+"Updated:", strings.Join(fields, ", "), listing.ShortURL())
+}
+
+func smsRemovedMessage(listing Listing) string {
+	return searchPrefix(listing) + "Listing " + listing.ID + " was removed from Realtor.ca"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// snapshotFields are the listing fields that can be watched for changes,
+// each rendered to the short string kept in the snapshot. The description
+// is kept as a hash, to keep items small, of its text with whitespace
+// collapsed as in the fingerprint. The price is kept as listed, as the
+// converted one moves with the exchange rate.
+var snapshotFields = map[string]func(Listing) string{
+	"price":     func(l Listing) string { return l.ListedPrice() },
+	"status":    func(l Listing) string { return l.Status },
+	"bedrooms":  func(l Listing) string { return l.Bedrooms },
+	"bathrooms": func(l Listing) string { return l.Bathrooms },
+	"size":      func(l Listing) string { return l.SizeInterior },
+	"description": func(l Listing) string {
+		if l.Description == "" {
+			return ""
+		}
+		h := fnv.New64a()
+		h.Write([]byte(collapseSpace(l.Description)))
+		return strconv.FormatUint(h.Sum64(), 36)
+	},
+}
+
+// defaultWatchFields leaves out the price, whose drops have alerts of
+// their own.
+const defaultWatchFields = "status,bedrooms,bathrooms,size,description"
+
+// watchFields are the snapshot fields a change alert is sent for, from
+// WATCH_FIELDS. "none" turns change alerts off.
+var watchFields []string
+
+func validWatchField(name string) bool {
+	_, ok := snapshotFields[name]
+	return ok
+}
+
+// FieldChange is a watched field whose value differs from the snapshot.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c FieldChange) String() string {
+	name := strings.ToUpper(c.Field[:1]) + c.Field[1:]
+	switch {
+	case c.Field == "description":
+		return "Description was edited"
+	case c.Old == "":
+		return name + " is now " + c.New
+	case c.New == "":
+		return name + " was removed (was " + c.Old + ")"
+	}
+	return name + " changed from " + c.Old + " to " + c.New
+}
+
+// snapshotOf returns the compact record of a listing's fields kept in the
+// cache.
+func snapshotOf(listing Listing) map[string]string {
+	snapshot := make(map[string]string, len(snapshotFields))
+	for name, value := range snapshotFields {
+		snapshot[name] = value(listing)
+	}
+	return snapshot
+}
+
+// fingerprintOf hashes the listing's watched fields, with runs of
+// whitespace collapsed, so that edits which change nothing a reader would
+// notice, such as a reflowed description, leave it the same.
+func fingerprintOf(listing Listing) string {
+	h := fnv.New64a()
+	for _, field := range watchFields {
+		value := listing.Description
+		if field != "description" {
+			value = snapshotFields[field](listing)
+		}
+		h.Write([]byte(field + "=" + collapseSpace(value) + "\x00"))
+	}
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// collapseSpace trims s and turns its runs of whitespace into single
+// spaces.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// diffSnapshots returns the watched fields that differ between two
+// snapshots, in the order they are watched. Fields missing from the old
+// snapshot were not recorded at the time, and are not compared.
+func diffSnapshots(old, new map[string]string) []FieldChange {
+	var changes []FieldChange
+	for _, field := range watchFields {
+		previous, ok := old[field]
+		if ok && previous != new[field] {
+			changes = append(changes, FieldChange{Field: field, Old: old[field], New: new[field]})
+		}
+	}
+	return changes
+}
+
+func withoutField(changes []FieldChange, field string) []FieldChange {
+	var kept []FieldChange
+	for _, change := range changes {
+		if change.Field != field {
+			kept = append(kept, change)
+		}
+	}
+	return kept
+}
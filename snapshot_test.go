@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotIgnoresConversion(t *testing.T) {
+	listing := Listing{ID: "1", PriceAmount: 2500, ForRent: true}
+	converted := listing
+	converted.ConvertedPrice, converted.ConvertedCurrency = 1825, "USD"
+	reconverted := listing
+	reconverted.ConvertedPrice, reconverted.ConvertedCurrency = 1850, "USD"
+
+	want := snapshotOf(listing)
+	if want["price"] != "$2,500/mo" {
+		t.Errorf("price snapshot = %q, want $2,500/mo", want["price"])
+	}
+	for _, l := range []Listing{converted, reconverted} {
+		if got := snapshotOf(l); !reflect.DeepEqual(got, want) {
+			t.Errorf("snapshot with a converted price of %d = %v, want %v", l.ConvertedPrice, got, want)
+		}
+	}
+}
+
+func TestChangesIgnoresUnwatchedFields(t *testing.T) {
+	defer func(fields []string) { watchFields = fields }(watchFields)
+	watchFields = []string{"price", "status", "bedrooms", "bathrooms", "description"}
+
+	original := Listing{
+		ID:           "1",
+		PriceAmount:  650000,
+		Status:       StatusActive,
+		Bedrooms:     "3",
+		Bathrooms:    "2",
+		SizeInterior: "1500 sqft",
+		Description:  "Bright corner unit.\nSteps to the park.",
+		PhotoURL:     "https://cdn.realtor.ca/listing/1/a.jpg",
+	}
+	tests := []struct {
+		name        string
+		edit        func(*Listing)
+		wantChanges []string
+	}{
+		{name: "unchanged", edit: func(l *Listing) {}},
+		{name: "new photo", edit: func(l *Listing) { l.PhotoURL = "https://cdn.realtor.ca/listing/1/b.jpg" }},
+		{name: "unwatched size", edit: func(l *Listing) { l.SizeInterior = "1600 sqft" }},
+		{name: "reflowed description", edit: func(l *Listing) { l.Description = "  Bright corner  unit. Steps\tto the park. " }},
+		{name: "edited description", edit: func(l *Listing) { l.Description = "Bright corner unit. Sold firm." }, wantChanges: []string{"description"}},
+		{name: "status", edit: func(l *Listing) { l.Status = "Sold" }, wantChanges: []string{"status"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := NewDB(newFakeDynamo(), "search")
+			if err := db.MarkSeen(ctx, original); err != nil {
+				t.Fatal(err)
+			}
+			edited := original
+			tt.edit(&edited)
+
+			changes, err := db.Changes(ctx, edited)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for _, change := range changes {
+				fields = append(fields, change.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantChanges) {
+				t.Errorf("changes %v, want %v", fields, tt.wantChanges)
+			}
+			if tt.wantChanges == nil && fingerprintOf(edited) != fingerprintOf(original) {
+				t.Error("fingerprint changed without a watched change")
+			}
+		})
+	}
+}
+
+func TestDescriptionSnapshotIgnoresWhitespace(t *testing.T) {
+	a := snapshotOf(Listing{Description: "Bright corner unit.\nSteps to the park."})
+	b := snapshotOf(Listing{Description: "Bright corner unit.  Steps to the\r\npark. "})
+	if a["description"] != b["description"] {
+		t.Errorf("reflowed description hashes to %q, want %q", b["description"], a["description"])
+	}
+	if c := snapshotOf(Listing{Description: "Bright corner unit."}); c["description"] == a["description"] {
+		t.Error("edited description hashes the same")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+const (
+	// SNS rejects subjects of 100 characters or more, and messages over
+	// 256KB.
+	snsMaxSubjectLength = 99
+	snsMaxMessageLength = 256 * 1024
+
+	// snsMaxRetries is how often a failed publish is retried. The SNS
+	// client is built without retries of its own so they do not stack.
+	snsMaxRetries = 3
+
+	snsFormatDefault = "default"
+	snsFormatSMS     = "sms"
+)
+
+// operatorTopicName optionally names the SNS topic told about problems
+// that need the operator's attention, such as being blocked by
+// realtor.ca, as opposed to listing alerts.
+var operatorTopicName string
+
+func operatorTopicArn() string {
+	return "arn:aws:sns:" + awsRegion + ":" + awsAccountId + ":" + operatorTopicName
+}
+
+// alertOperatorOnChallenge tells the operator topic when any of the
+// searches' errors is a ChallengeError. Failing to do so is only logged,
+// as the errors are reported anyway.
+func alertOperatorOnChallenge(ctx context.Context, client snsAPI, topicArn string, errs []error) {
+	for _, err := range errs {
+		var challengeErr *ChallengeError
+		if !errors.As(err, &challengeErr) {
+			continue
+		}
+		_, publishErr := client.PublishWithContext(ctx, &sns.PublishInput{
+			Subject:  aws.String("Realtorca is being blocked by realtor.ca"),
+			Message:  aws.String(err.Error() + "\n\n" + challengeErr.Snippet),
+			TopicArn: aws.String(topicArn),
+		})
+		if publishErr != nil {
+			slog.ErrorContext(ctx, "Failed to alert the operator", "error", publishErr)
+		}
+		return
+	}
+}
+
+// snsAPI is the part of the SNS client SNSNotifier uses, so tests can stand
+// in a fake for it.
+type snsAPI interface {
+	PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error)
+}
+
+var _ snsAPI = (*sns.SNS)(nil)
+
+// snsPriceTopics route alerts about listings priced at least MinPrice to
+// their own topics, from SNS_PRICE_TOPICS. Other alerts, and those about
+// listings without a price, go to the SNS_TOPIC_NAME topic.
+var snsPriceTopics []priceTopic
+
+type priceTopic struct {
+	MinPrice int
+	TopicArn string
+}
+
+// parsePriceTopics reads comma-separated "price=topic" pairs, where the
+// topic is a name in this account and region or a full ARN, e.g.
+// "800000=luxury,1500000=arn:aws:sns:ca-central-1:123456789012:estates".
+// The result is sorted by price.
+func parsePriceTopics(v string) ([]priceTopic, error) {
+	var topics []priceTopic
+	prices := make(map[int]bool)
+	for _, pair := range splitList(v) {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, errors.New("missing \"=\" in " + pair)
+		}
+		price, err := strconv.Atoi(strings.TrimSpace(pair[:i]))
+		if err != nil || price < 0 {
+			return nil, errors.New("invalid price in " + pair)
+		}
+		if prices[price] {
+			return nil, errors.New("price given twice: " + strconv.Itoa(price))
+		}
+		prices[price] = true
+		topic := strings.TrimSpace(pair[i+1:])
+		if topic == "" {
+			return nil, errors.New("missing topic in " + pair)
+		}
+		if !strings.HasPrefix(topic, "arn:") {
+			topic = "arn:aws:sns:" + awsRegion + ":" + awsAccountId + ":" + topic
+		}
+		topics = append(topics, priceTopic{MinPrice: price, TopicArn: topic})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].MinPrice < topics[j].MinPrice })
+	return topics, nil
+}
+
+type SNSNotifier struct {
+	sns      snsAPI
+	topicArn string
+	// priceTopics are sorted by MinPrice.
+	priceTopics []priceTopic
+}
+
+func NewSNSNotifier(client snsAPI, topicArn string, priceTopics []priceTopic) *SNSNotifier {
+	return &SNSNotifier{
+		sns:         client,
+		topicArn:    topicArn,
+		priceTopics: priceTopics,
+	}
+}
+
+// topicFor returns the topic alerts about the listing go to: that of the
+// highest price threshold it reaches, or the default topic.
+func (n *SNSNotifier) topicFor(listing Listing) string {
+	topic := n.topicArn
+	if listing.PriceAmount <= 0 {
+		return topic
+	}
+	for _, t := range n.priceTopics {
+		if listing.PriceAmount < t.MinPrice {
+			break
+		}
+		topic = t.TopicArn
+	}
+	return topic
+}
+
+func (n *SNSNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	if snsFormat == snsFormatSMS {
+		return n.publish(ctx, n.topicFor(listing), listingSubject(listing), smsListingMessage(listing), listingAttributes("new_listing", listing))
+	}
+	return n.publish(ctx, n.topicFor(listing), listingSubject(listing), listingMessage(listing), listingAttributes("new_listing", listing))
+}
+
+func (n *SNSNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	if snsFormat == snsFormatSMS {
+		return n.publish(ctx, n.topicArn, digestSubject(listings), smsDigestMessage(listings), searchAttributes("digest", listings[0].SearchName))
+	}
+	return n.publish(ctx, n.topicArn, digestSubject(listings), digestMessage(listings, snsMaxMessageLength), searchAttributes("digest", listings[0].SearchName))
+}
+
+func (n *SNSNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.publish(ctx, n.topicArn, comparablesSubject(searchName, listings), digestMessage(listings, snsMaxMessageLength), searchAttributes("comparables", searchName))
+}
+
+func (n *SNSNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	if snsFormat == snsFormatSMS {
+		return n.publish(ctx, n.topicFor(listing), priceDropSubject(listing), smsPriceDropMessage(listing, oldPrice), listingAttributes("price_drop", listing))
+	}
+	return n.publish(ctx, n.topicFor(listing), priceDropSubject(listing), priceChangeMessage(listing, oldPrice), listingAttributes("price_drop", listing))
+}
+
+func (n *SNSNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	if snsFormat == snsFormatSMS {
+		return n.publish(ctx, n.topicFor(listing), priceIncreaseSubject(listing), smsPriceIncreaseMessage(listing, oldPrice), listingAttributes("price_increase", listing))
+	}
+	return n.publish(ctx, n.topicFor(listing), priceIncreaseSubject(listing), priceChangeMessage(listing, oldPrice), listingAttributes("price_increase", listing))
+}
+
+func (n *SNSNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	if snsFormat == snsFormatSMS {
+		return n.publish(ctx, n.topicFor(listing), removedSubject(listing), smsRemovedMessage(listing), listingAttributes("removed", listing))
+	}
+	return n.publish(ctx, n.topicFor(listing), removedSubject(listing), removedMessage(listing), listingAttributes("removed", listing))
+}
+
+func (n *SNSNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	if snsFormat == snsFormatSMS {
+		return n.publish(ctx, n.topicFor(listing), changedSubject(listing), smsChangedMessage(listing, changes), listingAttributes("changed", listing))
+	}
+	return n.publish(ctx, n.topicFor(listing), changedSubject(listing), changedMessage(listing, changes), listingAttributes("changed", listing))
+}
+
+func (n *SNSNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.publish(ctx, n.topicArn, heartbeatSubject(searchName), heartbeatMessage(fetched, lastNotified), searchAttributes("heartbeat", searchName))
+}
+
+// publish sends a message to the topic, retrying throttling and other
+// transient errors. An alert that still fails is returned as an error, so
+// its listing is not marked seen and the next run tries again.
+//
+// Messages to a FIFO topic carry a deduplication ID, so that a retried run
+// does not deliver an alert twice.
+func (n *SNSNotifier) publish(ctx context.Context, topicArn, subject, message string, attributes map[string]*sns.MessageAttributeValue) error {
+	input := &sns.PublishInput{
+		Message:           aws.String(message),
+		MessageAttributes: attributes,
+		Subject:           aws.String(truncate(subject, snsMaxSubjectLength)),
+		TopicArn:          aws.String(topicArn),
+	}
+	var opts []request.Option
+	if strings.HasSuffix(topicArn, ".fifo") {
+		opts = append(opts, withFIFOParams(snsDeduplicationID(ctx, subject, message), snsMessageGroupID(attributes)))
+	}
+	return withRetry(ctx, snsMaxRetries, isRetryableSNSError, func() error {
+		_, err := n.sns.PublishWithContext(ctx, input, opts...)
+		return err
+	})
+}
+
+// snsDeduplicationID identifies a message within a run. Lambda retries an
+// invocation under the same request ID, so the retry's alert on a listing
+// gets the same ID and SNS drops it, while the next scheduled run's alerts
+// get new ones. The message itself names the listing and its price, so
+// alerts on different listings, or the same one after it changed, differ.
+func snsDeduplicationID(ctx context.Context, subject, message string) string {
+	var requestID string
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		requestID = lc.AwsRequestID
+	}
+	sum := sha256.Sum256([]byte(requestID + "\x00" + subject + "\x00" + message))
+	return hex.EncodeToString(sum[:])
+}
+
+// snsMessageGroupID keeps each search's alerts in order, apart from the
+// other searches'. Group IDs only take up to 128 ASCII letters, digits and
+// punctuation, so anything else in the name becomes "_".
+func snsMessageGroupID(attributes map[string]*sns.MessageAttributeValue) string {
+	name, ok := attributes["search_name"]
+	if !ok {
+		return "default"
+	}
+	id := strings.Map(func(r rune) rune {
+		if r > ' ' && r <= '~' {
+			return r
+		}
+		return '_'
+	}, aws.StringValue(name.StringValue))
+	return truncate(id, 128)
+}
+
+// withFIFOParams adds the deduplication and message group IDs FIFO topics
+// need to a publish request. The SDK's PublishInput predates FIFO topics,
+// so they are appended to the query-encoded body once it is built.
+func withFIFOParams(deduplicationID, groupID string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			if r.Error != nil {
+				return
+			}
+			body, err := ioutil.ReadAll(r.GetBody())
+			if err != nil {
+				r.Error = err
+				return
+			}
+			params := url.Values{
+				"MessageDeduplicationId": {deduplicationID},
+				"MessageGroupId":         {groupID},
+			}
+			r.SetBufferBody(append(body, "&"+params.Encode()...))
+		})
+	}
+}
+
+// isRetryableSNSError reports whether a failed publish is worth trying
+// again: throttling, server-side errors and connection problems.
+func isRetryableSNSError(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() >= 500 {
+		return true
+	}
+	// SNS reports its own rate limit as "Throttled", which the SDK does not
+	// count as throttling.
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case sns.ErrCodeThrottledException, sns.ErrCodeInternalErrorException, sns.ErrCodeKMSThrottlingException:
+		return true
+	}
+	return false
+}
+
+// Listing prices are bucketed by these amounts in the price_bucket
+// attribute.
+const (
+	snsPriceBucketSale = 100000
+	snsPriceBucketRent = 500
+)
+
+// snsMaxAttributeLength keeps string attributes well within SNS's limits.
+const snsMaxAttributeLength = 256
+
+// listingAttributes returns the message attributes subscribers can filter
+// alerts about the listing on. Attributes whose field is unknown are left
+// out.
+func listingAttributes(alertType string, listing Listing) map[string]*sns.MessageAttributeValue {
+	attributes := searchAttributes(alertType, listing.SearchName)
+	if listing.PriceAmount > 0 {
+		size := snsPriceBucketSale
+		if listing.ForRent {
+			size = snsPriceBucketRent
+		}
+		low := listing.PriceAmount / size * size
+		attributes["price"] = numberAttribute(listing.PriceAmount)
+		attributes["price_bucket"] = stringAttribute(strconv.Itoa(low) + "-" + strconv.Itoa(low+size))
+	}
+	if listing.Bedrooms != "" {
+		attributes["bedrooms"] = numberAttribute(listing.BedroomsTotal)
+	}
+	if parts := strings.Split(listing.Address, ", "); len(parts) >= 2 && parts[1] != "" {
+		attributes["city"] = stringAttribute(parts[1])
+	}
+	return attributes
+}
+
+// searchAttributes returns the message attributes of an alert that is not
+// about a single listing.
+func searchAttributes(alertType, searchName string) map[string]*sns.MessageAttributeValue {
+	attributes := map[string]*sns.MessageAttributeValue{"alert_type": stringAttribute(alertType)}
+	if searchName != "" {
+		attributes["search_name"] = stringAttribute(searchName)
+	}
+	return attributes
+}
+
+func stringAttribute(v string) *sns.MessageAttributeValue {
+	return &sns.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(truncate(v, snsMaxAttributeLength))}
+}
+
+func numberAttribute(v int) *sns.MessageAttributeValue {
+	return &sns.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(v))}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// fakeSNS records the messages published to it. The next calls fail with
+// errs, one per call, before publishes start succeeding.
+type fakeSNS struct {
+	mu        sync.Mutex
+	errs      []error
+	calls     int
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	f.published = append(f.published, input)
+	return &sns.PublishOutput{MessageId: aws.String("id")}, nil
+}
+
+var _ snsAPI = (*fakeSNS)(nil)
+
+func TestSendListingAlert(t *testing.T) {
+	const (
+		defaultTopic = "arn:aws:sns:ca-central-1:123456789012:listings"
+		luxuryTopic  = "arn:aws:sns:ca-central-1:123456789012:luxury"
+	)
+	priceTopics := []priceTopic{{MinPrice: 1000000, TopicArn: luxuryTopic}}
+
+	tests := []struct {
+		name        string
+		listing     Listing
+		wantTopic   string
+		wantSubject string
+		wantMessage string
+	}{
+		{
+			name:        "default topic",
+			listing:     Listing{ID: "1", Address: "12 Main St, Toronto", PriceAmount: 650000, RelativeDetailsURL: "/real-estate/1/12-main-st"},
+			wantTopic:   defaultTopic,
+			wantSubject: "New listing for sale: 12 Main St, Toronto - $650,000",
+			wantMessage: "https://realtor.ca/real-estate/1/12-main-st",
+		},
+		{
+			name:        "price topic",
+			listing:     Listing{ID: "2", Address: "1 Bay St, Toronto", PriceAmount: 1500000, RelativeDetailsURL: "/real-estate/2/1-bay-st"},
+			wantTopic:   luxuryTopic,
+			wantSubject: "New listing for sale: 1 Bay St, Toronto - $1,500,000",
+			wantMessage: "https://realtor.ca/real-estate/2/1-bay-st",
+		},
+		{
+			name:        "no price",
+			listing:     Listing{ID: "3", RelativeDetailsURL: "/real-estate/3/lot"},
+			wantTopic:   defaultTopic,
+			wantSubject: "New listing for sale on Realtor.ca",
+			wantMessage: "https://realtor.ca/real-estate/3/lot",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSNS{}
+			notifier := NewSNSNotifier(client, defaultTopic, priceTopics)
+			if err := notifier.SendListingAlert(context.Background(), tt.listing); err != nil {
+				t.Fatal(err)
+			}
+			if len(client.published) != 1 {
+				t.Fatalf("published %d messages, want 1", len(client.published))
+			}
+			input := client.published[0]
+			if topic := aws.StringValue(input.TopicArn); topic != tt.wantTopic {
+				t.Errorf("topic = %s, want %s", topic, tt.wantTopic)
+			}
+			if subject := aws.StringValue(input.Subject); subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", subject, tt.wantSubject)
+			}
+			if message := aws.StringValue(input.Message); !strings.Contains(message, tt.wantMessage) {
+				t.Errorf("message %q does not contain %q", message, tt.wantMessage)
+			}
+			if alertType := aws.StringValue(input.MessageAttributes["alert_type"].StringValue); alertType != "new_listing" {
+				t.Errorf("alert_type attribute = %q, want new_listing", alertType)
+			}
+		})
+	}
+}
+
+func TestSendListingAlertError(t *testing.T) {
+	failure := awserr.New(sns.ErrCodeAuthorizationErrorException, "not authorized", nil)
+	client := &fakeSNS{errs: []error{failure}}
+	notifier := NewSNSNotifier(client, "arn:aws:sns:ca-central-1:123456789012:listings", nil)
+
+	err := notifier.SendListingAlert(context.Background(), Listing{ID: "1"})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+	if client.calls != 1 {
+		t.Errorf("published %d times, want a permanent error not retried", client.calls)
+	}
+}
+
+func TestSendListingAlertRetry(t *testing.T) {
+	throttled := awserr.New(sns.ErrCodeThrottledException, "rate exceeded", nil)
+	client := &fakeSNS{errs: []error{throttled, throttled}}
+	notifier := NewSNSNotifier(client, "arn:aws:sns:ca-central-1:123456789012:listings", nil)
+
+	if err := notifier.SendListingAlert(context.Background(), Listing{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if client.calls != 3 {
+		t.Errorf("published %d times, want two failures and a success", client.calls)
+	}
+	if len(client.published) != 1 {
+		t.Errorf("delivered %d messages, want 1", len(client.published))
+	}
+}
+
+// newTestSNSClient returns an SNS client sending its requests to server.
+func newTestSNSClient(server *httptest.Server) *sns.SNS {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ca-central-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return sns.New(sess)
+}
+
+func TestPublishFIFODeduplicationID(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []url.Values
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params, _ := url.ParseQuery(string(body))
+		mu.Lock()
+		bodies = append(bodies, params)
+		first := len(bodies) == 1
+		mu.Unlock()
+		if first {
+			// The retry has to carry the same ID for SNS to drop it.
+			http.Error(w, "<ErrorResponse><Error><Code>InternalError</Code></Error></ErrorResponse>", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>"))
+	}))
+	defer server.Close()
+
+	const topic = "arn:aws:sns:ca-central-1:123456789012:listings.fifo"
+	notifier := NewSNSNotifier(newTestSNSClient(server), topic, nil)
+	listing := Listing{ID: "1", SearchName: "kitchener", PriceAmount: 650000, RelativeDetailsURL: "/real-estate/1/a"}
+	run := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+	if err := notifier.SendListingAlert(run, listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("%d publish requests, want a failure and its retry", len(bodies))
+	}
+	id := bodies[0].Get("MessageDeduplicationId")
+	if id == "" || bodies[1].Get("MessageDeduplicationId") != id {
+		t.Errorf("deduplication IDs %q and %q, want the same one on the retry", id, bodies[1].Get("MessageDeduplicationId"))
+	}
+	if group := bodies[1].Get("MessageGroupId"); group != "kitchener" {
+		t.Errorf("message group %q, want the search name", group)
+	}
+
+	// Lambda retries the invocation under the same request ID; the next
+	// scheduled run has another.
+	retried := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+	next := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-2"})
+	subject, message := listingSubject(listing), listingMessage(listing)
+	if snsDeduplicationID(retried, subject, message) != id {
+		t.Error("deduplication ID differs for the same listing in a retried invocation")
+	}
+	if snsDeduplicationID(next, subject, message) == id {
+		t.Error("deduplication ID is the same in the next run")
+	}
+	other := listing
+	other.ID, other.RelativeDetailsURL = "2", "/real-estate/2/b"
+	if snsDeduplicationID(retried, listingSubject(other), listingMessage(other)) == id {
+		t.Error("deduplication ID is the same for another listing")
+	}
+}
+
+func TestPublishStandardTopic(t *testing.T) {
+	var params url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params, _ = url.ParseQuery(string(body))
+		w.Write([]byte("<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>"))
+	}))
+	defer server.Close()
+
+	notifier := NewSNSNotifier(newTestSNSClient(server), "arn:aws:sns:ca-central-1:123456789012:listings", nil)
+	if err := notifier.SendListingAlert(context.Background(), Listing{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["MessageDeduplicationId"]; ok {
+		t.Error("deduplication ID sent to a standard topic")
+	}
+	if _, ok := params["MessageGroupId"]; ok {
+		t.Error("message group sent to a standard topic")
+	}
+}
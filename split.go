@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// splitMaxDepth, when non-zero, has a search whose area matches more
+// listings than a single search returns fetched again as the four quarters
+// of its bounding box, each split in turn while it is still capped, up to
+// this many times. Every level multiplies the requests by up to four.
+var splitMaxDepth int
+
+// FetchSplit fetches the search like FetchListings, then splits its area
+// into quarters as long as the results are cut short by realtor.ca's cap
+// or MAX_PAGES and splitMaxDepth allows, merging the quarters' listings in
+// first-seen order. The result's Paging is that of the whole area.
+func (f *Fetcher) FetchSplit(ctx context.Context, search Search) (*Listings, error) {
+	listings, err := f.fetchSplit(ctx, search, 0)
+	if err != nil {
+		return listings, err
+	}
+	seen := make(map[string]bool, len(listings.Results))
+	unique := listings.Results[:0]
+	for _, listing := range listings.Results {
+		if !seen[listing.ID] {
+			seen[listing.ID] = true
+			unique = append(unique, listing)
+		}
+	}
+	listings.Results = unique
+	return listings, nil
+}
+
+func (f *Fetcher) fetchSplit(ctx context.Context, search Search, depth int) (*Listings, error) {
+	listings, err := f.FetchListings(ctx, search)
+	listings.Boxes = 1
+	if err != nil || depth >= splitMaxDepth || listings.StoppedEarly || len(listings.Results) >= listings.Paging.TotalRecords {
+		return listings, err
+	}
+	box, ok := searchBox(search.Params)
+	if !ok {
+		return listings, nil
+	}
+
+	for _, quarter := range box.quarters() {
+		if !withinBudget(ctx, minRequestInterval) {
+			listings.StoppedEarly = true
+			break
+		}
+		params := make(url.Values, len(search.Params))
+		for k, v := range search.Params {
+			params[k] = v
+		}
+		quarter.Apply(params)
+
+		sub, err := f.fetchSplit(ctx, Search{Name: search.Name, Params: params}, depth+1)
+		listings.Results = append(listings.Results, sub.Results...)
+		listings.Boxes += sub.Boxes
+		if err != nil {
+			return listings, err
+		}
+		if sub.StoppedEarly {
+			listings.StoppedEarly = true
+			break
+		}
+	}
+	return listings, nil
+}
+
+// searchBox reads the bounding box a search's parameters cover.
+func searchBox(params url.Values) (BoundingBox, bool) {
+	var coords [4]float64
+	for i, name := range []string{"LatitudeMin", "LatitudeMax", "LongitudeMin", "LongitudeMax"} {
+		v, err := strconv.ParseFloat(params.Get(name), 64)
+		if err != nil {
+			return BoundingBox{}, false
+		}
+		coords[i] = v
+	}
+	box := BoundingBox{LatitudeMin: coords[0], LatitudeMax: coords[1], LongitudeMin: coords[2], LongitudeMax: coords[3]}
+	return box, box.LatitudeMin < box.LatitudeMax && box.LongitudeMin < box.LongitudeMax
+}
+
+// quarters splits the box in four at its midpoints. Listings on a shared
+// edge may come back from two quarters; FetchSplit drops the repeats.
+func (b BoundingBox) quarters() []BoundingBox {
+	midLat := (b.LatitudeMin + b.LatitudeMax) / 2
+	midLng := (b.LongitudeMin + b.LongitudeMax) / 2
+	return []BoundingBox{
+		{LatitudeMin: b.LatitudeMin, LatitudeMax: midLat, LongitudeMin: b.LongitudeMin, LongitudeMax: midLng},
+		{LatitudeMin: b.LatitudeMin, LatitudeMax: midLat, LongitudeMin: midLng, LongitudeMax: b.LongitudeMax},
+		{LatitudeMin: midLat, LatitudeMax: b.LatitudeMax, LongitudeMin: b.LongitudeMin, LongitudeMax: midLng},
+		{LatitudeMin: midLat, LatitudeMax: b.LatitudeMax, LongitudeMin: midLng, LongitudeMax: b.LongitudeMax},
+	}
+}
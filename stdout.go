@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// StdoutNotifier writes alerts to a writer instead of delivering them, for
+// trying out a configuration locally.
+type StdoutNotifier struct {
+	w io.Writer
+}
+
+func NewStdoutNotifier(w io.Writer) *StdoutNotifier {
+	return &StdoutNotifier{w: w}
+}
+
+func (n *StdoutNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	return n.print(listingSubject(listing), listingMessage(listing))
+}
+
+func (n *StdoutNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.print(digestSubject(listings), digestMessage(listings, snsMaxMessageLength))
+}
+
+func (n *StdoutNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.print(comparablesSubject(searchName, listings), digestMessage(listings, snsMaxMessageLength))
+}
+
+func (n *StdoutNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.print(priceDropSubject(listing), priceChangeMessage(listing, oldPrice))
+}
+
+func (n *StdoutNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.print(priceIncreaseSubject(listing), priceChangeMessage(listing, oldPrice))
+}
+
+func (n *StdoutNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return n.print(removedSubject(listing), removedMessage(listing))
+}
+
+func (n *StdoutNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	return n.print(changedSubject(listing), changedMessage(listing, changes))
+}
+
+func (n *StdoutNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.print(heartbeatSubject(searchName), heartbeatMessage(fetched, lastNotified))
+}
+
+func (n *StdoutNotifier) print(subject, message string) error {
+	_, err := fmt.Fprintf(n.w, "%s\n%s\n%s\n\n", subject, strings.Repeat("-", len(subject)), strings.TrimRight(message, "\n"))
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// dynamoTTLAttribute is the attribute DynamoDB expires items by.
+const dynamoTTLAttribute = "ttl"
+
+// dynamoAutocreate creates the table when it does not exist, for trying
+// things out against DynamoDB Local. It is meant for development only;
+// a production table is better made with the rest of the stack.
+var dynamoAutocreate bool
+
+// tableAPI is the part of the DynamoDB client checkTable uses.
+type tableAPI interface {
+	DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error)
+	CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error)
+	WaitUntilTableExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error
+	UpdateTimeToLiveWithContext(ctx aws.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+var _ tableAPI = (*dynamodb.DynamoDB)(nil)
+
+var (
+	tableCheckMu sync.Mutex
+	tableChecked bool
+)
+
+// checkTable makes sure the table exists before anything is read from it,
+// once per container: with dynamoAutocreate it is created if missing, and
+// otherwise its absence is reported plainly rather than as whichever call
+// happens to fail first. A role not allowed to describe the table skips
+// the check.
+func checkTable(ctx context.Context, client tableAPI) error {
+	tableCheckMu.Lock()
+	defer tableCheckMu.Unlock()
+	if tableChecked {
+		return nil
+	}
+
+	_, err := client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(dynamoTableName),
+	})
+	var awsErr awserr.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &awsErr) && awsErr.Code() == "AccessDeniedException":
+		slog.DebugContext(ctx, "Not allowed to describe the DynamoDB table, skipping the check", "table", dynamoTableName)
+	case errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException:
+		if !dynamoAutocreate {
+			return fmt.Errorf("DynamoDB table %q not found; create it, or set DYNAMO_AUTOCREATE=true to have it created in development", dynamoTableName)
+		}
+		if err = createTable(ctx, client); err != nil {
+			return fmt.Errorf("failed to create DynamoDB table %q: %w", dynamoTableName, err)
+		}
+	default:
+		return fmt.Errorf("failed to check DynamoDB table %q: %w", dynamoTableName, err)
+	}
+	tableChecked = true
+	return nil
+}
+
+// createTable creates the table with the key schema every item uses, and
+// expiry on the ttl attribute.
+func createTable(ctx context.Context, client tableAPI) error {
+	slog.WarnContext(ctx, "Creating the missing DynamoDB table", "table", dynamoTableName)
+	_, err := client.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(dynamoTableName),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(dynamoPartitionKeyName), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String(dynamoSortKeyName), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(dynamoPartitionKeyName), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String(dynamoSortKeyName), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeResourceInUseException {
+		// Another run is creating it.
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	table := &dynamodb.DescribeTableInput{TableName: aws.String(dynamoTableName)}
+	if err = client.WaitUntilTableExistsWithContext(ctx, table); err != nil {
+		return err
+	}
+	_, err = client.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(dynamoTableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(dynamoTTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
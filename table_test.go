@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// fakeTable answers DescribeTable with describeErr, and records the calls
+// creating the table.
+type fakeTable struct {
+	describeErr error
+
+	created, waited bool
+	create          *dynamodb.CreateTableInput
+	ttl             *dynamodb.UpdateTimeToLiveInput
+}
+
+func (f *fakeTable) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	if f.describeErr != nil {
+		return nil, f.describeErr
+	}
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{TableName: input.TableName}}, nil
+}
+
+func (f *fakeTable) CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	f.created = true
+	f.create = input
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (f *fakeTable) WaitUntilTableExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error {
+	if !f.created {
+		return awserr.New(dynamodb.ErrCodeResourceNotFoundException, "waited on a table never created", nil)
+	}
+	f.waited = true
+	return nil
+}
+
+func (f *fakeTable) UpdateTimeToLiveWithContext(ctx aws.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	f.ttl = input
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+var _ tableAPI = (*fakeTable)(nil)
+
+func TestCheckTable(t *testing.T) {
+	defer func(v bool) { dynamoAutocreate = v }(dynamoAutocreate)
+	notFound := awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found", nil)
+
+	tests := []struct {
+		name        string
+		describeErr error
+		autocreate  bool
+		wantErr     string
+		wantCreated bool
+	}{
+		{name: "table exists"},
+		{name: "missing, autocreate off", describeErr: notFound, wantErr: "DYNAMO_AUTOCREATE"},
+		{name: "missing, autocreate on", describeErr: notFound, autocreate: true, wantCreated: true},
+		{name: "not allowed to describe", describeErr: awserr.New("AccessDeniedException", "not authorized", nil)},
+		{name: "other error", describeErr: awserr.New("InternalServerError", "try again", nil), wantErr: "failed to check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tableChecked = false
+			defer func() { tableChecked = false }()
+			dynamoAutocreate = tt.autocreate
+			client := &fakeTable{describeErr: tt.describeErr}
+
+			err := checkTable(context.Background(), client)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("checkTable: got error %v, want one mentioning %q", err, tt.wantErr)
+			}
+			if client.created != tt.wantCreated || client.waited != tt.wantCreated {
+				t.Errorf("created %v, waited %v, want %v", client.created, client.waited, tt.wantCreated)
+			}
+			if tableChecked == (err != nil) {
+				t.Errorf("table checked = %v after error %v", tableChecked, err)
+			}
+			if !tt.wantCreated {
+				return
+			}
+			if name := aws.StringValue(client.create.TableName); name != dynamoTableName {
+				t.Errorf("created table %q, want %q", name, dynamoTableName)
+			}
+			keys := map[string]string{}
+			for _, k := range client.create.KeySchema {
+				keys[aws.StringValue(k.AttributeName)] = aws.StringValue(k.KeyType)
+			}
+			if keys[dynamoPartitionKeyName] != dynamodb.KeyTypeHash || keys[dynamoSortKeyName] != dynamodb.KeyTypeRange {
+				t.Errorf("key schema %v, want %s as hash and %s as range key", keys, dynamoPartitionKeyName, dynamoSortKeyName)
+			}
+			if client.ttl == nil || aws.StringValue(client.ttl.TimeToLiveSpecification.AttributeName) != dynamoTTLAttribute {
+				t.Errorf("TTL not enabled on %q", dynamoTTLAttribute)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	telegramAPIURL = "https://api.telegram.org/bot"
+
+	telegramMaxMessageLength = 4096
+	telegramMaxCaptionLength = 1024
+)
+
+// TelegramNotifier posts alerts to a chat through the Telegram Bot API,
+// formatted with Telegram's Markdown.
+type TelegramNotifier struct {
+	client httpClient
+	token  string
+	chatID string
+}
+
+func NewTelegramNotifier(client httpClient, token, chatID string) *TelegramNotifier {
+	return &TelegramNotifier{client: client, token: token, chatID: chatID}
+}
+
+// SendListingAlert sends the listing's photo with the details as its
+// caption, or a plain message when there is no photo.
+func (n *TelegramNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	text, ok := customBody(formatMarkdown, listing)
+	if !ok {
+		text = telegramListingText(listing)
+	}
+
+	if listing.PhotoURL != "" && len(text) <= telegramMaxCaptionLength {
+		return n.call(ctx, "sendPhoto", map[string]string{
+			"chat_id":    n.chatID,
+			"photo":      listing.PhotoURL,
+			"caption":    text,
+			"parse_mode": "Markdown",
+		})
+	}
+	return n.sendMessage(ctx, text)
+}
+
+func telegramListingText(listing Listing) string {
+	text := telegramBold(searchPrefix(listing)+headline(listing)) + "\n" +
+		telegramEscape(listing.TransactionLabel()) + "\n"
+	if price := listing.DisplayPriceDetails(); price != "" {
+		text += telegramEscape(price) + "\n"
+	}
+	if rooms := listing.Rooms(); rooms != "" {
+		text += telegramEscape(rooms) + "\n"
+	}
+	if lot := listing.LotText(); lot != "" {
+		text += telegramEscape(lot) + "\n"
+	}
+	if parking := listing.ParkingText(); parking != "" {
+		text += telegramEscape(parking) + "\n"
+	}
+	if fee := listing.CondoFeeText(); fee != "" {
+		text += telegramEscape(fee) + "\n"
+	}
+	if age := listing.AgeText(); age != "" {
+		text += telegramEscape(age) + "\n"
+	}
+	if openHouse := listing.OpenHouseText(); openHouse != "" {
+		text += telegramEscape(openHouse) + "\n"
+	}
+	if commute := listing.CommuteText(); commute != "" {
+		text += telegramEscape(commute) + "\n"
+	}
+	if agent := listing.AgentText(); agent != "" {
+		text += telegramEscape(agent) + "\n"
+	}
+	text += telegramLink("View on Realtor.ca", listing.URL())
+	if mapURL := listing.MapURL(); mapURL != "" {
+		text += " · " + telegramLink("Map", mapURL)
+	}
+	if listing.TourURL != "" {
+		text += " · " + telegramLink("Virtual tour", listing.TourURL)
+	}
+	return text
+}
+
+func (n *TelegramNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.sendList(ctx, digestSubject(listings), listings)
+}
+
+func (n *TelegramNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.sendList(ctx, comparablesSubject(searchName, listings), listings)
+}
+
+// sendList sends a titled list of listings, cut short with a count of the
+// rest when it gets too long.
+func (n *TelegramNotifier) sendList(ctx context.Context, title string, listings []Listing) error {
+	var out strings.Builder
+	out.WriteString(telegramBold(title) + "\n")
+	for i, listing := range listings {
+		entry := "• " + telegramLink(headline(listing), listing.URL())
+		if listing.NewThisRun {
+			entry = "• " + telegramBold("NEW") + " " + telegramLink(headline(listing), listing.URL())
+		}
+		if price := listing.DisplayPrice(); price != "" {
+			entry += " – " + telegramEscape(price)
+		}
+		entry += "\n"
+
+		more := fmt.Sprintf("…and %d more\n", len(listings)-i)
+		if out.Len()+len(entry)+len(more) > telegramMaxMessageLength {
+			out.WriteString(more)
+			break
+		}
+		out.WriteString(entry)
+	}
+	return n.sendMessage(ctx, out.String())
+}
+
+func (n *TelegramNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	text := telegramBold(searchPrefix(listing)+"Price reduced: "+headline(listing)) + "\n" +
+		telegramEscape(priceChange(listing, oldPrice)) + "\n" +
+		telegramLink("View on Realtor.ca", listing.URL())
+	return n.sendMessage(ctx, text)
+}
+
+func (n *TelegramNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	text := telegramBold(searchPrefix(listing)+"Price raised: "+headline(listing)) + "\n" +
+		telegramEscape(priceChange(listing, oldPrice)) + "\n" +
+		telegramLink("View on Realtor.ca", listing.URL())
+	return n.sendMessage(ctx, text)
+}
+
+func (n *TelegramNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return n.sendMessage(ctx, telegramBold(removedSubject(listing))+"\n"+telegramEscape(removedMessage(listing)))
+}
+
+func (n *TelegramNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	text := telegramBold(changedSubject(listing)) + "\n" +
+		telegramEscape(changeList(changes)) + "\n" +
+		telegramLink("View on Realtor.ca", listing.URL())
+	return n.sendMessage(ctx, text)
+}
+
+func (n *TelegramNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.sendMessage(ctx, telegramBold(heartbeatSubject(searchName))+"\n"+telegramEscape(heartbeatMessage(fetched, lastNotified)))
+}
+
+func (n *TelegramNotifier) sendMessage(ctx context.Context, text string) error {
+	return n.call(ctx, "sendMessage", map[string]string{
+		"chat_id":    n.chatID,
+		"text":       text,
+		"parse_mode": "Markdown",
+	})
+}
+
+// call invokes a Bot API method, turning a response that is not "ok" into
+// an error carrying Telegram's description.
+func (n *TelegramNotifier) call(ctx context.Context, method string, params map[string]string) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", telegramAPIURL+n.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil || !result.OK {
+		return fmt.Errorf("telegram %s failed with HTTP %d: %s", method, response.StatusCode, result.Description)
+	}
+	return nil
+}
+
+// Telegram's legacy Markdown only allows escaping outside of entities, and
+// entities cannot nest, so text inside bold or link markup is stripped of
+// the characters that would end it instead.
+var telegramEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+func telegramEscape(s string) string {
+	return telegramEscaper.Replace(s)
+}
+
+func telegramBold(s string) string {
+	return "*" + strings.Replace(s, "*", "", -1) + "*"
+}
+
+func telegramLink(text, url string) string {
+	return "[" + strings.Replace(text, "]", "", -1) + "](" + url + ")"
+}
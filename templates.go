@@ -0,0 +1,109 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// The formats a message body can be written in. Each backend asks for the
+// one it sends: SMS for terse texts, Markdown for chat apps and HTML for
+// email.
+const (
+	formatPlain    = "plain"
+	formatSMS      = "sms"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// bodyTemplateEnvVars names the variable holding each format's template.
+var bodyTemplateEnvVars = map[string]string{
+	formatPlain:    "BODY_TEMPLATE",
+	formatSMS:      "BODY_TEMPLATE_SMS",
+	formatMarkdown: "BODY_TEMPLATE_MARKDOWN",
+	formatHTML:     "BODY_TEMPLATE_HTML",
+}
+
+// listingTemplate is what text/template and html/template templates have
+// in common.
+type listingTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+	Name() string
+}
+
+// subjectTemplate and bodyTemplates optionally replace the built-in
+// subject and message bodies of new-listing alerts, the latter by format.
+// They are executed on the Listing, so they can use its fields and
+// methods, e.g.
+//
+//	{{.DisplayPrice}} {{.Bedrooms}}bd - {{.Address}}
+//
+// HTML templates are html/templates, which escape what they insert.
+var (
+	subjectTemplate listingTemplate
+	bodyTemplates   = make(map[string]listingTemplate)
+)
+
+// loadTemplates reads the templates from the environment, panicking on one
+// that does not parse.
+func loadTemplates() {
+	subjectTemplate = templateEnvVar("SUBJECT_TEMPLATE", formatPlain)
+	for format, key := range bodyTemplateEnvVars {
+		if t := templateEnvVar(key, format); t != nil {
+			bodyTemplates[format] = t
+		}
+	}
+}
+
+func templateEnvVar(key, format string) listingTemplate {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+
+	var (
+		t   listingTemplate
+		err error
+	)
+	if format == formatHTML {
+		t, err = htmltemplate.New(key).Parse(v)
+	} else {
+		t, err = template.New(key).Parse(v)
+	}
+	if err != nil {
+		panic("Invalid template in environment variable " + key + ": " + err.Error())
+	}
+	return t
+}
+
+// renderTemplate executes t on the listing. It reports false when there is
+// no template or it fails, for the caller to fall back on.
+func renderTemplate(t listingTemplate, listing Listing) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, listing); err != nil {
+		slog.Warn("Failed to render template", "template", t.Name(), "listing_id", listing.ID, "error", err)
+		return "", false
+	}
+	return out.String(), true
+}
+
+// customBody renders the configured template for format on the listing.
+// It reports false when there is none, for the backend to use its own
+// format; a template that fails to render gives the bare listing URL, so
+// the alert still goes out.
+func customBody(format string, listing Listing) (string, bool) {
+	t := bodyTemplates[format]
+	if t == nil {
+		return "", false
+	}
+	if body, ok := renderTemplate(t, listing); ok {
+		return body, true
+	}
+	return listing.URL(), true
+}
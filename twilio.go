@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	twilioAPIURL = "https://api.twilio.com/2010-04-01/Accounts/"
+
+	// Twilio refuses message bodies over 1600 characters.
+	twilioMaxMessageLength = 1600
+
+	twilioChannelSMS      = "sms"
+	twilioChannelWhatsApp = "whatsapp"
+)
+
+// TwilioNotifier sends short text alerts through the Twilio Messaging API,
+// as SMS or WhatsApp messages.
+type TwilioNotifier struct {
+	client     httpClient
+	accountSID string
+	authToken  string
+	from       string
+	to         string
+}
+
+// NewTwilioNotifier returns a notifier sending from one number to another
+// over channel, which is "sms" or "whatsapp".
+func NewTwilioNotifier(client httpClient, accountSID, authToken, from, to, channel string) *TwilioNotifier {
+	if channel == twilioChannelWhatsApp {
+		from, to = "whatsapp:"+from, "whatsapp:"+to
+	}
+	return &TwilioNotifier{
+		client:     client,
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+		to:         to,
+	}
+}
+
+func (n *TwilioNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	if text, ok := customBody(formatSMS, listing); ok {
+		return n.send(ctx, text)
+	}
+	text := searchPrefix(listing) + "New: " + listing.DisplayPrice()
+	if listing.Address != "" {
+		text += " - " + listing.Address
+	}
+	return n.send(ctx, text+"\n"+listing.ShortURL())
+}
+
+func (n *TwilioNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.sendList(ctx, digestSubject(listings), listings)
+}
+
+func (n *TwilioNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.sendList(ctx, comparablesSubject(searchName, listings), listings)
+}
+
+// sendList sends a titled list of listings, one line each, cut short with
+// a count of the rest when it gets too long.
+func (n *TwilioNotifier) sendList(ctx context.Context, title string, listings []Listing) error {
+	var out strings.Builder
+	out.WriteString(title + "\n")
+	for i, listing := range listings {
+		entry := newMarker(listing) + listing.DisplayPrice() + " " + headline(listing) + " " + listing.ShortURL() + "\n"
+
+		more := fmt.Sprintf("...and %d more", len(listings)-i)
+		if out.Len()+len(entry)+len(more) > twilioMaxMessageLength {
+			out.WriteString(more)
+			break
+		}
+		out.WriteString(entry)
+	}
+	return n.send(ctx, strings.TrimSuffix(out.String(), "\n"))
+}
+
+func (n *TwilioNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	text := searchPrefix(listing) + "Price drop: " + formatDollars(oldPrice) + " -> " + formatDollars(listing.PriceAmount)
+	if listing.Address != "" {
+		text += " - " + listing.Address
+	}
+	return n.send(ctx, text+"\n"+listing.ShortURL())
+}
+
+func (n *TwilioNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	text := searchPrefix(listing) + "Price up: " + formatDollars(oldPrice) + " -> " + formatDollars(listing.PriceAmount)
+	if listing.Address != "" {
+		text += " - " + listing.Address
+	}
+	return n.send(ctx, text+"\n"+listing.ShortURL())
+}
+
+func (n *TwilioNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return n.send(ctx, smsRemovedMessage(listing))
+}
+
+func (n *TwilioNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	return n.send(ctx, changedSubject(listing)+"\n"+changeList(changes)+"\n"+listing.ShortURL())
+}
+
+func (n *TwilioNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.send(ctx, heartbeatSubject(searchName)+"\n"+heartbeatMessage(fetched, lastNotified))
+}
+
+// send creates a message, turning an error response into an error carrying
+// Twilio's code and message.
+func (n *TwilioNotifier) send(ctx context.Context, text string) error {
+	form := url.Values{
+		"From": {n.from},
+		"To":   {n.to},
+		"Body": {truncate(text, twilioMaxMessageLength)},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", twilioAPIURL+n.accountSID+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(n.accountSID, n.authToken)
+
+	response, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil || result.Message == "" {
+		return fmt.Errorf("twilio send failed with HTTP %d", response.StatusCode)
+	}
+	return fmt.Errorf("twilio send failed with HTTP %d: error %d: %s", response.StatusCode, result.Code, result.Message)
+}
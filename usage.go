@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+const (
+	// dynamoUsagePartitionKey holds one item per calendar month, sorted by
+	// "2006-01", counting the notifications each backend sent in it.
+	dynamoUsagePartitionKey = "usage"
+
+	usageMonthFormat = "2006-01"
+
+	// usageReportedAttribute marks a month whose usage report was sent.
+	usageReportedAttribute = "reported"
+)
+
+// usageReport sends the operator topic a summary of the notifications sent
+// the month before, on the first run of each month.
+var usageReport bool
+
+// Usage counts the notifications delivered by each backend during a run, to
+// be added to the month's totals in DynamoDB. This is a rough self-check of
+// how many messages are going out, not a bill.
+type Usage struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func NewUsage() *Usage {
+	return &Usage{counts: make(map[string]int)}
+}
+
+func (u *Usage) add(backend string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counts[backend]++
+}
+
+// Flush adds the run's counts to the totals of the month of now and returns
+// the month's totals so far. Nothing is written when nothing was sent.
+func (u *Usage) Flush(ctx context.Context, dynamo dynamoAPI, now time.Time) (map[string]int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := usageKey(now)
+	if len(u.counts) == 0 {
+		item, err := dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			Key:       key,
+			TableName: aws.String(dynamoTableName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return usageCounts(item.Item), nil
+	}
+
+	var (
+		adds   []string
+		names  = make(map[string]*string)
+		values = make(map[string]*dynamodb.AttributeValue)
+	)
+	for i, backend := range sortedBackends(u.counts) {
+		n := strconv.Itoa(i)
+		adds = append(adds, "#b"+n+" :n"+n)
+		names["#b"+n] = aws.String(backend)
+		values[":n"+n] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(u.counts[backend]))}
+	}
+	output, err := dynamo.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                       key,
+		UpdateExpression:          aws.String("ADD " + strings.Join(adds, ", ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		TableName:                 aws.String(dynamoTableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.counts = make(map[string]int)
+	return usageCounts(output.Attributes), nil
+}
+
+// ReportPreviousMonth publishes the totals of the month before now to the
+// topic, once: the month is marked reported in the same conditional write
+// that claims it, so concurrent runs do not both send it.
+func ReportPreviousMonth(ctx context.Context, dynamo dynamoAPI, client snsAPI, topicArn string, now time.Time) error {
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	output, err := dynamo.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                      usageKey(month),
+		UpdateExpression:         aws.String("SET #r = :t"),
+		ConditionExpression:      aws.String("attribute_exists(#pk) AND attribute_not_exists(#r)"),
+		ExpressionAttributeNames: map[string]*string{"#pk": aws.String(dynamoPartitionKeyName), "#r": aws.String(usageReportedAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {BOOL: aws.Bool(true)}},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		TableName:    aws.String(dynamoTableName),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PublishWithContext(ctx, &sns.PublishInput{
+		Subject:  aws.String("Realtorca usage for " + month.Format("January 2006")),
+		Message:  aws.String(usageMessage(usageCounts(output.Attributes), "last month")),
+		TopicArn: aws.String(topicArn),
+	})
+	return err
+}
+
+// usageMessage reads e.g. "You sent 312 alerts this month (sns 300,
+// telegram 12)."
+func usageMessage(counts map[string]int, period string) string {
+	total := 0
+	var parts []string
+	for _, backend := range sortedBackends(counts) {
+		total += counts[backend]
+		parts = append(parts, backend+" "+strconv.Itoa(counts[backend]))
+	}
+	message := fmt.Sprintf("You sent %d alerts %s", total, period)
+	if total == 1 {
+		message = "You sent 1 alert " + period
+	}
+	if len(parts) > 1 {
+		message += " (" + strings.Join(parts, ", ") + ")"
+	}
+	return message + "."
+}
+
+func usageKey(month time.Time) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamoPartitionKeyName: {S: aws.String(dynamoUsagePartitionKey)},
+		dynamoSortKeyName:      {S: aws.String(month.UTC().Format(usageMonthFormat))},
+	}
+}
+
+// usageCounts picks the backend counts out of a usage item.
+func usageCounts(item map[string]*dynamodb.AttributeValue) map[string]int {
+	counts := make(map[string]int)
+	for name, value := range item {
+		if value.N == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(aws.StringValue(value.N)); err == nil {
+			counts[name] = n
+		}
+	}
+	return counts
+}
+
+func sortedBackends(counts map[string]int) []string {
+	backends := make([]string, 0, len(counts))
+	for backend := range counts {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+// countedNotifier counts the notifications its backend delivers into usage.
+type countedNotifier struct {
+	name  string
+	next  Notifier
+	usage *Usage
+}
+
+func (n countedNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	return n.count(n.next.SendListingAlert(ctx, listing))
+}
+
+func (n countedNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.count(n.next.SendDigest(ctx, listings))
+}
+
+func (n countedNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.count(n.next.SendPriceDropAlert(ctx, listing, oldPrice))
+}
+
+func (n countedNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	return n.count(n.next.SendPriceIncreaseAlert(ctx, listing, oldPrice))
+}
+
+func (n countedNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	return n.count(n.next.SendRemovedAlert(ctx, listing))
+}
+
+func (n countedNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	return n.count(n.next.SendChangedAlert(ctx, listing, changes))
+}
+
+func (n countedNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.count(n.next.SendHeartbeat(ctx, searchName, fetched, lastNotified))
+}
+
+func (n countedNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.count(n.next.SendComparables(ctx, searchName, listings))
+}
+
+func (n countedNotifier) count(err error) error {
+	if err == nil {
+		n.usage.add(n.name)
+	}
+	return err
+}
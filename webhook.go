@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// keyed with WEBHOOK_SECRET, so receivers can check a request came from
+// us.
+const webhookSignatureHeader = "X-Realtorca-Signature"
+
+// WebhookNotifier POSTs every alert as JSON to a URL of the user's
+// choosing, for feeding into their own automations.
+type WebhookNotifier struct {
+	client  httpClient
+	url     string
+	secret  string
+	headers http.Header
+}
+
+// NewWebhookNotifier returns a notifier posting to url. Requests are
+// signed when secret is not empty, and carry headers as well as the usual
+// ones.
+func NewWebhookNotifier(client httpClient, url, secret string, headers http.Header) *WebhookNotifier {
+	return &WebhookNotifier{client: client, url: url, secret: secret, headers: headers}
+}
+
+// webhookEvent is the body of a webhook request. Event says which kind of
+// alert it is, and decides which of the other fields are set.
+type webhookEvent struct {
+	Event        string          `json:"event"`
+	SearchName   string          `json:"search_name,omitempty"`
+	Listing      *jsonListing    `json:"listing,omitempty"`
+	Listings     []jsonListing   `json:"listings,omitempty"`
+	OldPrice     int             `json:"old_price,omitempty"`
+	Changes      []webhookChange `json:"changes,omitempty"`
+	Fetched      int             `json:"fetched,omitempty"`
+	LastNotified *time.Time      `json:"last_notified,omitempty"`
+	SentAt       time.Time       `json:"sent_at"`
+}
+
+// jsonListing is the JSON form of a Listing, for webhooks and exports. It
+// is kept apart from Listing so consumers see stable field names.
+type jsonListing struct {
+	ID                string     `json:"id"`
+	URL               string     `json:"url"`
+	MapURL            string     `json:"map_url,omitempty"`
+	Price             string     `json:"price,omitempty"`
+	PriceAmount       int        `json:"price_amount,omitempty"`
+	Address           string     `json:"address,omitempty"`
+	Latitude          float64    `json:"latitude,omitempty"`
+	Longitude         float64    `json:"longitude,omitempty"`
+	Bedrooms          string     `json:"bedrooms,omitempty"`
+	Bathrooms         string     `json:"bathrooms,omitempty"`
+	SizeInterior      string     `json:"size_interior,omitempty"`
+	SquareFeet        int        `json:"square_feet,omitempty"`
+	Description       string     `json:"description,omitempty"`
+	PhotoURL          string     `json:"photo_url,omitempty"`
+	TourURL           string     `json:"tour_url,omitempty"`
+	Status            string     `json:"status,omitempty"`
+	YearBuilt         int        `json:"year_built,omitempty"`
+	PropertyType      string     `json:"property_type,omitempty"`
+	CondoFee          int        `json:"condo_fee,omitempty"`
+	CondoFeeRaw       string     `json:"condo_fee_raw,omitempty"`
+	Currency          string     `json:"currency,omitempty"`
+	ConvertedPrice    int        `json:"converted_price,omitempty"`
+	ConvertedCurrency string     `json:"converted_currency,omitempty"`
+	NewThisRun        bool       `json:"new_this_run,omitempty"`
+	LotSize           string     `json:"lot_size,omitempty"`
+	CommuteMinutes    int        `json:"commute_minutes,omitempty"`
+	Parking           []string   `json:"parking,omitempty"`
+	ListedAt          *time.Time `json:"listed_at,omitempty"`
+	Brokerage         string     `json:"brokerage,omitempty"`
+	AgentName         string     `json:"agent_name,omitempty"`
+	AgentPhone        string     `json:"agent_phone,omitempty"`
+	SearchName        string     `json:"search_name,omitempty"`
+	ForRent           bool       `json:"for_rent,omitempty"`
+}
+
+func newJSONListing(listing Listing) jsonListing {
+	l := jsonListing{
+		ID:                listing.ID,
+		URL:               listing.URL(),
+		MapURL:            listing.MapURL(),
+		Price:             listing.Price,
+		PriceAmount:       listing.PriceAmount,
+		Address:           listing.Address,
+		Latitude:          listing.Latitude,
+		Longitude:         listing.Longitude,
+		Bedrooms:          listing.Bedrooms,
+		Bathrooms:         listing.Bathrooms,
+		SizeInterior:      listing.SizeInterior,
+		SquareFeet:        listing.SquareFeet,
+		Description:       listing.Description,
+		PhotoURL:          listing.PhotoURL,
+		TourURL:           listing.TourURL,
+		Status:            listing.Status,
+		YearBuilt:         listing.YearBuilt,
+		PropertyType:      listing.PropertyType,
+		CondoFee:          listing.CondoFee,
+		CondoFeeRaw:       listing.CondoFeeRaw,
+		Currency:          listing.Currency,
+		ConvertedPrice:    listing.ConvertedPrice,
+		ConvertedCurrency: listing.ConvertedCurrency,
+		NewThisRun:        listing.NewThisRun,
+		LotSize:           listing.LotSize,
+		CommuteMinutes:    listing.CommuteMinutes,
+		Parking:           listing.Parking,
+		Brokerage:         listing.Brokerage,
+		AgentName:         listing.AgentName,
+		AgentPhone:        listing.AgentPhone,
+		SearchName:        listing.SearchName,
+		ForRent:           listing.ForRent,
+	}
+	if !listing.ListedAt.IsZero() {
+		l.ListedAt = &listing.ListedAt
+	}
+	return l
+}
+
+func newJSONListings(listings []Listing) []jsonListing {
+	ret := make([]jsonListing, len(listings))
+	for i, listing := range listings {
+		ret[i] = newJSONListing(listing)
+	}
+	return ret
+}
+
+type webhookChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+func newWebhookChanges(changes []FieldChange) []webhookChange {
+	ret := make([]webhookChange, len(changes))
+	for i, change := range changes {
+		ret[i] = webhookChange{Field: change.Field, Old: change.Old, New: change.New}
+	}
+	return ret
+}
+
+func (n *WebhookNotifier) SendListingAlert(ctx context.Context, listing Listing) error {
+	l := newJSONListing(listing)
+	return n.post(ctx, webhookEvent{Event: "new_listing", SearchName: listing.SearchName, Listing: &l})
+}
+
+func (n *WebhookNotifier) SendDigest(ctx context.Context, listings []Listing) error {
+	return n.post(ctx, webhookEvent{Event: "digest", SearchName: listings[0].SearchName, Listings: newJSONListings(listings)})
+}
+
+func (n *WebhookNotifier) SendComparables(ctx context.Context, searchName string, listings []Listing) error {
+	return n.post(ctx, webhookEvent{Event: "comparables", SearchName: searchName, Listings: newJSONListings(listings)})
+}
+
+func (n *WebhookNotifier) SendPriceDropAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	l := newJSONListing(listing)
+	return n.post(ctx, webhookEvent{Event: "price_drop", SearchName: listing.SearchName, Listing: &l, OldPrice: oldPrice})
+}
+
+func (n *WebhookNotifier) SendPriceIncreaseAlert(ctx context.Context, listing Listing, oldPrice int) error {
+	l := newJSONListing(listing)
+	return n.post(ctx, webhookEvent{Event: "price_increase", SearchName: listing.SearchName, Listing: &l, OldPrice: oldPrice})
+}
+
+func (n *WebhookNotifier) SendRemovedAlert(ctx context.Context, listing Listing) error {
+	l := newJSONListing(listing)
+	return n.post(ctx, webhookEvent{Event: "removed", SearchName: listing.SearchName, Listing: &l})
+}
+
+func (n *WebhookNotifier) SendChangedAlert(ctx context.Context, listing Listing, changes []FieldChange) error {
+	l := newJSONListing(listing)
+	return n.post(ctx, webhookEvent{Event: "changed", SearchName: listing.SearchName, Listing: &l, Changes: newWebhookChanges(changes)})
+}
+
+func (n *WebhookNotifier) SendHeartbeat(ctx context.Context, searchName string, fetched int, lastNotified time.Time) error {
+	return n.post(ctx, webhookEvent{Event: "heartbeat", SearchName: searchName, Fetched: fetched, LastNotified: &lastNotified})
+}
+
+// post sends event, treating any response other than 2xx as an error.
+func (n *WebhookNotifier) post(ctx context.Context, event webhookEvent) error {
+	event.SentAt = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range n.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("webhook %s failed with HTTP %d: %s", event.Event, response.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// parseWebhookHeaders parses WEBHOOK_HEADERS, a comma-separated list of
+// "Name: value" pairs.
+func parseWebhookHeaders(v string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, item := range splitList(v) {
+		name, value, ok := strings.Cut(item, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header %q is not of the form Name: value", item)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return headers, nil
+}